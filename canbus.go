@@ -2,18 +2,20 @@ package juicer
 
 import (
 	"context"
+	"github.com/brutella/can"
 	"github.com/jd3nn1s/juicer/lemoncan"
-	log "github.com/sirupsen/logrus"
 )
 
 type canBusRetryable struct {
+	UpdateSender
 	c        CANBus
-	sendChan chan<- canSensorData
+	portName string
 	data     canSensorData
+	capture  Capturer
 }
 
 func (bus *canBusRetryable) Open() error {
-	c, err := canBusConnect(canBusPortName)
+	c, err := canBusConnect(bus.portName)
 	if err == nil {
 		bus.c = c
 	}
@@ -41,14 +43,19 @@ func (bus *canBusRetryable) Start(ctx context.Context) error {
 			bus.data.OilTemp = v
 			bus.send()
 		},
+		Frame: func(frame can.Frame) {
+			if bus.capture != nil {
+				bus.capture.CANFrame(frame)
+			}
+		},
 	})
 }
 
 func (bus *canBusRetryable) send() {
-	select {
-	case bus.sendChan <- bus.data:
-	default:
-	}
+	bus.Send(Update{
+		Source: bus.Name(),
+		Values: bus.data.values(),
+	})
 }
 
 func (bus *canBusRetryable) Name() string {
@@ -59,16 +66,9 @@ var canBusConnect = func(p string) (CANBus, error) {
 	return lemoncan.Connect(p)
 }
 
-func newCANBus(sendChan chan<- canSensorData) *canBusRetryable {
+func newCANBus(portName string) *canBusRetryable {
 	return &canBusRetryable{
-		sendChan: sendChan,
-	}
-}
-
-func (bus *canBusRetryable) runCAN(ctx context.Context) {
-	err := retry(ctx, bus)
-	if err != nil {
-		log.Errorf("canbus done: %v", err)
+		portName: portName,
 	}
 }
 
@@ -20,9 +20,8 @@ func TestRunCANBus(t *testing.T) {
 		return stub, nil
 	}
 
-	canBusRetryable := &canBusRetryable{
-		sendChan: jc.canSensorChan,
-	}
+	canBusRetryable := &canBusRetryable{}
+	canBusRetryable.SetUpdateChan(jc.updateChan)
 
 	// close before opening
 	assert.NoError(t, canBusRetryable.Close())
@@ -38,28 +37,31 @@ func TestRunCANBus(t *testing.T) {
 	}()
 	<-stub.startChan
 
-	expectedData := canSensorData{}
+	expectedTelem := Telemetry{}
+	telem := Telemetry{}
 
 	stub.fnChan <- func() {
 		stub.callbacks.CoolantTemp(1)
 	}
-	data := <-jc.canSensorChan
-	expectedData.CoolantTemp = 1
-	assert.Equal(t, expectedData, data)
+	update := <-jc.updateChan
+	assert.Equal(t, "canbus", update.Source)
+	telem.Apply(update)
+	expectedTelem.CoolantTemp = 1
+	assert.True(t, sameValues(expectedTelem, telem))
 
 	stub.fnChan <- func() {
 		stub.callbacks.OilTemp(2)
 	}
-	data = <-jc.canSensorChan
-	expectedData.OilTemp = 2
-	assert.Equal(t, expectedData, data)
+	telem.Apply(<-jc.updateChan)
+	expectedTelem.OilTemp = 2
+	assert.True(t, sameValues(expectedTelem, telem))
 
 	stub.fnChan <- func() {
 		stub.callbacks.Fuel(3)
 	}
-	data = <-jc.canSensorChan
-	expectedData.FuelLevel = 3
-	assert.Equal(t, expectedData, data)
+	telem.Apply(<-jc.updateChan)
+	expectedTelem.FuelLevel = 3
+	assert.True(t, sameValues(expectedTelem, telem))
 
 	cancel()
 	wg.Wait()
@@ -8,15 +8,27 @@ type CANForwarder struct {
 	canSensorBus *canBusRetryable
 }
 
-func (fwd *CANForwarder) Forward(prevTelemetry *Telemetry, newTelemetry *Telemetry) error {
-	if prevTelemetry.Speed != newTelemetry.Speed {
-		canBus := fwd.canSensorBus.CANBus()
-		if canBus == nil {
-			return errors.New("canbus is not initialized")
-		}
+func (fwd *CANForwarder) Forward(newTelemetry *Telemetry, prevTelemetry *Telemetry) error {
+	sendSpeed := prevTelemetry.Speed != newTelemetry.Speed
+	// a stale delta is not shown on the dash
+	sendDelta := prevTelemetry.Delta != newTelemetry.Delta &&
+		!newTelemetry.Stale.Has(ChannelDelta)
+	if !sendSpeed && !sendDelta {
+		return nil
+	}
+	canBus := fwd.canSensorBus.CANBus()
+	if canBus == nil {
+		return errors.New("canbus is not initialized")
+	}
+	if sendSpeed {
 		if err := canBus.SendSpeed(int(newTelemetry.Speed)); err != nil {
 			return errors.Wrapf(err, "unable to send speed to CAN bus")
 		}
 	}
+	if sendDelta {
+		if err := canBus.SendDelta(int(newTelemetry.Delta * 1000)); err != nil {
+			return errors.Wrapf(err, "unable to send delta to CAN bus")
+		}
+	}
 	return nil
 }
@@ -0,0 +1,336 @@
+package juicer
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Channel identifies a single value of Telemetry.
+type Channel uint8
+
+const (
+	ChannelRPM Channel = iota + 1
+	ChannelOilPressure
+	ChannelSpeed
+	ChannelFuelRemaining
+	ChannelFuelLevel
+	ChannelOilTemp
+	ChannelCoolantTemp
+	ChannelAirIntakeTemp
+	ChannelBatteryVoltage
+	ChannelLatitude
+	ChannelLongitude
+	ChannelAltitude
+	ChannelTrack
+	ChannelGPSSpeed
+	ChannelGasPedalAngle
+	ChannelLap
+	ChannelLastLapTime
+	ChannelBestLapTime
+	ChannelSector
+	ChannelLastSectorTime
+	ChannelDelta
+	ChannelLinkLoss
+	ChannelLinkRTT
+	ChannelLinkJitter
+
+	// must be the last channel
+	maxChannel = iota
+)
+
+// ChannelKind is the type of the Telemetry field of a channel.
+type ChannelKind uint8
+
+const (
+	KindFloat32 ChannelKind = iota + 1
+	KindFloat64
+	KindUint8
+	KindUint16
+)
+
+// Size returns the size of a value of the kind in bytes.
+func (k ChannelKind) Size() int {
+	switch k {
+	case KindFloat32:
+		return 4
+	case KindFloat64:
+		return 8
+	case KindUint8:
+		return 1
+	case KindUint16:
+		return 2
+	}
+	return 0
+}
+
+type channelInfo struct {
+	name string
+	kind ChannelKind
+	// name of the source that updates the channel
+	source string
+	unit   string
+	// nominal rate the source updates the channel at, in Hz
+	sampleRate int
+}
+
+var channelTable = [maxChannel + 1]channelInfo{
+	ChannelRPM:            {"RPM", KindFloat32, "ecu", "rpm", 5},
+	ChannelOilPressure:    {"OilPressure", KindFloat32, "ecu", "bar", 5},
+	ChannelSpeed:          {"Speed", KindFloat32, "ecu", "km/h", 5},
+	ChannelFuelRemaining:  {"FuelRemaining", KindFloat32, "canbus", "l", 2},
+	ChannelFuelLevel:      {"FuelLevel", KindUint8, "canbus", "%", 2},
+	ChannelOilTemp:        {"OilTemp", KindFloat32, "canbus", "degC", 2},
+	ChannelCoolantTemp:    {"CoolantTemp", KindFloat32, "canbus", "degC", 2},
+	ChannelAirIntakeTemp:  {"AirIntakeTemp", KindFloat32, "ecu", "degC", 5},
+	ChannelBatteryVoltage: {"BatteryVoltage", KindFloat32, "ecu", "V", 5},
+	ChannelLatitude:       {"Latitude", KindFloat64, "gps", "deg", 10},
+	ChannelLongitude:      {"Longitude", KindFloat64, "gps", "deg", 10},
+	ChannelAltitude:       {"Altitude", KindFloat32, "gps", "m", 10},
+	ChannelTrack:          {"Track", KindFloat32, "gps", "rad", 10},
+	ChannelGPSSpeed:       {"GPSSpeed", KindFloat32, "gps", "cm/s", 10},
+	ChannelGasPedalAngle:  {"GasPedalAngle", KindUint8, "ecu", "deg", 5},
+	ChannelLap:            {"Lap", KindUint16, lapTimerName, "", 10},
+	ChannelLastLapTime:    {"LastLapTime", KindFloat32, lapTimerName, "s", 10},
+	ChannelBestLapTime:    {"BestLapTime", KindFloat32, lapTimerName, "s", 10},
+	ChannelSector:         {"Sector", KindUint8, lapTimerName, "", 10},
+	ChannelLastSectorTime: {"LastSectorTime", KindFloat32, lapTimerName, "s", 10},
+	ChannelDelta:          {"Delta", KindFloat32, lapTimerName, "s", 10},
+	ChannelLinkLoss:       {"LinkLoss", KindFloat32, LinkSourceName, "%", 1},
+	ChannelLinkRTT:        {"LinkRTT", KindFloat32, LinkSourceName, "ms", 1},
+	ChannelLinkJitter:     {"LinkJitter", KindFloat32, LinkSourceName, "ms", 1},
+}
+
+// ChannelSet is a set of channels.
+type ChannelSet uint64
+
+// fails to compile if there are too many channels for a ChannelSet
+var _ = [64 - maxChannel - 1]struct{}{}
+
+func (s ChannelSet) Has(ch Channel) bool {
+	return s&(1<<ch) != 0
+}
+
+func (s *ChannelSet) Add(ch Channel) {
+	*s |= 1 << ch
+}
+
+func (s *ChannelSet) Remove(ch Channel) {
+	*s &^= 1 << ch
+}
+
+// Channels returns every channel in order.
+func Channels() []Channel {
+	chs := make([]Channel, 0, maxChannel)
+	for ch := Channel(1); ch <= maxChannel; ch++ {
+		chs = append(chs, ch)
+	}
+	return chs
+}
+
+func (ch Channel) Valid() bool {
+	return ch > 0 && ch <= maxChannel
+}
+
+func (ch Channel) String() string {
+	if !ch.Valid() {
+		return "Unknown"
+	}
+	return channelTable[ch].name
+}
+
+// Kind returns the type of the channel's Telemetry field, or 0 for an
+// unknown channel.
+func (ch Channel) Kind() ChannelKind {
+	if !ch.Valid() {
+		return 0
+	}
+	return channelTable[ch].kind
+}
+
+// Source returns the name of the built-in source that updates the channel.
+func (ch Channel) Source() string {
+	if !ch.Valid() {
+		return ""
+	}
+	return channelTable[ch].source
+}
+
+// Unit returns the unit of the channel's value, or "" if it is a count.
+func (ch Channel) Unit() string {
+	if !ch.Valid() {
+		return ""
+	}
+	return channelTable[ch].unit
+}
+
+// SampleRate returns the nominal rate the channel is updated at in Hz, or 0
+// for an unknown channel. Exports to formats with a fixed rate per channel
+// are sampled at this rate.
+func (ch Channel) SampleRate() int {
+	if !ch.Valid() {
+		return 0
+	}
+	return channelTable[ch].sampleRate
+}
+
+// ParseChannel returns the channel with the given name.
+func ParseChannel(name string) (Channel, error) {
+	for _, ch := range Channels() {
+		if channelTable[ch].name == name {
+			return ch, nil
+		}
+	}
+	return 0, errors.Errorf("unknown channel %q", name)
+}
+
+// ChannelValue is the value of a single channel sent by a Source.
+type ChannelValue struct {
+	Channel Channel
+	Value   float64
+}
+
+// Get returns the value of a channel, or 0 for an unknown channel.
+func (t *Telemetry) Get(ch Channel) float64 {
+	switch ch {
+	case ChannelRPM:
+		return float64(t.RPM)
+	case ChannelOilPressure:
+		return float64(t.OilPressure)
+	case ChannelSpeed:
+		return float64(t.Speed)
+	case ChannelFuelRemaining:
+		return float64(t.FuelRemaining)
+	case ChannelFuelLevel:
+		return float64(t.FuelLevel)
+	case ChannelOilTemp:
+		return float64(t.OilTemp)
+	case ChannelCoolantTemp:
+		return float64(t.CoolantTemp)
+	case ChannelAirIntakeTemp:
+		return float64(t.AirIntakeTemp)
+	case ChannelBatteryVoltage:
+		return float64(t.BatteryVoltage)
+	case ChannelLatitude:
+		return t.Latitude
+	case ChannelLongitude:
+		return t.Longitude
+	case ChannelAltitude:
+		return float64(t.Altitude)
+	case ChannelTrack:
+		return float64(t.Track)
+	case ChannelGPSSpeed:
+		return float64(t.GPSSpeed)
+	case ChannelGasPedalAngle:
+		return float64(t.GasPedalAngle)
+	case ChannelLap:
+		return float64(t.Lap)
+	case ChannelLastLapTime:
+		return float64(t.LastLapTime)
+	case ChannelBestLapTime:
+		return float64(t.BestLapTime)
+	case ChannelSector:
+		return float64(t.Sector)
+	case ChannelLastSectorTime:
+		return float64(t.LastSectorTime)
+	case ChannelDelta:
+		return float64(t.Delta)
+	case ChannelLinkLoss:
+		return float64(t.LinkLoss)
+	case ChannelLinkRTT:
+		return float64(t.LinkRTT)
+	case ChannelLinkJitter:
+		return float64(t.LinkJitter)
+	}
+	return 0
+}
+
+// Set sets the value of a channel, converting it to the type of the
+// Telemetry field. Unknown channels are ignored.
+func (t *Telemetry) Set(ch Channel, v float64) {
+	switch ch {
+	case ChannelRPM:
+		t.RPM = float32(v)
+	case ChannelOilPressure:
+		t.OilPressure = float32(v)
+	case ChannelSpeed:
+		t.Speed = float32(v)
+	case ChannelFuelRemaining:
+		t.FuelRemaining = float32(v)
+	case ChannelFuelLevel:
+		t.FuelLevel = uint8(v)
+	case ChannelOilTemp:
+		t.OilTemp = float32(v)
+	case ChannelCoolantTemp:
+		t.CoolantTemp = float32(v)
+	case ChannelAirIntakeTemp:
+		t.AirIntakeTemp = float32(v)
+	case ChannelBatteryVoltage:
+		t.BatteryVoltage = float32(v)
+	case ChannelLatitude:
+		t.Latitude = v
+	case ChannelLongitude:
+		t.Longitude = v
+	case ChannelAltitude:
+		t.Altitude = float32(v)
+	case ChannelTrack:
+		t.Track = float32(v)
+	case ChannelGPSSpeed:
+		t.GPSSpeed = float32(v)
+	case ChannelGasPedalAngle:
+		t.GasPedalAngle = uint8(v)
+	case ChannelLap:
+		t.Lap = uint16(v)
+	case ChannelLastLapTime:
+		t.LastLapTime = float32(v)
+	case ChannelBestLapTime:
+		t.BestLapTime = float32(v)
+	case ChannelSector:
+		t.Sector = uint8(v)
+	case ChannelLastSectorTime:
+		t.LastSectorTime = float32(v)
+	case ChannelDelta:
+		t.Delta = float32(v)
+	case ChannelLinkLoss:
+		t.LinkLoss = float32(v)
+	case ChannelLinkRTT:
+		t.LinkRTT = float32(v)
+	case ChannelLinkJitter:
+		t.LinkJitter = float32(v)
+	}
+}
+
+// Apply sets all the channel values of an update. If the update has a time
+// it is recorded as when the channels were last updated.
+func (t *Telemetry) Apply(update Update) {
+	var ns int64
+	if !update.Time.IsZero() {
+		ns = update.Time.UnixNano()
+		t.Time = ns
+	}
+	for _, v := range update.Values {
+		if !v.Channel.Valid() {
+			continue
+		}
+		t.Set(v.Channel, v.Value)
+		if ns != 0 {
+			t.Updated[v.Channel] = ns
+		}
+	}
+}
+
+// UpdatedAt returns when a channel was last updated, or the zero time if it
+// never has been.
+func (t *Telemetry) UpdatedAt(ch Channel) time.Time {
+	if !ch.Valid() || t.Updated[ch] == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t.Updated[ch])
+}
+
+// sameValues reports whether a and b have the same channel values and
+// staleness, ignoring when they were updated.
+func sameValues(a, b Telemetry) bool {
+	a.Time, a.Monotonic, a.Updated = 0, 0, [maxChannel + 1]int64{}
+	b.Time, b.Monotonic, b.Updated = 0, 0, [maxChannel + 1]int64{}
+	return a == b
+}
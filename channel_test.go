@@ -0,0 +1,77 @@
+package juicer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChannelGetSet(t *testing.T) {
+	telem := Telemetry{}
+	for _, ch := range Channels() {
+		telem.Set(ch, float64(ch))
+	}
+	for _, ch := range Channels() {
+		assert.Equal(t, float64(ch), telem.Get(ch), ch.String())
+	}
+	assert.Equal(t, float32(ChannelRPM), telem.RPM)
+	assert.Equal(t, uint8(ChannelGasPedalAngle), telem.GasPedalAngle)
+
+	// unknown channels are ignored
+	prev := telem
+	telem.Set(maxChannel+1, 100)
+	assert.Equal(t, prev, telem)
+	assert.Equal(t, float64(0), telem.Get(0))
+}
+
+func TestChannelString(t *testing.T) {
+	assert.Len(t, Channels(), int(maxChannel))
+	for _, ch := range Channels() {
+		assert.NotEmpty(t, channelTable[ch].name)
+		assert.NotZero(t, ch.Kind().Size(), ch.String())
+		assert.NotZero(t, ch.SampleRate(), ch.String())
+	}
+	assert.Equal(t, "OilTemp", ChannelOilTemp.String())
+	assert.Equal(t, "Unknown", Channel(0).String())
+	assert.Equal(t, KindFloat64, ChannelLatitude.Kind())
+	assert.Equal(t, ChannelKind(0), Channel(0).Kind())
+	assert.Equal(t, "degC", ChannelOilTemp.Unit())
+	assert.Equal(t, "", Channel(0).Unit())
+	assert.Equal(t, 10, ChannelLatitude.SampleRate())
+	assert.Equal(t, 0, Channel(0).SampleRate())
+}
+
+func TestParseChannel(t *testing.T) {
+	for _, ch := range Channels() {
+		parsed, err := ParseChannel(ch.String())
+		assert.NoError(t, err)
+		assert.Equal(t, ch, parsed)
+	}
+	_, err := ParseChannel("Unknown")
+	assert.Error(t, err)
+}
+
+func TestApply(t *testing.T) {
+	telem := Telemetry{}
+	telem.Apply(Update{
+		Values: []ChannelValue{
+			{ChannelOilTemp, 90},
+			{ChannelLatitude, 51.5},
+		},
+	})
+	assert.Equal(t, Telemetry{
+		OilTemp:  90,
+		Latitude: 51.5,
+	}, telem)
+}
+
+func TestChannelSet(t *testing.T) {
+	var s ChannelSet
+	assert.False(t, s.Has(ChannelRPM))
+	s.Add(ChannelRPM)
+	s.Add(maxChannel)
+	assert.True(t, s.Has(ChannelRPM))
+	assert.True(t, s.Has(maxChannel))
+	assert.False(t, s.Has(ChannelOilTemp))
+	s.Remove(ChannelRPM)
+	assert.False(t, s.Has(ChannelRPM))
+}
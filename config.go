@@ -0,0 +1,229 @@
+package juicer
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config is the daemon configuration, normally loaded from juicer.toml:
+//
+//	retrySleep = "1s"
+//	shutdownTimeout = "5s"
+//
+//	[ecu]
+//	enabled = true
+//	port = "/dev/obd"
+//	staleTimeout = "3s"
+//
+//	[gps]
+//	enabled = true
+//	port = "/dev/ttyAMA0"
+//	maxHDOP = 500
+//	staleTimeout = "3s"
+//
+//	[canbus]
+//	enabled = true
+//	interface = "can0"
+//	staleTimeout = "3s"
+//
+//	[track]
+//	enabled = true
+//	name = "Thunderhill"
+//	startFinish = [[39.5401, -122.3310], [39.5399, -122.3307]]
+//	sectors = [
+//	  [[39.5367, -122.3288], [39.5365, -122.3284]],
+//	  [[39.5344, -122.3352], [39.5341, -122.3349]],
+//	]
+//	minLapTime = "20s"
+//
+//	[[forwarder]]
+//	type = "udp"
+//	mode = "broadcast"
+//	carID = 7
+//	sendRateLimit = "50ms"
+//	batchSize = 10
+//	batchInterval = "500ms"
+//	keyframeInterval = "10s"
+//	redundancy = 2
+//	key = "<openssl rand -hex 32>"
+//	encrypt = true
+//
+//	[[forwarder.destination]]
+//	server = "192.168.1.10"
+//	port = 5000
+//
+//	[[forwarder.destination]]
+//	server = "pit.example.com"
+//	port = 5000
+//	sendRateLimit = "1s"
+//
+//	[[forwarder]]
+//	type = "recorder"
+//	dir = "/var/lib/juicer"
+//	maxSize = 67108864
+//	syncInterval = "1s"
+//	queueSize = 1024
+//	overflow = "drop-oldest"
+//
+// Keys that are not present keep the values from DefaultConfig.
+type Config struct {
+	RetrySleep      Duration
+	ShutdownTimeout Duration
+
+	ECU    ECUConfig
+	GPS    GPSConfig
+	CANBus CANBusConfig
+	Track  TrackConfig
+
+	Forwarders []ForwarderConfig `toml:"-"`
+}
+
+// ECUConfig, GPSConfig and CANBusConfig configure the built-in sources.
+// StaleTimeout is how long the channels of a source are considered valid
+// after they were last updated, zero disables the timeout.
+type ECUConfig struct {
+	Enabled      bool
+	Port         string
+	StaleTimeout Duration
+}
+
+type GPSConfig struct {
+	Enabled bool
+	Port    string
+	// maximum horizontal dilution of precision
+	MaxHDOP      int
+	StaleTimeout Duration
+}
+
+type CANBusConfig struct {
+	Enabled      bool
+	Interface    string
+	StaleTimeout Duration
+}
+
+// ForwarderConfig is a [[forwarder]] entry. Type selects the forwarder and
+// the rest of the entry is decoded by the forwarder with Decode. QueueSize
+// and Overflow override the ForwarderOptions of the forwarder when they are
+// present, they are "drop-oldest", "drop-newest" or "block".
+type ForwarderConfig struct {
+	Type      string
+	QueueSize int
+	Overflow  *OverflowPolicy
+
+	md        toml.MetaData
+	primitive toml.Primitive
+}
+
+func (fc ForwarderConfig) Decode(v interface{}) error {
+	return fc.md.PrimitiveDecode(fc.primitive, v)
+}
+
+// Options returns opts with the queueSize and overflow of the entry applied.
+func (fc ForwarderConfig) Options(opts ForwarderOptions) ForwarderOptions {
+	if fc.QueueSize > 0 {
+		opts.QueueSize = fc.QueueSize
+	}
+	if fc.Overflow != nil {
+		opts.Overflow = *fc.Overflow
+	}
+	return opts
+}
+
+// Duration is a time.Duration that is decoded from a string such as "100ms".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		RetrySleep:      Duration{defaultRetrySleep},
+		ShutdownTimeout: Duration{shutdownTimeout},
+		ECU: ECUConfig{
+			Enabled:      true,
+			Port:         defaultECUPortName,
+			StaleTimeout: Duration{defaultStaleTimeout},
+		},
+		GPS: GPSConfig{
+			Enabled:      true,
+			Port:         defaultGPSPortName,
+			MaxHDOP:      defaultMaxHDOP,
+			StaleTimeout: Duration{defaultStaleTimeout},
+		},
+		CANBus: CANBusConfig{
+			Enabled:      true,
+			Interface:    defaultCANBusPortName,
+			StaleTimeout: Duration{defaultStaleTimeout},
+		},
+		Track: TrackConfig{
+			MinLapTime: Duration{defaultMinLapTime},
+		},
+	}
+}
+
+// LoadConfig loads the configuration from fileName. Relative paths are
+// relative to the location of the binary.
+func LoadConfig(fileName string) (*Config, error) {
+	if !filepath.IsAbs(fileName) {
+		dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to determine binary location")
+		}
+		fileName = filepath.Join(dir, fileName)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open file %s", fileName)
+	}
+	defer file.Close()
+	return LoadConfigFromReader(file)
+}
+
+func LoadConfigFromReader(configReader io.Reader) (*Config, error) {
+	configData, err := ioutil.ReadAll(configReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read config reader")
+	}
+	config := DefaultConfig()
+	if _, err := toml.Decode(string(configData), config); err != nil {
+		return nil, errors.Wrap(err, "unable to load juicer configuration")
+	}
+	if config.Track.Enabled && config.Track.StartFinish[0] == config.Track.StartFinish[1] {
+		return nil, errors.New("track has no start/finish line")
+	}
+
+	fwders := struct {
+		Forwarder []toml.Primitive
+	}{}
+	md, err := toml.Decode(string(configData), &fwders)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load forwarder configuration")
+	}
+	for n, primitive := range fwders.Forwarder {
+		fc := ForwarderConfig{
+			md:        md,
+			primitive: primitive,
+		}
+		if err := fc.Decode(&fc); err != nil {
+			return nil, errors.Wrapf(err, "unable to decode forwarder %d", n)
+		}
+		if fc.Type == "" {
+			return nil, errors.Errorf("forwarder %d has no type", n)
+		}
+		if fc.QueueSize < 0 {
+			return nil, errors.Errorf("forwarder %d has a negative queueSize", n)
+		}
+		config.Forwarders = append(config.Forwarders, fc)
+	}
+	return config, nil
+}
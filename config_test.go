@@ -0,0 +1,123 @@
+package juicer
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := LoadConfigFromReader(bytes.NewBufferString(""))
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfigFromReader(bytes.NewBufferString(`
+retrySleep = "250ms"
+
+[ecu]
+enabled = false
+
+[gps]
+port = "/dev/ttyUSB0"
+maxHDOP = 200
+
+[canbus]
+interface = "can1"
+
+[track]
+enabled = true
+startFinish = [[39.5401, -122.3310], [39.5399, -122.3307]]
+sectors = [
+  [[39.5367, -122.3288], [39.5365, -122.3284]],
+]
+
+[[forwarder]]
+type = "udp"
+server = "127.0.0.1"
+port = 5000
+
+[[forwarder]]
+type = "other"
+queueSize = 100
+overflow = "block"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, config.RetrySleep.Duration)
+	assert.Equal(t, shutdownTimeout, config.ShutdownTimeout.Duration)
+	assert.False(t, config.ECU.Enabled)
+	assert.Equal(t, defaultECUPortName, config.ECU.Port)
+	assert.True(t, config.GPS.Enabled)
+	assert.Equal(t, "/dev/ttyUSB0", config.GPS.Port)
+	assert.Equal(t, 200, config.GPS.MaxHDOP)
+	assert.Equal(t, "can1", config.CANBus.Interface)
+	assert.True(t, config.Track.Enabled)
+	assert.Equal(t, Line{{39.5401, -122.3310}, {39.5399, -122.3307}}, config.Track.StartFinish)
+	assert.Equal(t, []Line{{{39.5367, -122.3288}, {39.5365, -122.3284}}}, config.Track.Sectors)
+	assert.Equal(t, defaultMinLapTime, config.Track.MinLapTime.Duration)
+
+	assert.Len(t, config.Forwarders, 2)
+	assert.Equal(t, "udp", config.Forwarders[0].Type)
+	assert.Equal(t, "other", config.Forwarders[1].Type)
+
+	udp := struct {
+		Server string
+		Port   int
+	}{}
+	assert.NoError(t, config.Forwarders[0].Decode(&udp))
+	assert.Equal(t, "127.0.0.1", udp.Server)
+	assert.Equal(t, 5000, udp.Port)
+
+	opts := DefaultForwarderOptions()
+	assert.Equal(t, opts, config.Forwarders[0].Options(opts))
+	opts = config.Forwarders[1].Options(opts)
+	assert.Equal(t, 100, opts.QueueSize)
+	assert.Equal(t, Block, opts.Overflow)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := LoadConfigFromReader(bytes.NewBufferString(`retrySleep = "soon"`))
+	assert.Error(t, err)
+
+	_, err = LoadConfigFromReader(bytes.NewBufferString(`
+[[forwarder]]
+server = "127.0.0.1"
+`))
+	assert.Error(t, err, "forwarder without a type should be rejected")
+
+	_, err = LoadConfigFromReader(bytes.NewBufferString(`
+[[forwarder]]
+type = "udp"
+overflow = "sometimes"
+`))
+	assert.Error(t, err, "unknown overflow policy should be rejected")
+
+	_, err = LoadConfigFromReader(bytes.NewBufferString(`
+[[forwarder]]
+type = "udp"
+queueSize = -1
+`))
+	assert.Error(t, err, "negative queue size should be rejected")
+
+	_, err = LoadConfigFromReader(bytes.NewBufferString(`
+[track]
+enabled = true
+`))
+	assert.Error(t, err, "track without a start/finish line should be rejected")
+}
+
+func TestNewJuicerFromConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.CANBus.Enabled = false
+	jc := NewJuicerFromConfig(config)
+	assert.Nil(t, jc.canSensorBus)
+	assert.Empty(t, jc.forwarders, "no CAN forwarder without a CAN bus")
+
+	config.Track.Enabled = true
+	jc = NewJuicerFromConfig(config)
+	assert.Len(t, jc.forwarders, 1)
+	_, ok := jc.Health().Source(lapTimerName)
+	assert.True(t, ok)
+}
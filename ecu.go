@@ -8,8 +8,10 @@ import (
 )
 
 type ecuRetryable struct{
+	UpdateSender
 	c KW1281
-	sendChan chan<- ecuData
+	portName string
+	capture  Capturer
 }
 
 // to allow testing
@@ -22,7 +24,7 @@ func (e *ecuRetryable) Name() string {
 }
 
 func (e *ecuRetryable) Open() error {
-	c, err := ecuConnect(ecuPortName)
+	c, err := ecuConnect(e.portName)
 	if err == nil {
 		e.c = c
 	}
@@ -48,6 +50,9 @@ func (e *ecuRetryable) Start(ctx context.Context) error {
 			go e.startMeasurementRequests()
 		},
 		Measurement: func(group kw1281.MeasurementGroup, measurements []*kw1281.Measurement) {
+			if e.capture != nil {
+				e.capture.KW1281Block(group, measurements)
+			}
 			for _, m := range measurements {
 				switch m.Metric {
 				case kw1281.MetricRPM:
@@ -62,10 +67,10 @@ func (e *ecuRetryable) Start(ctx context.Context) error {
 					data.Speed = m.Value.(int)
 				}
 			}
-			select {
-			case e.sendChan <- data:
-			default:
-			}
+			e.Send(Update{
+				Source: e.Name(),
+				Values: data.values(),
+			})
 		},
 	})
 }
@@ -89,12 +94,3 @@ func (e *ecuRetryable) startMeasurementRequests() {
 		}
 	}
 }
-
-func runECU(ctx context.Context, sendChan chan<- ecuData) {
-	err := retry(ctx, &ecuRetryable{
-		sendChan: sendChan,
-	})
-	if err != nil {
-		log.Errorf("ecu done: %v", err)
-	}
-}
@@ -21,9 +21,8 @@ func TestRunECU(t *testing.T) {
 		return stub, nil
 	}
 
-	ecuRetryable := &ecuRetryable{
-		sendChan: jc.ecuChan,
-	}
+	ecuRetryable := &ecuRetryable{}
+	ecuRetryable.SetUpdateChan(jc.updateChan)
 
 	// close before opening
 	assert.NoError(t, ecuRetryable.Close())
@@ -70,8 +69,11 @@ func TestRunECU(t *testing.T) {
 	stub.fnChan <- func() {
 		stub.callbacks.Measurement(kw1281.GroupRPMCoolantTemp, measurements)
 	}
-	data := <-jc.ecuChan
-	assert.Equal(t, float32(3200), data.RPM)
+	update := <-jc.updateChan
+	assert.Equal(t, "ecu", update.Source)
+	telem := Telemetry{}
+	telem.Apply(update)
+	assert.Equal(t, float32(3200), telem.RPM)
 	cancel()
 	wg.Wait()
 }
@@ -0,0 +1,65 @@
+package export
+
+import (
+	"encoding/csv"
+	"github.com/jd3nn1s/juicer"
+	"io"
+)
+
+// CSVWriter writes a row for each sample with a column for each channel.
+// The header gives the unit of each channel and stale values are left empty.
+type CSVWriter struct {
+	w        *csv.Writer
+	channels []juicer.Channel
+	header   bool
+	clock    sampleClock
+}
+
+// NewCSVWriter creates a CSV writer of the channels given, or of every
+// channel if there are none.
+func NewCSVWriter(w io.Writer, channels []juicer.Channel) *CSVWriter {
+	if len(channels) == 0 {
+		channels = juicer.Channels()
+	}
+	return &CSVWriter{
+		w:        csv.NewWriter(w),
+		channels: channels,
+	}
+}
+
+func (c *CSVWriter) Write(telem *juicer.Telemetry) error {
+	if !c.header {
+		if err := c.w.Write(c.headings()); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	row := make([]string, 0, len(c.channels)+2)
+	row = append(row, formatTime(telem.Time), c.clock.elapsed(telem.Time))
+	for _, ch := range c.channels {
+		value := ""
+		if !telem.Stale.Has(ch) {
+			value = formatValue(ch, telem.Get(ch))
+		}
+		row = append(row, value)
+	}
+	return c.w.Write(row)
+}
+
+func (c *CSVWriter) headings() []string {
+	headings := make([]string, 0, len(c.channels)+2)
+	headings = append(headings, "Time", "Elapsed (s)")
+	for _, ch := range c.channels {
+		heading := ch.String()
+		if unit := ch.Unit(); unit != "" {
+			heading += " (" + unit + ")"
+		}
+		headings = append(headings, heading)
+	}
+	return headings
+}
+
+func (c *CSVWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
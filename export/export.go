@@ -0,0 +1,169 @@
+// Package export converts recorded sessions into the formats used by
+// spreadsheets, notebooks and other analysis tools.
+package export
+
+import (
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writer writes telemetry in an export format.
+type Writer interface {
+	Write(telem *juicer.Telemetry) error
+	// Close writes anything still buffered. It does not close the underlying
+	// io.Writer.
+	Close() error
+}
+
+// Source is read until it returns io.EOF, such as a recorder.Reader.
+type Source interface {
+	Next() (*juicer.Telemetry, error)
+}
+
+// Range limits an export to the telemetry from From up to but not including
+// To. A zero time leaves that end open.
+type Range struct {
+	From time.Time
+	To   time.Time
+}
+
+// Contains reports whether telemetry with the given time is within the range.
+func (r Range) Contains(t time.Time) bool {
+	if !r.From.IsZero() && t.Before(r.From) {
+		return false
+	}
+	if !r.To.IsZero() && !t.Before(r.To) {
+		return false
+	}
+	return true
+}
+
+// Export writes the telemetry read from src that is within rng to w and
+// returns the number of samples written. An error from src other than
+// io.EOF is returned once the samples before it have been written.
+func Export(w Writer, src Source, rng Range) (int, error) {
+	n := 0
+	for {
+		telem, err := src.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if !rng.Contains(time.Unix(0, telem.Time)) {
+			continue
+		}
+		if err := w.Write(telem); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// ParseChannels parses a comma separated list of channel names, returning
+// nil for an empty list so that the writer's default channels are used.
+func ParseChannels(names string) ([]juicer.Channel, error) {
+	if names == "" {
+		return nil, nil
+	}
+	var channels []juicer.Channel
+	for _, name := range strings.Split(names, ",") {
+		ch, err := juicer.ParseChannel(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, nil
+}
+
+// New returns the writer for a format: "csv", "ndjson", "gpx", "kml", "ld"
+// or "vbo".
+func New(format string, w io.Writer, channels []juicer.Channel) (Writer, error) {
+	switch format {
+	case "csv":
+		return NewCSVWriter(w, channels), nil
+	case "ndjson":
+		return NewNDJSONWriter(w, channels), nil
+	case "gpx":
+		return NewGPXWriter(w, channels), nil
+	case "kml":
+		return NewKMLWriter(w), nil
+	case "ld":
+		return NewLDWriter(w, channels), nil
+	case "vbo":
+		return NewVBOWriter(w, channels), nil
+	}
+	return nil, errors.Errorf("unknown export format %q", format)
+}
+
+// formatValue formats a channel value with no more digits than its
+// Telemetry field holds.
+func formatValue(ch juicer.Channel, v float64) string {
+	bits := 64
+	if ch.Kind() == juicer.KindFloat32 {
+		bits = 32
+	}
+	return strconv.FormatFloat(v, 'f', -1, bits)
+}
+
+func formatTime(ns int64) string {
+	return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+}
+
+// sampleClock tracks the time of the first sample written so that the
+// elapsed time of each sample can be given.
+type sampleClock struct {
+	start int64
+}
+
+// elapsed returns the seconds since the first sample.
+func (c *sampleClock) elapsed(ns int64) string {
+	if c.start == 0 {
+		c.start = ns
+	}
+	return strconv.FormatFloat(time.Duration(ns-c.start).Seconds(), 'f', 3, 64)
+}
+
+// trackPoint is a GPS fix with the telemetry at the time.
+type trackPoint struct {
+	telem juicer.Telemetry
+}
+
+// fixes picks the samples with a new GPS fix.
+type fixes struct {
+	last int64
+}
+
+func (f *fixes) next(telem *juicer.Telemetry) (trackPoint, bool) {
+	at := telem.Updated[juicer.ChannelLatitude]
+	if at == 0 || at == f.last ||
+		telem.Stale.Has(juicer.ChannelLatitude) || telem.Stale.Has(juicer.ChannelLongitude) {
+		return trackPoint{}, false
+	}
+	f.last = at
+	return trackPoint{telem: *telem}, true
+}
+
+// time returns when the fix was read.
+func (p trackPoint) time() int64 {
+	return p.telem.Updated[juicer.ChannelLatitude]
+}
+
+// speed returns the speed in km/h, from the ECU if it is not stale and
+// otherwise from the GPS.
+func (p trackPoint) speed() (float64, bool) {
+	if !p.telem.Stale.Has(juicer.ChannelSpeed) {
+		return float64(p.telem.Speed), true
+	}
+	if !p.telem.Stale.Has(juicer.ChannelGPSSpeed) {
+		// cm/s
+		return float64(p.telem.GPSSpeed) * 0.036, true
+	}
+	return 0, false
+}
@@ -0,0 +1,96 @@
+package export
+
+import (
+	"bytes"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+type sliceSource struct {
+	telems []juicer.Telemetry
+	err    error
+}
+
+func (s *sliceSource) Next() (*juicer.Telemetry, error) {
+	if len(s.telems) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	telem := s.telems[0]
+	s.telems = s.telems[1:]
+	return &telem, nil
+}
+
+func testTelemetry(n int) []juicer.Telemetry {
+	telems := make([]juicer.Telemetry, n)
+	for i := range telems {
+		telem := &telems[i]
+		telem.Time = time.Unix(1500000000, 0).Add(time.Duration(i) * 500 * time.Millisecond).UnixNano()
+		telem.RPM = float32(1000 + i)
+		telem.Latitude = 51.4779948
+		telem.BatteryVoltage = 13.8
+		telem.Stale = juicer.ChannelSet(0)
+		if i == 0 {
+			telem.Stale.Add(juicer.ChannelLatitude)
+		}
+	}
+	return telems
+}
+
+func TestCSV(t *testing.T) {
+	buf := &bytes.Buffer{}
+	channels, err := ParseChannels("RPM, Latitude,BatteryVoltage,Lap")
+	assert.NoError(t, err)
+	w := NewCSVWriter(buf, channels)
+	n, err := Export(w, &sliceSource{telems: testTelemetry(2)}, Range{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, `Time,Elapsed (s),RPM (rpm),Latitude (deg),BatteryVoltage (V),Lap
+2017-07-14T02:40:00Z,0.000,1000,,13.8,0
+2017-07-14T02:40:00.5Z,0.500,1001,51.4779948,13.8,0
+`, buf.String())
+}
+
+func TestNDJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewNDJSONWriter(buf, []juicer.Channel{juicer.ChannelRPM, juicer.ChannelLatitude})
+	telems := testTelemetry(3)
+	rng := Range{
+		From: time.Unix(0, telems[1].Time),
+		To:   time.Unix(0, telems[2].Time),
+	}
+	n, err := Export(w, &sliceSource{telems: telems}, rng)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, `{"Time":"2017-07-14T02:40:00.5Z","Elapsed":0.000,"RPM":1001,"Latitude":51.4779948}
+`, buf.String())
+
+	// every channel by default
+	buf.Reset()
+	w = NewNDJSONWriter(buf, nil)
+	assert.NoError(t, w.Write(&juicer.Telemetry{}))
+	assert.NoError(t, w.Close())
+	assert.Contains(t, buf.String(), `"LinkJitter":0}`)
+}
+
+func TestExportError(t *testing.T) {
+	truncated := errors.New("truncated")
+	w, err := New("csv", &bytes.Buffer{}, nil)
+	assert.NoError(t, err)
+	n, err := Export(w, &sliceSource{telems: testTelemetry(2), err: truncated}, Range{})
+	assert.Equal(t, truncated, err)
+	assert.Equal(t, 2, n)
+
+	_, err = New("xls", &bytes.Buffer{}, nil)
+	assert.Error(t, err)
+	_, err = ParseChannels("RPM,Boost")
+	assert.Error(t, err)
+}
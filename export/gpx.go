@@ -0,0 +1,87 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jd3nn1s/juicer"
+	"io"
+)
+
+const extensionsNamespace = "https://github.com/jd3nn1s/juicer"
+
+// defaultGPXChannels are added to each track point as extensions.
+var defaultGPXChannels = []juicer.Channel{
+	juicer.ChannelSpeed,
+	juicer.ChannelRPM,
+	juicer.ChannelOilTemp,
+	juicer.ChannelCoolantTemp,
+	juicer.ChannelAirIntakeTemp,
+}
+
+// GPXWriter writes the GPS fixes as a GPX 1.1 track with a segment for each
+// lap. The channels are added to each point as extensions in the juicer
+// namespace, leaving out those that are stale.
+type GPXWriter struct {
+	w        *bufio.Writer
+	channels []juicer.Channel
+	fixes    fixes
+	started  bool
+	lap      uint16
+}
+
+// NewGPXWriter creates a GPX writer with the channels given as extensions,
+// or speed, RPM and temperatures if there are none.
+func NewGPXWriter(w io.Writer, channels []juicer.Channel) *GPXWriter {
+	if len(channels) == 0 {
+		channels = defaultGPXChannels
+	}
+	return &GPXWriter{
+		w:        bufio.NewWriter(w),
+		channels: channels,
+	}
+}
+
+func (g *GPXWriter) Write(telem *juicer.Telemetry) error {
+	p, ok := g.fixes.next(telem)
+	if !ok {
+		return nil
+	}
+	if !g.started {
+		g.start()
+		g.started = true
+		g.lap = telem.Lap
+	} else if telem.Lap != g.lap {
+		g.w.WriteString("</trkseg>\n<trkseg>\n")
+		g.lap = telem.Lap
+	}
+	fmt.Fprintf(g.w, `<trkpt lat="%s" lon="%s">`,
+		formatValue(juicer.ChannelLatitude, telem.Latitude),
+		formatValue(juicer.ChannelLongitude, telem.Longitude))
+	if !telem.Stale.Has(juicer.ChannelAltitude) {
+		fmt.Fprintf(g.w, "<ele>%s</ele>", formatValue(juicer.ChannelAltitude, float64(telem.Altitude)))
+	}
+	fmt.Fprintf(g.w, "<time>%s</time><extensions>", formatTime(p.time()))
+	for _, ch := range g.channels {
+		if telem.Stale.Has(ch) {
+			continue
+		}
+		fmt.Fprintf(g.w, "<juicer:%s>%s</juicer:%s>", ch, formatValue(ch, telem.Get(ch)), ch)
+	}
+	_, err := g.w.WriteString("</extensions></trkpt>\n")
+	return err
+}
+
+func (g *GPXWriter) start() {
+	g.w.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(g.w, `<gpx version="1.1" creator="juicer" xmlns="http://www.topografix.com/GPX/1/1" xmlns:juicer="%s">`+"\n", extensionsNamespace)
+	g.w.WriteString("<trk>\n<name>juicer</name>\n<trkseg>\n")
+}
+
+// Close ends the GPX document, which is empty if there were no fixes.
+func (g *GPXWriter) Close() error {
+	if !g.started {
+		g.start()
+	}
+	g.w.WriteString("</trkseg>\n</trk>\n</gpx>\n")
+	return g.w.Flush()
+}
@@ -0,0 +1,80 @@
+package export
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// trackTelemetry returns two laps of fixes with a sample between each fix
+// that has no new fix.
+func trackTelemetry() []juicer.Telemetry {
+	var telems []juicer.Telemetry
+	var telem juicer.Telemetry
+	telem.Stale.Add(juicer.ChannelAltitude)
+	telem.Stale.Add(juicer.ChannelOilTemp)
+	for i := 0; i < 4; i++ {
+		at := time.Unix(1500000000, 0).Add(time.Duration(i) * time.Second).UnixNano()
+		telem.Time = at
+		telem.Lap = uint16(1 + i/2)
+		telem.Latitude = 51.5 + float64(i)/1000
+		telem.Longitude = -0.1
+		telem.Speed = float32(100 + 20*i)
+		telem.RPM = 5000
+		telem.Updated[juicer.ChannelLatitude] = at
+		telems = append(telems, telem)
+		telem.Time += int64(time.Millisecond)
+		telem.RPM = 5100
+		telems = append(telems, telem)
+	}
+	return telems
+}
+
+func TestGPX(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewGPXWriter(buf, nil)
+	n, err := Export(w, &sliceSource{telems: trackTelemetry()}, Range{})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.NoError(t, w.Close())
+
+	var gpx struct {
+		Segments []struct {
+			Points []struct {
+				Lat     float64  `xml:"lat,attr"`
+				Lon     float64  `xml:"lon,attr"`
+				Ele     *float64 `xml:"ele"`
+				Time    string   `xml:"time"`
+				Speed   float64  `xml:"extensions>Speed"`
+				RPM     float64  `xml:"extensions>RPM"`
+				OilTemp *float64 `xml:"extensions>OilTemp"`
+			} `xml:"trkpt"`
+		} `xml:"trk>trkseg"`
+	}
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &gpx))
+	if !assert.Len(t, gpx.Segments, 2) {
+		return
+	}
+	assert.Len(t, gpx.Segments[0].Points, 2)
+	p := gpx.Segments[1].Points[1]
+	assert.Equal(t, 51.503, p.Lat)
+	assert.Equal(t, -0.1, p.Lon)
+	assert.Equal(t, "2017-07-14T02:40:03Z", p.Time)
+	assert.Equal(t, float64(160), p.Speed)
+	// only the samples with a new fix are written
+	assert.Equal(t, float64(5000), p.RPM)
+	assert.Nil(t, p.Ele, "stale altitude")
+	assert.Nil(t, p.OilTemp, "stale oil temperature")
+
+	// no fixes is still a valid document
+	buf.Reset()
+	w = NewGPXWriter(buf, nil)
+	assert.NoError(t, w.Close())
+	gpx.Segments = nil
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &gpx))
+	assert.Len(t, gpx.Segments, 1)
+	assert.Empty(t, gpx.Segments[0].Points)
+}
@@ -0,0 +1,126 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jd3nn1s/juicer"
+	"io"
+	"time"
+)
+
+// kmlLap is the fixes of a single lap.
+type kmlLap struct {
+	lap         uint16
+	coordinates []string
+	start, end  int64
+	speedSum    float64
+	speedCount  int
+}
+
+func (l *kmlLap) averageSpeed() (float64, bool) {
+	if l.speedCount == 0 {
+		return 0, false
+	}
+	return l.speedSum / float64(l.speedCount), true
+}
+
+// KMLWriter writes the GPS fixes as a KML document with a placemark for each
+// lap. The line of each lap is coloured by its average speed, from blue for
+// the slowest lap to red for the fastest. The laps are written by Close.
+type KMLWriter struct {
+	w     io.Writer
+	fixes fixes
+	laps  []*kmlLap
+}
+
+func NewKMLWriter(w io.Writer) *KMLWriter {
+	return &KMLWriter{
+		w: w,
+	}
+}
+
+func (k *KMLWriter) Write(telem *juicer.Telemetry) error {
+	p, ok := k.fixes.next(telem)
+	if !ok {
+		return nil
+	}
+	if len(k.laps) == 0 || k.laps[len(k.laps)-1].lap != telem.Lap {
+		k.laps = append(k.laps, &kmlLap{
+			lap:   telem.Lap,
+			start: p.time(),
+		})
+	}
+	lap := k.laps[len(k.laps)-1]
+	lap.end = p.time()
+	coordinates := formatValue(juicer.ChannelLongitude, telem.Longitude) + "," +
+		formatValue(juicer.ChannelLatitude, telem.Latitude)
+	if !telem.Stale.Has(juicer.ChannelAltitude) {
+		coordinates += "," + formatValue(juicer.ChannelAltitude, float64(telem.Altitude))
+	}
+	lap.coordinates = append(lap.coordinates, coordinates)
+	if speed, ok := p.speed(); ok {
+		lap.speedSum += speed
+		lap.speedCount++
+	}
+	return nil
+}
+
+func (k *KMLWriter) Close() error {
+	minSpeed, maxSpeed := k.speedRange()
+	w := bufio.NewWriter(k.w)
+	w.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	w.WriteString(`<kml xmlns="http://www.opengis.net/kml/2.2">` + "\n<Document>\n<name>juicer</name>\n")
+	for _, lap := range k.laps {
+		name := "Out lap"
+		if lap.lap > 0 {
+			name = fmt.Sprintf("Lap %d", lap.lap)
+		}
+		fmt.Fprintf(w, "<Placemark>\n<name>%s</name>\n", name)
+		description := fmt.Sprintf("%s from %s", time.Duration(lap.end-lap.start), formatTime(lap.start))
+		colour := "ff808080"
+		if speed, ok := lap.averageSpeed(); ok {
+			description += fmt.Sprintf(", average speed %.1f km/h", speed)
+			colour = speedColour(speed, minSpeed, maxSpeed)
+		}
+		fmt.Fprintf(w, "<description>%s</description>\n", description)
+		fmt.Fprintf(w, "<Style><LineStyle><color>%s</color><width>3</width></LineStyle></Style>\n", colour)
+		w.WriteString("<LineString>\n<tessellate>1</tessellate>\n<altitudeMode>clampToGround</altitudeMode>\n<coordinates>\n")
+		for _, c := range lap.coordinates {
+			w.WriteString(c)
+			w.WriteString("\n")
+		}
+		w.WriteString("</coordinates>\n</LineString>\n</Placemark>\n")
+	}
+	w.WriteString("</Document>\n</kml>\n")
+	return w.Flush()
+}
+
+func (k *KMLWriter) speedRange() (float64, float64) {
+	first := true
+	var minSpeed, maxSpeed float64
+	for _, lap := range k.laps {
+		speed, ok := lap.averageSpeed()
+		if !ok {
+			continue
+		}
+		if first || speed < minSpeed {
+			minSpeed = speed
+		}
+		if first || speed > maxSpeed {
+			maxSpeed = speed
+		}
+		first = false
+	}
+	return minSpeed, maxSpeed
+}
+
+// speedColour returns the KML colour, aabbggrr, of a speed between blue for
+// minSpeed and red for maxSpeed.
+func speedColour(speed, minSpeed, maxSpeed float64) string {
+	t := 1.0
+	if maxSpeed > minSpeed {
+		t = (speed - minSpeed) / (maxSpeed - minSpeed)
+	}
+	red := uint8(255 * t)
+	return fmt.Sprintf("ff%02x00%02x", 255-red, red)
+}
@@ -0,0 +1,50 @@
+package export
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestKML(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := New("kml", buf, nil)
+	assert.NoError(t, err)
+	telems := trackTelemetry()
+	// an out lap before the first crossing
+	outLap := telems[0]
+	outLap.Lap = 0
+	outLap.Stale.Add(juicer.ChannelSpeed)
+	outLap.Stale.Add(juicer.ChannelGPSSpeed)
+	outLap.Updated[juicer.ChannelLatitude]--
+	_, err = Export(w, &sliceSource{telems: append([]juicer.Telemetry{outLap}, telems...)}, Range{})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	var kml struct {
+		Placemarks []struct {
+			Name        string `xml:"name"`
+			Description string `xml:"description"`
+			Colour      string `xml:"Style>LineStyle>color"`
+			Coordinates string `xml:"LineString>coordinates"`
+		} `xml:"Document>Placemark"`
+	}
+	assert.NoError(t, xml.Unmarshal(buf.Bytes(), &kml))
+	if !assert.Len(t, kml.Placemarks, 3) {
+		return
+	}
+	assert.Equal(t, "Out lap", kml.Placemarks[0].Name)
+	// no speed
+	assert.Equal(t, "ff808080", kml.Placemarks[0].Colour)
+
+	lap := kml.Placemarks[1]
+	assert.Equal(t, "Lap 1", lap.Name)
+	assert.Equal(t, "1s from 2017-07-14T02:40:00Z, average speed 110.0 km/h", lap.Description)
+	assert.Equal(t, []string{"-0.1,51.5", "-0.1,51.501"}, strings.Fields(lap.Coordinates))
+	// slowest blue, fastest red
+	assert.Equal(t, "ffff0000", lap.Colour)
+	assert.Equal(t, "ff0000ff", kml.Placemarks[2].Colour)
+}
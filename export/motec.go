@@ -0,0 +1,251 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+// The MoTeC i2 log format is not published, the layout follows the one
+// worked out by the ldparser project. A file is the header, the event,
+// venue and vehicle details, a linked list of channel descriptions and then
+// the samples of each channel. Every value is little-endian.
+const (
+	ldMarker       = 0x40
+	ldDeviceSerial = 0x1f44
+	ldDeviceVer    = 420
+	ldProLogging   = 0xc81a4
+	ldChannelID    = 0x2ee1
+	// data types, samples are always written as float32
+	ldTypeFloat = 0x07
+	ldSizeFloat = 4
+)
+
+type ldHeader struct {
+	Marker        uint32
+	_             [4]byte
+	ChannelsPtr   uint32
+	DataPtr       uint32
+	_             [20]byte
+	EventPtr      uint32
+	_             [24]byte
+	Unknown       [3]uint16
+	DeviceSerial  uint32
+	DeviceType    [8]byte
+	DeviceVersion uint16
+	Unknown2      uint16
+	NumChannels   uint32
+	_             [4]byte
+	Date          [16]byte
+	_             [16]byte
+	Time          [16]byte
+	_             [16]byte
+	Driver        [64]byte
+	Vehicle       [64]byte
+	_             [64]byte
+	Venue         [64]byte
+	_             [64]byte
+	_             [1024]byte
+	ProLogging    uint32
+	_             [66]byte
+	ShortComment  [64]byte
+	_             [126]byte
+}
+
+type ldEvent struct {
+	Name     [64]byte
+	Session  [64]byte
+	Comment  [1024]byte
+	VenuePtr uint16
+}
+
+type ldVenue struct {
+	Name       [64]byte
+	_          [1034]byte
+	VehiclePtr uint16
+}
+
+type ldVehicle struct {
+	ID      [64]byte
+	_       [128]byte
+	Weight  uint32
+	Type    [32]byte
+	Comment [32]byte
+}
+
+type ldChannel struct {
+	PrevPtr    uint32
+	NextPtr    uint32
+	DataPtr    uint32
+	Samples    uint32
+	ID         uint16
+	DataTypeA  uint16
+	DataType   uint16
+	SampleRate uint16
+	Shift      int16
+	Mul        int16
+	Scale      int16
+	DecPlaces  int16
+	Name       [32]byte
+	ShortName  [8]byte
+	Unit       [12]byte
+	_          [40]byte
+}
+
+// longest gap between two samples of an LDWriter, a log is resampled at a
+// fixed rate so a gap is filled with samples
+var maxLDGap = time.Minute
+
+// LDWriter writes a MoTeC i2 log. Every channel is sampled at its
+// SampleRate from the start of the session, holding the last value between
+// updates. A stale value is held too, as the format has no way to mark it.
+// The samples are kept in memory and the log is written by Close. A log is
+// of a single session, telemetry that is more than maxLDGap after the
+// previous sample or before it is rejected.
+type LDWriter struct {
+	// shown in i2, they can be left empty
+	Driver  string
+	Vehicle string
+	Venue   string
+	Comment string
+
+	w        io.Writer
+	channels []juicer.Channel
+	telems   []juicer.Telemetry
+}
+
+// NewLDWriter creates a MoTeC log writer of the channels given, or of every
+// channel if there are none.
+func NewLDWriter(w io.Writer, channels []juicer.Channel) *LDWriter {
+	if len(channels) == 0 {
+		channels = juicer.Channels()
+	}
+	return &LDWriter{
+		w:        w,
+		channels: channels,
+	}
+}
+
+func (l *LDWriter) Write(telem *juicer.Telemetry) error {
+	if len(l.telems) > 0 {
+		gap := time.Duration(telem.Time - l.telems[len(l.telems)-1].Time)
+		if gap < 0 || gap > maxLDGap {
+			return errors.Errorf("telemetry at %s is %s from the previous sample, a MoTeC log is of a single session",
+				formatTime(telem.Time), gap)
+		}
+	}
+	l.telems = append(l.telems, *telem)
+	return nil
+}
+
+func (l *LDWriter) Close() error {
+	var start time.Time
+	if len(l.telems) > 0 {
+		start = time.Unix(0, l.telems[0].Time)
+	}
+	headerSize := binary.Size(ldHeader{})
+	eventPtr := headerSize
+	venuePtr := eventPtr + binary.Size(ldEvent{})
+	vehiclePtr := venuePtr + binary.Size(ldVenue{})
+	channelsPtr := vehiclePtr + binary.Size(ldVehicle{})
+	dataPtr := channelsPtr + len(l.channels)*binary.Size(ldChannel{})
+
+	hdr := ldHeader{
+		Marker:        ldMarker,
+		ChannelsPtr:   uint32(channelsPtr),
+		DataPtr:       uint32(dataPtr),
+		EventPtr:      uint32(eventPtr),
+		Unknown:       [3]uint16{1, 0x4240, 0xf},
+		DeviceSerial:  ldDeviceSerial,
+		DeviceVersion: ldDeviceVer,
+		Unknown2:      0xadb0,
+		NumChannels:   uint32(len(l.channels)),
+		ProLogging:    ldProLogging,
+	}
+	copy(hdr.DeviceType[:], "ADL")
+	copy(hdr.Date[:], start.Format("02/01/2006"))
+	copy(hdr.Time[:], start.Format("15:04:05"))
+	copy(hdr.Driver[:], l.Driver)
+	copy(hdr.Vehicle[:], l.Vehicle)
+	copy(hdr.Venue[:], l.Venue)
+	copy(hdr.ShortComment[:], l.Comment)
+	event := ldEvent{VenuePtr: uint16(venuePtr)}
+	copy(event.Comment[:], l.Comment)
+	venue := ldVenue{VehiclePtr: uint16(vehiclePtr)}
+	copy(venue.Name[:], l.Venue)
+	vehicle := ldVehicle{}
+	copy(vehicle.ID[:], l.Vehicle)
+
+	buf := &bytes.Buffer{}
+	// every ld struct is a fixed size, binary.Write only fails for values it
+	// cannot encode or a failing writer
+	_ = binary.Write(buf, binary.LittleEndian, &hdr)
+	_ = binary.Write(buf, binary.LittleEndian, &event)
+	_ = binary.Write(buf, binary.LittleEndian, &venue)
+	_ = binary.Write(buf, binary.LittleEndian, &vehicle)
+
+	samples := make([][]float32, len(l.channels))
+	ptr := dataPtr
+	channelSize := binary.Size(ldChannel{})
+	for i, ch := range l.channels {
+		samples[i] = resample(l.telems, ch)
+		desc := ldChannel{
+			DataPtr:    uint32(ptr),
+			Samples:    uint32(len(samples[i])),
+			ID:         uint16(ldChannelID + i),
+			DataTypeA:  ldTypeFloat,
+			DataType:   ldSizeFloat,
+			SampleRate: uint16(ch.SampleRate()),
+			Mul:        1,
+			Scale:      1,
+		}
+		if i > 0 {
+			desc.PrevPtr = uint32(channelsPtr + (i-1)*channelSize)
+		}
+		if i < len(l.channels)-1 {
+			desc.NextPtr = uint32(channelsPtr + (i+1)*channelSize)
+		}
+		copy(desc.Name[:], ch.String())
+		copy(desc.ShortName[:], ch.String())
+		copy(desc.Unit[:], ldUnit(ch.Unit()))
+		_ = binary.Write(buf, binary.LittleEndian, &desc)
+		ptr += len(samples[i]) * ldSizeFloat
+	}
+	for _, s := range samples {
+		_ = binary.Write(buf, binary.LittleEndian, s)
+	}
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
+
+// ldUnit returns the unit as i2 names it.
+func ldUnit(unit string) string {
+	if unit == "degC" {
+		return "C"
+	}
+	return unit
+}
+
+// resample returns the value of a channel at its sample rate from the time
+// of the first telemetry to the last, holding the value between updates.
+func resample(telems []juicer.Telemetry, ch juicer.Channel) []float32 {
+	if len(telems) == 0 || ch.SampleRate() == 0 {
+		return nil
+	}
+	start := telems[0].Time
+	period := int64(time.Second) / int64(ch.SampleRate())
+	n := (telems[len(telems)-1].Time-start)/period + 1
+	samples := make([]float32, 0, n)
+	i := 0
+	for k := int64(0); k < n; k++ {
+		at := start + k*period
+		for i+1 < len(telems) && telems[i+1].Time <= at {
+			i++
+		}
+		samples = append(samples, float32(telems[i].Get(ch)))
+	}
+	return samples
+}
@@ -0,0 +1,79 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func TestLD(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewLDWriter(buf, []juicer.Channel{juicer.ChannelRPM, juicer.ChannelOilTemp})
+	w.Venue = "Thunderhill"
+	start := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	// a second of samples, RPM changes after 300ms
+	for _, ms := range []int{0, 300, 1000} {
+		telem := juicer.Telemetry{
+			Time:    start.Add(time.Duration(ms) * time.Millisecond).UnixNano(),
+			RPM:     float32(1000 + ms),
+			OilTemp: 90,
+		}
+		assert.NoError(t, w.Write(&telem))
+	}
+	assert.NoError(t, w.Close())
+
+	data := buf.Bytes()
+	rdr := bytes.NewReader(data)
+	hdr := ldHeader{}
+	assert.NoError(t, binary.Read(rdr, binary.LittleEndian, &hdr))
+	assert.Equal(t, uint32(ldMarker), hdr.Marker)
+	assert.Equal(t, uint32(2), hdr.NumChannels)
+	assert.Equal(t, "14/07/2017", cString(hdr.Date[:]))
+	assert.Equal(t, "Thunderhill", cString(hdr.Venue[:]))
+	assert.Equal(t, 1762, binary.Size(hdr))
+
+	event := ldEvent{}
+	assert.NoError(t, binary.Read(bytes.NewReader(data[hdr.EventPtr:]), binary.LittleEndian, &event))
+	venue := ldVenue{}
+	assert.NoError(t, binary.Read(bytes.NewReader(data[event.VenuePtr:]), binary.LittleEndian, &venue))
+	assert.Equal(t, "Thunderhill", cString(venue.Name[:]))
+
+	var names []string
+	for ptr := hdr.ChannelsPtr; ptr != 0; {
+		ch := ldChannel{}
+		assert.NoError(t, binary.Read(bytes.NewReader(data[ptr:]), binary.LittleEndian, &ch))
+		names = append(names, cString(ch.Name[:]))
+		samples := make([]float32, ch.Samples)
+		assert.NoError(t, binary.Read(bytes.NewReader(data[ch.DataPtr:]), binary.LittleEndian, samples))
+		switch cString(ch.Name[:]) {
+		case "RPM":
+			assert.Equal(t, uint16(5), ch.SampleRate)
+			assert.Equal(t, "rpm", cString(ch.Unit[:]))
+			assert.Equal(t, []float32{1000, 1000, 1300, 1300, 1300, 2000}, samples)
+		case "OilTemp":
+			assert.Equal(t, uint16(2), ch.SampleRate)
+			assert.Equal(t, "C", cString(ch.Unit[:]))
+			assert.Equal(t, []float32{90, 90, 90}, samples)
+		}
+		ptr = ch.NextPtr
+	}
+	assert.Equal(t, []string{"RPM", "OilTemp"}, names)
+	assert.Equal(t, int(hdr.DataPtr)+(6+3)*4, len(data))
+}
+
+func TestLDGap(t *testing.T) {
+	w := NewLDWriter(&bytes.Buffer{}, nil)
+	start := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	assert.NoError(t, w.Write(&juicer.Telemetry{Time: start.UnixNano()}))
+	assert.Error(t, w.Write(&juicer.Telemetry{Time: start.Add(24 * time.Hour).UnixNano()}), "sessions a day apart")
+	assert.Error(t, w.Write(&juicer.Telemetry{Time: start.Add(-time.Second).UnixNano()}), "earlier session")
+	assert.NoError(t, w.Write(&juicer.Telemetry{Time: start.Add(maxLDGap).UnixNano()}))
+}
@@ -0,0 +1,55 @@
+package export
+
+import (
+	"bufio"
+	"github.com/jd3nn1s/juicer"
+	"io"
+	"math"
+)
+
+// NDJSONWriter writes a JSON object on its own line for each sample, with a
+// field for each channel. Stale values are null.
+type NDJSONWriter struct {
+	w        *bufio.Writer
+	channels []juicer.Channel
+	clock    sampleClock
+}
+
+// NewNDJSONWriter creates an NDJSON writer of the channels given, or of
+// every channel if there are none.
+func NewNDJSONWriter(w io.Writer, channels []juicer.Channel) *NDJSONWriter {
+	if len(channels) == 0 {
+		channels = juicer.Channels()
+	}
+	return &NDJSONWriter{
+		w:        bufio.NewWriter(w),
+		channels: channels,
+	}
+}
+
+// Write writes the fields in channel order, channel names and times never
+// need escaping.
+func (n *NDJSONWriter) Write(telem *juicer.Telemetry) error {
+	n.w.WriteString(`{"Time":"`)
+	n.w.WriteString(formatTime(telem.Time))
+	n.w.WriteString(`","Elapsed":`)
+	n.w.WriteString(n.clock.elapsed(telem.Time))
+	for _, ch := range n.channels {
+		n.w.WriteString(`,"`)
+		n.w.WriteString(ch.String())
+		n.w.WriteString(`":`)
+		v := telem.Get(ch)
+		// JSON has no NaN or infinity
+		if telem.Stale.Has(ch) || math.IsNaN(v) || math.IsInf(v, 0) {
+			n.w.WriteString("null")
+			continue
+		}
+		n.w.WriteString(formatValue(ch, v))
+	}
+	_, err := n.w.WriteString("}\n")
+	return err
+}
+
+func (n *NDJSONWriter) Close() error {
+	return n.w.Flush()
+}
@@ -0,0 +1,106 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jd3nn1s/juicer"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// defaultVBOChannels are written after the GPS channels.
+var defaultVBOChannels = []juicer.Channel{
+	juicer.ChannelRPM,
+	juicer.ChannelSpeed,
+	juicer.ChannelGasPedalAngle,
+	juicer.ChannelOilPressure,
+	juicer.ChannelOilTemp,
+	juicer.ChannelCoolantTemp,
+	juicer.ChannelAirIntakeTemp,
+	juicer.ChannelBatteryVoltage,
+	juicer.ChannelFuelLevel,
+}
+
+// VBOWriter writes a Racelogic VBOX text file with a row for each GPS fix.
+// The GPS channels are followed by the channels given, holding their last
+// value. Positions are in minutes with longitude positive to the west as
+// VBOX expects.
+type VBOWriter struct {
+	w        *bufio.Writer
+	channels []juicer.Channel
+	fixes    fixes
+	started  bool
+}
+
+// NewVBOWriter creates a VBOX writer of the GPS channels and the channels
+// given, or the ECU and CAN bus channels if there are none.
+func NewVBOWriter(w io.Writer, channels []juicer.Channel) *VBOWriter {
+	if len(channels) == 0 {
+		channels = defaultVBOChannels
+	}
+	return &VBOWriter{
+		w:        bufio.NewWriter(w),
+		channels: channels,
+	}
+}
+
+func (v *VBOWriter) Write(telem *juicer.Telemetry) error {
+	p, ok := v.fixes.next(telem)
+	if !ok {
+		return nil
+	}
+	at := time.Unix(0, p.time()).UTC()
+	if !v.started {
+		v.header(at)
+		v.started = true
+	}
+	var velocity float64
+	if !telem.Stale.Has(juicer.ChannelGPSSpeed) {
+		// cm/s
+		velocity = float64(telem.GPSSpeed) * 0.036
+	}
+	heading := math.Mod(float64(telem.Track)*180/math.Pi+360, 360)
+	// hhmmss.ss, truncated so that the seconds are never rounded up to 60
+	fmt.Fprintf(v.w, "%s%02d.%02d %+012.5f %+012.5f %07.3f %06.2f %+09.2f",
+		at.Format("1504"), at.Second(), at.Nanosecond()/int(10*time.Millisecond),
+		telem.Latitude*60, -telem.Longitude*60, velocity, heading, telem.Altitude)
+	for _, ch := range v.channels {
+		v.w.WriteString(" ")
+		v.w.WriteString(formatValue(ch, telem.Get(ch)))
+	}
+	_, err := v.w.WriteString("\r\n")
+	return err
+}
+
+func (v *VBOWriter) header(at time.Time) {
+	fmt.Fprintf(v.w, "File created on %s\r\n\r\n", at.Format("02/01/2006 @ 15:04:05"))
+	names := []string{"time", "latitude", "longitude", "velocity kmh", "heading", "height"}
+	units := []string{"", "min", "min", "kmh", "deg", "m"}
+	columns := []string{"time", "lat", "long", "velocity", "heading", "height"}
+	for _, ch := range v.channels {
+		names = append(names, ch.String())
+		units = append(units, ch.Unit())
+		columns = append(columns, ch.String())
+	}
+	v.w.WriteString("[header]\r\n")
+	for _, name := range names {
+		v.w.WriteString(name + "\r\n")
+	}
+	v.w.WriteString("\r\n[channel units]\r\n")
+	for _, unit := range units {
+		v.w.WriteString(unit + "\r\n")
+	}
+	v.w.WriteString("\r\n[comments]\r\nExported by juicer\r\n")
+	v.w.WriteString("\r\n[column names]\r\n" + strings.Join(columns, " ") + "\r\n")
+	v.w.WriteString("\r\n[data]\r\n")
+}
+
+// Close writes the buffered rows, or just the header if there were no fixes.
+func (v *VBOWriter) Close() error {
+	if !v.started {
+		v.header(time.Now().UTC())
+	}
+	return v.w.Flush()
+}
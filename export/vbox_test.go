@@ -0,0 +1,43 @@
+package export
+
+import (
+	"bytes"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestVBO(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := New("vbo", buf, []juicer.Channel{juicer.ChannelRPM, juicer.ChannelOilTemp})
+	assert.NoError(t, err)
+	telems := trackTelemetry()
+	telems[0].GPSSpeed = 2500
+	telems[0].Track = math.Pi / 2
+	telems[0].Altitude = 10.5
+	telems[0].OilTemp = 95
+	_, err = Export(w, &sliceSource{telems: telems}, Range{})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	lines := strings.Split(buf.String(), "\r\n")
+	assert.Equal(t, "File created on 14/07/2017 @ 02:40:00", lines[0])
+	assert.Contains(t, lines, "[header]")
+	assert.Contains(t, lines, "time lat long velocity heading height RPM OilTemp")
+	var data []string
+	for i, line := range lines {
+		if line == "[data]" {
+			data = lines[i+1:]
+		}
+	}
+	// a row for each fix
+	assert.Equal(t, []string{
+		"024000.00 +03090.00000 +00006.00000 090.000 090.00 +00010.50 5000 95",
+		"024001.00 +03090.06000 +00006.00000 000.000 000.00 +00000.00 5000 0",
+		"024002.00 +03090.12000 +00006.00000 000.000 000.00 +00000.00 5000 0",
+		"024003.00 +03090.18000 +00006.00000 000.000 000.00 +00000.00 5000 0",
+		"",
+	}, data)
+}
@@ -0,0 +1,209 @@
+package juicer
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy is what happens to telemetry when a forwarder's queue is
+// full.
+type OverflowPolicy uint8
+
+const (
+	// drop the oldest queued telemetry to make room
+	DropOldest OverflowPolicy = iota
+	// drop the new telemetry
+	DropNewest
+	// wait for the forwarder, stalling the merge loop
+	Block
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	}
+	return "unknown"
+}
+
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Block} {
+		if policy.String() == string(text) {
+			*p = policy
+			return nil
+		}
+	}
+	return errors.Errorf("unknown overflow policy %q", text)
+}
+
+// ForwarderOptions controls how telemetry is delivered to a forwarder. Each
+// forwarder is called from its own go-routine so that a slow forwarder does
+// not stall the merge loop or the other forwarders.
+type ForwarderOptions struct {
+	// number of telemetry updates that can be queued, a queue of 1 with
+	// DropOldest is a mailbox that only holds the latest telemetry
+	QueueSize int
+	Overflow  OverflowPolicy
+	// minimum interval between calls to Forward, zero for no limit
+	RateLimit Duration
+}
+
+// DefaultForwarderOptions delivers the latest telemetry as soon as the
+// forwarder is ready for it.
+func DefaultForwarderOptions() ForwarderOptions {
+	return ForwarderOptions{
+		QueueSize: 1,
+		Overflow:  DropOldest,
+	}
+}
+
+// ForwarderStats are the delivery counters of a forwarder.
+type ForwarderStats struct {
+	Name      string
+	Delivered uint64
+	Dropped   uint64
+	Errors    uint64
+}
+
+type forwarderQueue struct {
+	fwder Forwarder
+	opts  ForwarderOptions
+	queue chan Telemetry
+	// last telemetry delivered, passed to the forwarder as the previous
+	// telemetry as it may not have seen jc.PrevTelemetry
+	last Telemetry
+	// closed once run has returned
+	done chan struct{}
+	// telemetry queued that the forwarder has not finished with
+	pending int64
+
+	delivered uint64
+	dropped   uint64
+	errors    uint64
+}
+
+func newForwarderQueue(fwder Forwarder, opts ForwarderOptions) *forwarderQueue {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+	return &forwarderQueue{
+		fwder: fwder,
+		opts:  opts,
+		queue: make(chan Telemetry, opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+func (q *forwarderQueue) name() string {
+	return fmt.Sprintf("%T", q.fwder)
+}
+
+func (q *forwarderQueue) push(ctx context.Context, t Telemetry) {
+	for {
+		select {
+		case q.queue <- t:
+			atomic.AddInt64(&q.pending, 1)
+			return
+		default:
+		}
+		switch q.opts.Overflow {
+		case DropNewest:
+			atomic.AddUint64(&q.dropped, 1)
+			return
+		case Block:
+			select {
+			case q.queue <- t:
+				atomic.AddInt64(&q.pending, 1)
+			case <-ctx.Done():
+				atomic.AddUint64(&q.dropped, 1)
+			}
+			return
+		default:
+			select {
+			case <-q.queue:
+				atomic.AddInt64(&q.pending, -1)
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+// idle reports whether the forwarder has finished with the telemetry queued.
+func (q *forwarderQueue) idle() bool {
+	return atomic.LoadInt64(&q.pending) == 0
+}
+
+// run delivers queued telemetry to the forwarder until ctx is done.
+func (q *forwarderQueue) run(ctx context.Context) {
+	defer close(q.done)
+	var lastForward time.Time
+	for {
+		if wait := time.Until(lastForward.Add(q.opts.RateLimit.Duration)); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-q.queue:
+			q.forward(t)
+			lastForward = time.Now()
+		}
+	}
+}
+
+// stopped reports whether run has returned.
+func (q *forwarderQueue) stopped() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain delivers the telemetry still queued once run has returned.
+func (q *forwarderQueue) drain() int {
+	n := 0
+	for {
+		select {
+		case t := <-q.queue:
+			q.forward(t)
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+func (q *forwarderQueue) forward(t Telemetry) {
+	if err := q.fwder.Forward(&t, &q.last); err != nil {
+		atomic.AddUint64(&q.errors, 1)
+		log.Errorf("unable to send to forwarder %v %v", q.name(), err)
+	} else {
+		atomic.AddUint64(&q.delivered, 1)
+	}
+	q.last = t
+	atomic.AddInt64(&q.pending, -1)
+}
+
+func (q *forwarderQueue) stats() ForwarderStats {
+	return ForwarderStats{
+		Name:      q.name(),
+		Delivered: atomic.LoadUint64(&q.delivered),
+		Dropped:   atomic.LoadUint64(&q.dropped),
+		Errors:    atomic.LoadUint64(&q.errors),
+	}
+}
@@ -0,0 +1,151 @@
+package juicer
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type slowForwarder struct {
+	release  chan struct{}
+	received chan Telemetry
+	prev     []Telemetry
+}
+
+func (fwd *slowForwarder) Forward(newTelemetry *Telemetry, prevTelemetry *Telemetry) error {
+	<-fwd.release
+	fwd.prev = append(fwd.prev, *prevTelemetry)
+	fwd.received <- *newTelemetry
+	return nil
+}
+
+func newSlowForwarder() *slowForwarder {
+	return &slowForwarder{
+		release:  make(chan struct{}),
+		received: make(chan Telemetry, 10),
+	}
+}
+
+func TestForwarderQueueDropOldest(t *testing.T) {
+	fwder := newSlowForwarder()
+	q := newForwarderQueue(fwder, DefaultForwarderOptions())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for n := 1; n <= 3; n++ {
+		q.push(ctx, Telemetry{RPM: float32(n)})
+	}
+	go q.run(ctx)
+	close(fwder.release)
+	assert.Equal(t, float32(3), (<-fwder.received).RPM, "only the latest should be delivered")
+
+	stats := q.stats()
+	assert.Equal(t, uint64(1), stats.Delivered)
+	assert.Equal(t, uint64(2), stats.Dropped)
+	assert.Equal(t, "*juicer.slowForwarder", stats.Name)
+}
+
+func TestForwarderQueueDropNewest(t *testing.T) {
+	fwder := newSlowForwarder()
+	close(fwder.release)
+	q := newForwarderQueue(fwder, ForwarderOptions{
+		QueueSize: 2,
+		Overflow:  DropNewest,
+	})
+	ctx := context.Background()
+	for n := 1; n <= 3; n++ {
+		q.push(ctx, Telemetry{RPM: float32(n)})
+	}
+	assert.Equal(t, 2, q.drain())
+	assert.Equal(t, float32(1), (<-fwder.received).RPM)
+	assert.Equal(t, float32(2), (<-fwder.received).RPM)
+	assert.Equal(t, uint64(1), q.stats().Dropped)
+}
+
+func TestForwarderQueueBlock(t *testing.T) {
+	fwder := newSlowForwarder()
+	q := newForwarderQueue(fwder, ForwarderOptions{
+		QueueSize: 1,
+		Overflow:  Block,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go q.run(ctx)
+
+	pushed := make(chan struct{})
+	go func() {
+		for n := 1; n <= 3; n++ {
+			q.push(ctx, Telemetry{RPM: float32(n)})
+		}
+		close(pushed)
+	}()
+	close(fwder.release)
+	<-pushed
+	for n := 1; n <= 3; n++ {
+		assert.Equal(t, float32(n), (<-fwder.received).RPM)
+	}
+	assert.Equal(t, uint64(0), q.stats().Dropped)
+
+	// the previous telemetry is the last one delivered to the forwarder
+	assert.Equal(t, float32(0), fwder.prev[0].RPM)
+	assert.Equal(t, float32(2), fwder.prev[2].RPM)
+	cancel()
+}
+
+func TestForwarderQueueRateLimit(t *testing.T) {
+	fwder := newSlowForwarder()
+	close(fwder.release)
+	q := newForwarderQueue(fwder, ForwarderOptions{
+		QueueSize: 1,
+		RateLimit: Duration{20 * time.Millisecond},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.run(ctx)
+
+	q.push(ctx, Telemetry{RPM: 1})
+	<-fwder.received
+	start := time.Now()
+	q.push(ctx, Telemetry{RPM: 2})
+	<-fwder.received
+	assert.True(t, time.Now().Sub(start) >= 15*time.Millisecond)
+}
+
+func TestSlowForwarderDoesNotStall(t *testing.T) {
+	config := DefaultConfig()
+	config.CANBus.Enabled = false
+	jc := NewJuicerFromConfig(config)
+	slow := newSlowForwarder()
+	jc.AddForwarder(slow)
+	fwder := forwarderStub{
+		fwdChan: make(chan Telemetry, 1),
+	}
+	jc.AddForwarder(&fwder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		errChan <- jc.Run(ctx)
+	}()
+
+	for n := 1; n <= 5; n++ {
+		jc.updateChan <- update([]ChannelValue{{ChannelRPM, float64(n)}})
+		assert.Equal(t, float32(n), (<-fwder.fwdChan).RPM)
+	}
+
+	cancel()
+	close(slow.release)
+	assert.Equal(t, context.Canceled, <-errChan)
+	stats := jc.ForwarderStats()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, uint64(5), stats[1].Delivered)
+	assert.True(t, stats[0].Dropped > 0)
+}
+
+func TestOverflowPolicyText(t *testing.T) {
+	var p OverflowPolicy
+	assert.NoError(t, p.UnmarshalText([]byte("block")))
+	assert.Equal(t, Block, p)
+	assert.Error(t, p.UnmarshalText([]byte("explode")))
+	assert.Equal(t, "drop-newest", DropNewest.String())
+}
@@ -0,0 +1,58 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+)
+
+// Ack is the body of a TypeAck packet. It acknowledges the telemetry
+// packets received from a session, the highest sequence and the 64 before it.
+type Ack struct {
+	Session  uint32
+	Sequence uint32
+	// bit n is set if Sequence-1-n was received
+	Received uint64
+}
+
+func (a Ack) write(buf *bytes.Buffer) error {
+	return binary.Write(buf, binary.LittleEndian, &a)
+}
+
+func readAck(r *bytes.Reader) (*Ack, error) {
+	a := &Ack{}
+	if err := binary.Read(r, binary.LittleEndian, a); err != nil {
+		return nil, errors.Wrap(err, "unable to read ack")
+	}
+	return a, nil
+}
+
+// Has reports whether the packet with a sequence is acknowledged.
+func (a Ack) Has(sequence uint32) bool {
+	d := a.Sequence - sequence
+	if d == 0 {
+		return true
+	}
+	return d <= 64 && a.Received&(1<<(d-1)) != 0
+}
+
+// add records that the packet with a sequence was received.
+func (a *Ack) add(sequence uint32) {
+	d := sequence - a.Sequence
+	switch {
+	case d == 0:
+	case d < 1<<31:
+		// newer, the current highest becomes bit d-1
+		if d > 64 {
+			a.Received = 0
+		} else {
+			a.Received = a.Received<<d | 1<<(d-1)
+		}
+		a.Sequence = sequence
+	default:
+		// older
+		if d := a.Sequence - sequence; d <= 64 {
+			a.Received |= 1 << (d - 1)
+		}
+	}
+}
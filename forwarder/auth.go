@@ -0,0 +1,204 @@
+package forwarder
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// The shared key is not used directly, a key for each of HMAC-SHA256 and
+// AES-256-GCM is derived from it as the HMAC-SHA256, keyed with the shared
+// key, of the label "juicer mac" or "juicer encrypt".
+//
+// A packet authenticated with a shared key has FlagAuth set and the
+// HMAC-SHA256 of the header and body, truncated to authTagSize bytes,
+// appended. An encrypted packet also has FlagEncrypted set and its body is
+// sealed with AES-256-GCM, with the header as additional data, so the tag is
+// the GCM tag. The nonce is
+//
+//	session   uint32
+//	sequence  uint32
+//	time      uint32   low 32 bits of the header time
+//
+// which is unique as long as the random sessions of the encoders sharing a
+// key are.
+//
+// Receivers of authenticated packets drop those whose header time is more
+// than maxPacketAge from their own clock, so the clocks of the car and pit
+// must agree within it, and those that were already received, see
+// replayGuard. A packet can only be replayed within maxPacketAge of being
+// sent, such as after the receiver was restarted.
+
+// KeySize is the size of a shared key in bytes.
+const KeySize = 32
+
+const authTagSize = 16
+
+// most difference between the header time of an authenticated packet and
+// the clock of its receiver
+var maxPacketAge = time.Minute
+
+var ErrUnauthenticated = errors.New("packet is not authenticated")
+var ErrReplayed = errors.New("packet was already received")
+var ErrExpired = errors.New("packet is too old")
+
+// Auth authenticates and optionally encrypts packets with a shared key.
+type Auth struct {
+	macKey  []byte
+	aead    cipher.AEAD
+	encrypt bool
+}
+
+// ParseKey decodes a key written as hex, such as from openssl rand -hex 32.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "key is not hex")
+	}
+	if len(key) != KeySize {
+		return nil, errors.Errorf("key is %d bytes, not %d", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// NewAuth creates an Auth with a key of KeySize bytes. Packets are encrypted
+// as well as authenticated if encrypt is set. Packets are decoded whether or
+// not they are encrypted.
+func NewAuth(key []byte, encrypt bool) (*Auth, error) {
+	if len(key) != KeySize {
+		return nil, errors.Errorf("key is %d bytes, not %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(deriveKey(key, "juicer encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Auth{
+		macKey:  deriveKey(key, "juicer mac"),
+		aead:    aead,
+		encrypt: encrypt,
+	}, nil
+}
+
+// deriveKey derives the key of a single use from the shared key.
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// flags returns the header flags of the packets sealed.
+func (a *Auth) flags() uint8 {
+	if a.encrypt {
+		return FlagAuth | FlagEncrypted
+	}
+	return FlagAuth
+}
+
+func (a *Auth) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, a.macKey)
+	mac.Write(data)
+	return mac.Sum(nil)[:authTagSize]
+}
+
+func nonce(hdr *Header) []byte {
+	n := make([]byte, 12)
+	binary.LittleEndian.PutUint32(n[0:4], hdr.Session)
+	binary.LittleEndian.PutUint32(n[4:8], hdr.Sequence)
+	binary.LittleEndian.PutUint32(n[8:12], uint32(hdr.Time))
+	return n
+}
+
+// seal authenticates a packet whose header has the flags of the Auth.
+func (a *Auth) seal(packet []byte, hdr *Header) []byte {
+	if !a.encrypt {
+		return append(packet, a.mac(packet)...)
+	}
+	header := packet[:headerSize]
+	return a.aead.Seal(append([]byte(nil), header...), nonce(hdr), packet[headerSize:], header)
+}
+
+// open verifies a packet, returning it without the tag and decrypted.
+func (a *Auth) open(packet []byte, hdr *Header) ([]byte, error) {
+	if hdr.Flags&FlagAuth == 0 || len(packet) < headerSize+authTagSize {
+		return nil, ErrUnauthenticated
+	}
+	if hdr.Flags&FlagEncrypted == 0 {
+		n := len(packet) - authTagSize
+		if !hmac.Equal(packet[n:], a.mac(packet[:n])) {
+			return nil, ErrUnauthenticated
+		}
+		return packet[:n], nil
+	}
+	header := packet[:headerSize]
+	plain, err := a.aead.Open(append([]byte(nil), header...), nonce(hdr), packet[headerSize:], header)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	return plain, nil
+}
+
+// Decode verifies and decodes an authenticated packet. It returns
+// ErrUnauthenticated for packets that are not authenticated with the key, and
+// ErrExpired for those whose header time is more than maxPacketAge from now.
+func (a *Auth) Decode(buf []byte) (*Packet, error) {
+	hdr, err := readHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := a.open(buf, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if age := time.Since(time.Unix(0, hdr.Time)); age > maxPacketAge || age < -maxPacketAge {
+		return nil, ErrExpired
+	}
+	return decode(plain)
+}
+
+// most sessions of a sender that a replayGuard remembers
+const maxReplaySessions = 8
+
+// replayGuard drops packets that were already received from a sender, using
+// a window of the last 64 sequences of each of its recent sessions. Packets
+// older than the window are dropped. Only the packets of a session that was
+// forgotten, once the sender has started maxReplaySessions newer ones, can be
+// replayed, and with an Auth only until they are older than maxPacketAge.
+type replayGuard struct {
+	// oldest first
+	sessions []uint32
+	windows  map[uint32]*Ack
+}
+
+func newReplayGuard() *replayGuard {
+	return &replayGuard{
+		windows: map[uint32]*Ack{},
+	}
+}
+
+// accept reports whether a packet is new, recording it if it is.
+func (g *replayGuard) accept(session uint32, sequence uint32) bool {
+	w, ok := g.windows[session]
+	if !ok {
+		if len(g.sessions) == maxReplaySessions {
+			delete(g.windows, g.sessions[0])
+			g.sessions = g.sessions[1:]
+		}
+		g.sessions = append(g.sessions, session)
+		g.windows[session] = &Ack{Session: session, Sequence: sequence}
+		return true
+	}
+	if d := w.Sequence - sequence; w.Has(sequence) || (d > 64 && d < 1<<31) {
+		return false
+	}
+	w.add(sequence)
+	return true
+}
@@ -0,0 +1,121 @@
+package forwarder
+
+import (
+	"bytes"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, KeySize)
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("4242424242424242424242424242424242424242424242424242424242424242")
+	assert.NoError(t, err)
+	assert.Equal(t, testKey, key)
+	_, err = ParseKey("4242")
+	assert.Error(t, err)
+	_, err = ParseKey("not hex")
+	assert.Error(t, err)
+}
+
+func TestAuth(t *testing.T) {
+	telem := juicer.Telemetry{RPM: 6000, Time: 100}
+	otherKey := bytes.Repeat([]byte{0x24}, KeySize)
+	for _, encrypt := range []bool{false, true} {
+		auth, err := NewAuth(testKey, encrypt)
+		assert.NoError(t, err)
+		e, err := NewEncoder(4)
+		assert.NoError(t, err)
+		e.SetAuth(auth)
+		buf, err := e.Telemetry(&telem)
+		assert.NoError(t, err)
+		assert.Len(t, buf, telemetryPacketSize+authTagSize)
+
+		p, err := auth.Decode(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, FlagAuth, p.Flags&FlagAuth)
+		assert.Equal(t, &telem, p.Telemetry)
+
+		// a receiver decodes both whatever it encrypts itself
+		other, err := NewAuth(testKey, !encrypt)
+		assert.NoError(t, err)
+		_, err = other.Decode(buf)
+		assert.NoError(t, err)
+
+		wrong, err := NewAuth(otherKey, encrypt)
+		assert.NoError(t, err)
+		_, err = wrong.Decode(buf)
+		assert.Equal(t, ErrUnauthenticated, err)
+
+		for _, n := range []int{2, headerSize + 1, len(buf) - 1} {
+			tampered := append([]byte(nil), buf...)
+			tampered[n] ^= 1
+			_, err = auth.Decode(tampered)
+			assert.Equal(t, ErrUnauthenticated, err, "byte %d changed", n)
+		}
+
+		_, err = Decode(buf)
+		if encrypt {
+			assert.Equal(t, ErrEncrypted, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	// packets without a key are not authenticated
+	auth, err := NewAuth(testKey, false)
+	assert.NoError(t, err)
+	e, err := NewEncoder(4)
+	assert.NoError(t, err)
+	buf, err := e.Telemetry(&telem)
+	assert.NoError(t, err)
+	_, err = auth.Decode(buf)
+	assert.Equal(t, ErrUnauthenticated, err)
+	_, err = NewAuth(testKey[:16], false)
+	assert.Error(t, err)
+
+	// the shared key is not used directly
+	assert.NotEqual(t, testKey, auth.macKey)
+	assert.NotEqual(t, auth.macKey, deriveKey(testKey, "juicer encrypt"))
+}
+
+func TestAuthExpired(t *testing.T) {
+	defer func(age time.Duration) {
+		maxPacketAge = age
+	}(maxPacketAge)
+	maxPacketAge = 10 * time.Millisecond
+
+	auth, err := NewAuth(testKey, true)
+	assert.NoError(t, err)
+	e, err := NewEncoder(4)
+	assert.NoError(t, err)
+	e.SetAuth(auth)
+	buf, err := e.Telemetry(&juicer.Telemetry{RPM: 6000})
+	assert.NoError(t, err)
+	_, err = auth.Decode(buf)
+	assert.NoError(t, err)
+	time.Sleep(2 * maxPacketAge)
+	_, err = auth.Decode(buf)
+	assert.Equal(t, ErrExpired, err)
+}
+
+func TestReplayGuard(t *testing.T) {
+	g := newReplayGuard()
+	assert.True(t, g.accept(1, 10))
+	assert.False(t, g.accept(1, 10))
+	assert.True(t, g.accept(1, 12))
+	assert.True(t, g.accept(1, 11), "reordered")
+	assert.False(t, g.accept(1, 11))
+	assert.True(t, g.accept(1, 100))
+	assert.False(t, g.accept(1, 20), "older than the window")
+
+	// sessions are separate until they are forgotten
+	assert.True(t, g.accept(2, 10))
+	for session := uint32(3); session < maxReplaySessions+2; session++ {
+		assert.True(t, g.accept(session, 1))
+	}
+	assert.False(t, g.accept(2, 10))
+	assert.True(t, g.accept(1, 100))
+}
@@ -0,0 +1,86 @@
+package forwarder
+
+import (
+	"github.com/jd3nn1s/juicer"
+	"sync"
+	"time"
+)
+
+type backlogEntry struct {
+	sequence uint32
+	sent     time.Time
+	samples  []juicer.Telemetry
+}
+
+// backlog keeps the telemetry packets sent until the receiver acknowledges
+// them, so that they can be sent again once a lost link returns. The oldest
+// packet is dropped when it is full.
+type backlog struct {
+	size int
+
+	mu sync.Mutex
+	// in the order sent, which is the order of their sequences
+	entries []backlogEntry
+	dropped uint64
+}
+
+func newBacklog(size int) *backlog {
+	return &backlog{
+		size: size,
+	}
+}
+
+// add keeps the samples of a packet, which must not be modified afterwards.
+func (b *backlog) add(sequence uint32, sent time.Time, samples []juicer.Telemetry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) >= b.size {
+		n := len(b.entries) - b.size + 1
+		b.entries = b.entries[n:]
+		b.dropped += uint64(n)
+	}
+	b.entries = append(b.entries, backlogEntry{
+		sequence: sequence,
+		sent:     sent,
+		samples:  samples,
+	})
+}
+
+// ack removes the telemetry acknowledged.
+func (b *backlog) ack(ack Ack) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// only the newest entries can be in the ack
+	kept := len(b.entries)
+	for i := len(b.entries) - 1; i >= 0; i-- {
+		seq := b.entries[i].sequence
+		if d := ack.Sequence - seq; d > 64 && d < 1<<31 {
+			break
+		}
+		if ack.Has(seq) {
+			copy(b.entries[i:], b.entries[i+1:kept])
+			kept--
+		}
+	}
+	b.entries = b.entries[:kept]
+}
+
+// next removes and returns the samples of the oldest packet that was sent
+// more than timeout ago without being acknowledged.
+func (b *backlog) next(now time.Time, timeout time.Duration) ([]juicer.Telemetry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 || now.Sub(b.entries[0].sent) < timeout {
+		return nil, false
+	}
+	samples := b.entries[0].samples
+	b.entries = b.entries[1:]
+	return samples, true
+}
+
+// stats returns the packets waiting for an ack and the number dropped.
+func (b *backlog) stats() (int, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries), b.dropped
+}
@@ -0,0 +1,69 @@
+package forwarder
+
+import (
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAck(t *testing.T) {
+	ack := Ack{Session: 1, Sequence: 10}
+	assert.True(t, ack.Has(10))
+	assert.False(t, ack.Has(9))
+
+	ack.add(12)
+	assert.Equal(t, uint32(12), ack.Sequence)
+	assert.True(t, ack.Has(12))
+	assert.False(t, ack.Has(11))
+	assert.True(t, ack.Has(10))
+
+	// late packets are recorded
+	ack.add(11)
+	assert.Equal(t, uint32(12), ack.Sequence)
+	assert.True(t, ack.Has(11))
+
+	ack.add(12 + 64)
+	assert.True(t, ack.Has(12))
+	assert.False(t, ack.Has(11))
+
+	// too far ahead to keep any of the history
+	ack.add(12 + 64 + 65)
+	assert.False(t, ack.Has(12+64))
+	assert.False(t, ack.Has(0))
+
+	// sequence wraps
+	ack = Ack{Sequence: 0xffffffff}
+	ack.add(1)
+	assert.True(t, ack.Has(0xffffffff))
+	assert.False(t, ack.Has(0))
+}
+
+func TestBacklog(t *testing.T) {
+	b := newBacklog(3)
+	now := time.Now()
+	timeout := time.Second
+
+	for seq := uint32(1); seq <= 4; seq++ {
+		b.add(seq, now, []juicer.Telemetry{{Time: int64(seq)}})
+	}
+	pending, dropped := b.stats()
+	assert.Equal(t, 3, pending)
+	assert.Equal(t, uint64(1), dropped)
+
+	b.ack(Ack{Sequence: 3})
+	pending, _ = b.stats()
+	assert.Equal(t, 2, pending)
+
+	// nothing is sent again until it had time to be acknowledged
+	_, ok := b.next(now, timeout)
+	assert.False(t, ok)
+	samples, ok := b.next(now.Add(timeout), timeout)
+	assert.True(t, ok)
+	assert.Equal(t, []juicer.Telemetry{{Time: 2}}, samples)
+	samples, ok = b.next(now.Add(timeout), timeout)
+	assert.True(t, ok)
+	assert.Equal(t, []juicer.Telemetry{{Time: 4}}, samples)
+	_, ok = b.next(now.Add(timeout), timeout)
+	assert.False(t, ok)
+}
@@ -0,0 +1,57 @@
+package forwarder
+
+import (
+	"github.com/jd3nn1s/juicer"
+)
+
+// batch collects the samples of a TypeBatch packet until it has size
+// samples or the next would not fit in a packet.
+type batch struct {
+	size int
+	// largest body that fits in a packet, less the count
+	maxBytes int
+
+	samples []juicer.Telemetry
+	bytes   int
+	// whether any of the samples are new rather than re-sent
+	keep bool
+}
+
+func newBatch(size int, auth bool) *batch {
+	maxBytes := maxPacketSize - headerSize - 1
+	if auth {
+		maxBytes -= authTagSize
+	}
+	return &batch{
+		size:     size,
+		maxBytes: maxBytes,
+	}
+}
+
+func (b *batch) sampleSize(telem *juicer.Telemetry) int {
+	var prev *juicer.Telemetry
+	if n := len(b.samples); n > 0 {
+		prev = &b.samples[n-1]
+	}
+	return sampleSize(prev, telem)
+}
+
+// fits reports whether telem can be added without exceeding a packet.
+func (b *batch) fits(telem *juicer.Telemetry) bool {
+	return len(b.samples) == 0 || b.bytes+b.sampleSize(telem) <= b.maxBytes
+}
+
+// add adds a sample, returning whether the batch is full.
+func (b *batch) add(telem *juicer.Telemetry, keep bool) bool {
+	b.bytes += b.sampleSize(telem)
+	b.samples = append(b.samples, *telem)
+	b.keep = b.keep || keep
+	return len(b.samples) >= b.size
+}
+
+// take empties the batch, returning its samples and whether any are new.
+func (b *batch) take() ([]juicer.Telemetry, bool) {
+	samples, keep := b.samples, b.keep
+	b.samples, b.bytes, b.keep = nil, 0, false
+	return samples, keep
+}
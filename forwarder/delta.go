@@ -0,0 +1,367 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrMissingKeyframe is returned by Keyframes for a TypeDelta packet whose
+// keyframe was not received.
+var ErrMissingKeyframe = errors.New("keyframe of delta was not received")
+
+// Keyframe is the telemetry of a packet with FlagKeyframe, that TypeDelta
+// packets are encoded from.
+type Keyframe struct {
+	// sequence of the packet
+	Sequence  uint32
+	Telemetry juicer.Telemetry
+}
+
+// kinds of the fields of a TypeDelta packet sent with reduced precision
+const (
+	kindInt16 uint8 = 5
+	kindInt32 uint8 = 6
+)
+
+// updated of a field whose channel was never updated
+const neverUpdated = math.MinInt32
+
+// precision is how a channel is sent in a TypeDelta packet, as an integer of
+// kind of its value multiplied by scale.
+type precision struct {
+	kind  uint8
+	scale float64
+}
+
+// precisions are the channels sent with reduced precision in TypeDelta
+// packets. Other channels, and values that do not fit, are sent as they are
+// in TypeTelemetry packets.
+var precisions = map[juicer.Channel]precision{
+	juicer.ChannelRPM:            {kindInt16, 1},
+	juicer.ChannelOilPressure:    {kindInt16, 100},
+	juicer.ChannelSpeed:          {kindInt16, 10},
+	juicer.ChannelFuelRemaining:  {kindInt16, 100},
+	juicer.ChannelOilTemp:        {kindInt16, 10},
+	juicer.ChannelCoolantTemp:    {kindInt16, 10},
+	juicer.ChannelAirIntakeTemp:  {kindInt16, 10},
+	juicer.ChannelBatteryVoltage: {kindInt16, 100},
+	// about a centimeter
+	juicer.ChannelLatitude:   {kindInt32, 1e7},
+	juicer.ChannelLongitude:  {kindInt32, 1e7},
+	juicer.ChannelAltitude:   {kindInt16, 1},
+	juicer.ChannelTrack:      {kindInt16, 1000},
+	juicer.ChannelGPSSpeed:   {kindInt16, 1},
+	juicer.ChannelDelta:      {kindInt16, 1000},
+	juicer.ChannelLinkLoss:   {kindInt16, 100},
+	juicer.ChannelLinkRTT:    {kindInt16, 1},
+	juicer.ChannelLinkJitter: {kindInt16, 1},
+}
+
+type deltaFieldHeader struct {
+	Tag     uint8
+	Kind    uint8
+	Flags   uint8
+	Updated int32
+}
+
+// millisAfter returns the milliseconds from ref to t, clamped to an int32.
+func millisAfter(t int64, ref int64) int32 {
+	d := (t - ref) / int64(time.Millisecond)
+	if d <= math.MinInt32 {
+		return math.MinInt32 + 1
+	}
+	if d > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(d)
+}
+
+func addMillis(ref int64, millis int32) int64 {
+	return ref + int64(millis)*int64(time.Millisecond)
+}
+
+// writeDeltaSample writes a sample of a TypeDelta packet with the channels of
+// telem that changed since prev.
+func writeDeltaSample(buf *bytes.Buffer, key *juicer.Telemetry, prev *juicer.Telemetry,
+	telem *juicer.Telemetry) error {
+	channels := sampleChannels(prev, telem)
+	body := []interface{}{
+		millisAfter(telem.Time, key.Time),
+		millisAfter(telem.Monotonic, key.Monotonic),
+		uint8(len(channels)),
+	}
+	for _, v := range body {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return errors.Wrap(err, "unable to write telemetry")
+		}
+	}
+	for _, ch := range channels {
+		if err := writeDeltaField(buf, key, telem, ch); err != nil {
+			return errors.Wrapf(err, "unable to write channel %v", ch)
+		}
+	}
+	return nil
+}
+
+func writeDeltaField(w io.Writer, key *juicer.Telemetry, telem *juicer.Telemetry, ch juicer.Channel) error {
+	field := deltaFieldHeader{
+		Tag:     uint8(ch),
+		Kind:    uint8(ch.Kind()),
+		Updated: neverUpdated,
+	}
+	if telem.Updated[ch] != 0 {
+		field.Updated = millisAfter(telem.Updated[ch], key.Time)
+	}
+	if telem.Stale.Has(ch) {
+		field.Flags |= FieldStale
+	}
+	v := telem.Get(ch)
+	p, reduced := precisions[ch]
+	scaled := math.Round(v * p.scale)
+	switch p.kind {
+	case kindInt16:
+		reduced = scaled >= math.MinInt16 && scaled <= math.MaxInt16
+	case kindInt32:
+		reduced = scaled >= math.MinInt32 && scaled <= math.MaxInt32
+	}
+	if reduced {
+		field.Kind = p.kind
+	}
+	if err := binary.Write(w, binary.LittleEndian, &field); err != nil {
+		return err
+	}
+	if !reduced {
+		return writeValue(w, ch.Kind(), v)
+	}
+	if p.kind == kindInt16 {
+		return binary.Write(w, binary.LittleEndian, int16(scaled))
+	}
+	return binary.Write(w, binary.LittleEndian, int32(scaled))
+}
+
+// readDelta reads the samples of a TypeDelta packet from the body following
+// the keyframe sequence.
+func readDelta(r *bytes.Reader, key *juicer.Telemetry) ([]juicer.Telemetry, error) {
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read delta")
+	}
+	if count == 0 {
+		return nil, errors.New("delta has no samples")
+	}
+	samples := make([]juicer.Telemetry, count)
+	prev := key
+	for n := range samples {
+		if err := readDeltaSample(r, key, prev, &samples[n]); err != nil {
+			return nil, errors.Wrapf(err, "unable to read sample %d", n)
+		}
+		prev = &samples[n]
+	}
+	return samples, nil
+}
+
+// readDeltaSample reads a sample of a TypeDelta packet into telem. Channels
+// missing from it keep their value from prev.
+func readDeltaSample(r *bytes.Reader, key *juicer.Telemetry, prev *juicer.Telemetry,
+	telem *juicer.Telemetry) error {
+	*telem = *prev
+	var t, monotonic int32
+	var count uint8
+	for _, v := range []interface{}{&t, &monotonic, &count} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return errors.Wrap(err, "unable to read telemetry")
+		}
+	}
+	telem.Time = addMillis(key.Time, t)
+	telem.Monotonic = addMillis(key.Monotonic, monotonic)
+	for n := 0; n < int(count); n++ {
+		field := deltaFieldHeader{}
+		if err := binary.Read(r, binary.LittleEndian, &field); err != nil {
+			return errors.Wrapf(err, "unable to read field %d", n)
+		}
+		ch := juicer.Channel(field.Tag)
+		v, err := readDeltaValue(r, ch, field.Kind)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read field %d", n)
+		}
+		// sent by a newer juicer
+		if !ch.Valid() {
+			continue
+		}
+		telem.Set(ch, v)
+		telem.Updated[ch] = 0
+		if field.Updated != neverUpdated {
+			telem.Updated[ch] = addMillis(key.Time, field.Updated)
+		}
+		if field.Flags&FieldStale != 0 {
+			telem.Stale.Add(ch)
+		} else {
+			telem.Stale.Remove(ch)
+		}
+	}
+	return nil
+}
+
+func readDeltaValue(r io.Reader, ch juicer.Channel, kind uint8) (float64, error) {
+	var v float64
+	switch kind {
+	case kindInt16:
+		var i int16
+		if err := binary.Read(r, binary.LittleEndian, &i); err != nil {
+			return 0, err
+		}
+		v = float64(i)
+	case kindInt32:
+		var i int32
+		if err := binary.Read(r, binary.LittleEndian, &i); err != nil {
+			return 0, err
+		}
+		v = float64(i)
+	default:
+		return readValue(r, juicer.ChannelKind(kind))
+	}
+	if p, ok := precisions[ch]; ok {
+		v /= p.scale
+	}
+	return v, nil
+}
+
+// most keyframes of a car that Keyframes keeps, deltas may be encoded from
+// an older keyframe while the latest is being acknowledged
+const maxKeyframes = 4
+
+type carKeyframes struct {
+	session uint32
+	// oldest first
+	frames []Keyframe
+}
+
+// Keyframes keeps the recent keyframes of each car to decode the samples of
+// its TypeDelta packets. It is not safe for concurrent use.
+type Keyframes struct {
+	cars map[uint16]*carKeyframes
+}
+
+func NewKeyframes() *Keyframes {
+	return &Keyframes{
+		cars: map[uint16]*carKeyframes{},
+	}
+}
+
+// Update keeps the keyframe of a packet with FlagKeyframe and decodes the
+// samples of a TypeDelta packet from its keyframe, setting Telemetry, Batch
+// and Repeats. It returns ErrMissingKeyframe if the keyframe was not received.
+func (k *Keyframes) Update(p *Packet) error {
+	switch {
+	case p.Type == TypeDelta:
+		key, ok := k.find(p.CarID, p.Session, p.Keyframe)
+		if !ok {
+			return ErrMissingKeyframe
+		}
+		r := bytes.NewReader(p.Body)
+		samples, err := readDelta(r, key)
+		if err != nil {
+			return err
+		}
+		if p.Flags&FlagRedundant != 0 {
+			if p.Repeats, err = readRepeats(r, &samples[0]); err != nil {
+				return err
+			}
+		}
+		p.Batch, p.Telemetry, p.Body = samples, &samples[len(samples)-1], nil
+	case p.Flags&FlagKeyframe != 0 && p.Telemetry != nil:
+		k.add(p.CarID, p.Session, Keyframe{
+			Sequence:  p.Sequence,
+			Telemetry: *p.Telemetry,
+		})
+	}
+	return nil
+}
+
+func (k *Keyframes) add(carID uint16, session uint32, key Keyframe) {
+	car, ok := k.cars[carID]
+	if !ok || car.session != session {
+		car = &carKeyframes{session: session}
+		k.cars[carID] = car
+	}
+	if len(car.frames) == maxKeyframes {
+		car.frames = car.frames[1:]
+	}
+	car.frames = append(car.frames, key)
+}
+
+func (k *Keyframes) find(carID uint16, session uint32, sequence uint32) (*juicer.Telemetry, bool) {
+	car, ok := k.cars[carID]
+	if !ok || car.session != session {
+		return nil, false
+	}
+	for n := range car.frames {
+		if car.frames[n].Sequence == sequence {
+			return &car.frames[n].Telemetry, true
+		}
+	}
+	return nil, false
+}
+
+// keyframer chooses whether a UDPForwarder destination sends a keyframe or a
+// delta from the latest keyframe the receiver acknowledged. Keyframes are
+// sent every interval, and while the link is down so that a receiver that
+// lost them, such as by being restarted, gets a new one.
+type keyframer struct {
+	interval time.Duration
+	// time for a keyframe to be acknowledged before another is sent
+	timeout time.Duration
+
+	mu        sync.Mutex
+	acked     *Keyframe
+	ackedSent time.Time
+	// the keyframe waiting for an ack
+	pending     *Keyframe
+	pendingSent time.Time
+}
+
+func newKeyframer(interval time.Duration, timeout time.Duration) *keyframer {
+	return &keyframer{
+		interval: interval,
+		timeout:  timeout,
+	}
+}
+
+// reference returns the keyframe to encode a delta from, or nil if a
+// keyframe should be sent.
+func (k *keyframer) reference(now time.Time, linkUp bool) *Keyframe {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.acked == nil {
+		return nil
+	}
+	if k.pending != nil && now.Sub(k.pendingSent) < k.timeout {
+		return k.acked
+	}
+	if !linkUp || now.Sub(k.ackedSent) >= k.interval {
+		return nil
+	}
+	return k.acked
+}
+
+func (k *keyframer) sent(key Keyframe, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pending = &key
+	k.pendingSent = now
+}
+
+func (k *keyframer) ack(ack Ack) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pending != nil && ack.Has(k.pending.Sequence) {
+		k.acked, k.ackedSent = k.pending, k.pendingSent
+		k.pending = nil
+	}
+}
@@ -0,0 +1,128 @@
+package forwarder
+
+import (
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEncodeDelta(t *testing.T) {
+	e, err := NewEncoder(3)
+	assert.NoError(t, err)
+	start := time.Now().UnixNano()
+	telem := juicer.Telemetry{
+		Time:          start,
+		Monotonic:     int64(time.Minute),
+		RPM:           4000,
+		OilTemp:       90.25,
+		CoolantTemp:   85,
+		Latitude:      39.5401234,
+		Longitude:     -122.3310987,
+		FuelRemaining: 40.5,
+	}
+	for _, ch := range juicer.Channels() {
+		telem.Updated[ch] = start
+	}
+	telem.Stale.Add(juicer.ChannelLap)
+	buf, err := e.Keyframe([]juicer.Telemetry{telem})
+	assert.NoError(t, err)
+	keyframeSize := len(buf)
+	keyframe, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, FlagKeyframe, keyframe.Flags)
+	key := &Keyframe{Sequence: keyframe.Sequence, Telemetry: telem}
+
+	// only the channels that changed since the keyframe are sent
+	first := telem
+	first.Time += int64(20 * time.Millisecond)
+	first.Monotonic += int64(20 * time.Millisecond)
+	first.RPM = 4100
+	first.Updated[juicer.ChannelRPM] = first.Time
+	second := first
+	second.Time += int64(20 * time.Millisecond)
+	second.Latitude = 39.5401345
+	second.Updated[juicer.ChannelLatitude] = second.Time
+	second.Stale.Remove(juicer.ChannelLap)
+	buf, err = e.Delta(key, []juicer.Telemetry{first, second})
+	assert.NoError(t, err)
+	assert.True(t, len(buf) < keyframeSize/5)
+
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeDelta, p.Type)
+	assert.Equal(t, key.Sequence, p.Keyframe)
+	assert.Nil(t, p.Telemetry)
+
+	keyframes := NewKeyframes()
+	assert.Equal(t, ErrMissingKeyframe, keyframes.Update(p))
+	assert.NoError(t, keyframes.Update(keyframe))
+	assert.NoError(t, keyframes.Update(p))
+	assert.Equal(t, []juicer.Telemetry{first, second}, p.Batch)
+	assert.Equal(t, &second, p.Telemetry)
+
+	// with reduced precision
+	second.Time += int64(20 * time.Millisecond)
+	second.OilTemp = 90.36
+	second.Updated[juicer.ChannelOilTemp] = second.Time + 123456
+	second.Latitude = 39.54013456
+	second.Updated[juicer.ChannelLatitude] = second.Time
+	buf, err = e.Delta(key, []juicer.Telemetry{second})
+	assert.NoError(t, err)
+	p, err = Decode(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, keyframes.Update(p))
+	assert.InDelta(t, 90.4, p.Telemetry.OilTemp, 0.001)
+	assert.InDelta(t, 39.5401346, p.Telemetry.Latitude, 1e-9)
+	assert.Equal(t, second.Time, p.Telemetry.Updated[juicer.ChannelOilTemp])
+	assert.Equal(t, float32(4100), p.Telemetry.RPM)
+
+	// values that do not fit are sent whole
+	second.RPM = 40000
+	buf, err = e.Delta(key, []juicer.Telemetry{second})
+	assert.NoError(t, err)
+	p, err = Decode(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, keyframes.Update(p))
+	assert.Equal(t, float32(40000), p.Telemetry.RPM)
+
+	// keyframes of another session are not used
+	other, err := NewEncoder(3)
+	assert.NoError(t, err)
+	buf, err = other.Delta(key, []juicer.Telemetry{second})
+	assert.NoError(t, err)
+	p, err = Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrMissingKeyframe, keyframes.Update(p))
+}
+
+func TestKeyframer(t *testing.T) {
+	k := newKeyframer(10*time.Second, time.Second)
+	now := time.Now()
+	assert.Nil(t, k.reference(now, true))
+
+	// deltas are sent once the keyframe is acknowledged
+	key := Keyframe{Sequence: 1}
+	k.sent(key, now)
+	assert.Nil(t, k.reference(now, true))
+	k.ack(Ack{Sequence: 1})
+	assert.Equal(t, &key, k.reference(now, true))
+
+	// a keyframe is sent every interval
+	now = now.Add(10 * time.Second)
+	assert.Nil(t, k.reference(now, true))
+	k.sent(Keyframe{Sequence: 5}, now)
+	assert.Equal(t, &key, k.reference(now, true))
+	// until one is acknowledged
+	assert.Nil(t, k.reference(now.Add(time.Second), true))
+	k.sent(Keyframe{Sequence: 7}, now.Add(time.Second))
+	k.ack(Ack{Sequence: 7})
+	assert.Equal(t, uint32(7), k.reference(now.Add(time.Second), true).Sequence)
+
+	// and while the link is down
+	now = now.Add(2 * time.Second)
+	assert.NotNil(t, k.reference(now, true))
+	assert.Nil(t, k.reference(now, false))
+	k.sent(Keyframe{Sequence: 9}, now)
+	assert.Equal(t, uint32(7), k.reference(now, false).Sequence)
+}
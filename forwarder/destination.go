@@ -0,0 +1,365 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDPDestination is a receiver that a UDPForwarder sends telemetry to.
+type UDPDestination struct {
+	Server string
+	Port   int
+	// minimum interval between telemetry packets, or samples when batching,
+	// the forwarder's SendRateLimit if zero
+	SendRateLimit juicer.Duration
+}
+
+// destination is the connection to a single receiver. Each has its own
+// session so the acks, backlog and link stats of a receiver only cover the
+// packets sent to it.
+type destination struct {
+	name string
+	// minimum interval between telemetry packets, or samples when batching
+	rateLimit time.Duration
+	// allowance for telemetry delivered by the juicer a little early, half
+	// the interval of the fastest destination
+	slack time.Duration
+
+	conn    net.Conn
+	encoder *Encoder
+	backlog *backlog
+	link    *linkMonitor
+	auth    *Auth
+	// nil unless sending deltas
+	keyframes *keyframer
+	// nil unless repeating packets
+	repeats *repeater
+	// only used by the receive go-routine
+	messages messageFilter
+	replay   *replayGuard
+	// only used by the Start go-routine
+	wasUp bool
+
+	// protects lastSent which is used to rate limit and re-send telemetry,
+	// and batch. It is held while a batch is sent so that they are sent in
+	// order.
+	mu       sync.Mutex
+	lastSent time.Time
+	// samples waiting to be sent, nil unless batching
+	batch *batch
+
+	// held from encoding a packet until it is written, so that packets are
+	// sent in sequence and the keyframe to send a delta from is chosen once
+	// per packet. It is taken after mu.
+	sendMu sync.Mutex
+}
+
+func newDestination(config *UDPConfig, dest UDPDestination, auth *Auth) (*destination, error) {
+	encoder, err := NewEncoder(config.CarID)
+	if err != nil {
+		return nil, err
+	}
+	d := &destination{
+		name:      net.JoinHostPort(dest.Server, strconv.Itoa(dest.Port)),
+		rateLimit: dest.SendRateLimit.Duration,
+		encoder:   encoder,
+		link:      newLinkMonitor(config.AckTimeout.Duration),
+		auth:      auth,
+	}
+	if d.rateLimit == 0 {
+		d.rateLimit = config.SendRateLimit.Duration
+	}
+	if auth != nil {
+		encoder.SetAuth(auth)
+		d.replay = newReplayGuard()
+	}
+	if config.Backlog > 0 {
+		d.backlog = newBacklog(config.Backlog)
+	}
+	if config.BatchSize > 1 {
+		d.batch = newBatch(config.BatchSize, auth != nil)
+	}
+	if config.KeyframeInterval.Duration > 0 {
+		d.keyframes = newKeyframer(config.KeyframeInterval.Duration, config.AckTimeout.Duration)
+	}
+	if config.Redundancy > 0 {
+		d.repeats = newRepeater(config.Redundancy)
+	}
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *destination) connect() error {
+	writeBufSize := maxPacketSize * 2
+
+	conn, err := net.Dial("udp", d.name)
+	if err != nil {
+		return err
+	}
+	udpConn := conn.(*net.UDPConn)
+	if err = udpConn.SetWriteBuffer(writeBufSize); err != nil {
+		conn.Close()
+		return errors.Wrapf(err, "unable to set OS write buffer to %v", writeBufSize)
+	}
+
+	d.conn = conn
+	return nil
+}
+
+// due reports whether live telemetry can be sent without exceeding the rate
+// limit, and how long it has been since telemetry was last sent.
+func (d *destination) due(now time.Time) (bool, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	idle := now.Sub(d.lastSent)
+	return idle >= d.rateLimit-d.slack, idle
+}
+
+// send sends live telemetry, keeping it for backfill if it is new rather
+// than re-sent to show the car is alive. When batching it is added to the
+// batch, which is sent once it is full. Re-sent telemetry is sent at once
+// with the batch.
+func (d *destination) send(telem *juicer.Telemetry, keep bool) error {
+	d.mu.Lock()
+	d.lastSent = time.Now()
+	if d.batch == nil {
+		d.mu.Unlock()
+		return d.forward([]juicer.Telemetry{*telem}, keep, false)
+	}
+	defer d.mu.Unlock()
+	var err error
+	if !d.batch.fits(telem) {
+		err = d.sendBatch()
+	}
+	if full := d.batch.add(telem, keep); full || !keep {
+		if batchErr := d.sendBatch(); err == nil {
+			err = batchErr
+		}
+	}
+	return err
+}
+
+// flush sends the batched samples, returning how many were sent.
+func (d *destination) flush() (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.batch.samples)
+	return n, d.sendBatch()
+}
+
+// sendBatch sends the batched samples, d.mu must be held.
+func (d *destination) sendBatch() error {
+	samples, keep := d.batch.take()
+	if len(samples) == 0 {
+		return nil
+	}
+	return d.forward(samples, keep, false)
+}
+
+// forward sends samples of telemetry. Live telemetry is sent as a delta from
+// the latest keyframe when sending deltas, and repeats the latest packets of
+// new telemetry when repeating. Backfilled telemetry is always sent whole.
+func (d *destination) forward(samples []juicer.Telemetry, keep bool, backfill bool) error {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	now := time.Now()
+	var packet []byte
+	var err error
+	var key *Keyframe
+	if d.keyframes != nil && !backfill {
+		key = d.keyframes.reference(now, d.link.up(now))
+	}
+	var repeats []Repeat
+	if d.repeats != nil && !backfill {
+		repeats = d.repeats.repeats()
+	}
+	switch {
+	case key != nil:
+		packet, err = d.encoder.Delta(key, samples, repeats...)
+	case d.keyframes != nil && !backfill:
+		packet, err = d.encoder.Keyframe(samples, repeats...)
+	default:
+		packet, err = d.encode(samples, backfill, repeats)
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to encode telemetry udp packet")
+	}
+	hdr := Header{}
+	// the header was just encoded so can be read back
+	_ = binary.Read(bytes.NewReader(packet), binary.LittleEndian, &hdr)
+	if hdr.Flags&FlagKeyframe != 0 {
+		d.keyframes.sent(Keyframe{
+			Sequence:  hdr.Sequence,
+			Telemetry: samples[len(samples)-1],
+		}, now)
+	}
+	if keep && !backfill && d.repeats != nil {
+		d.repeats.sent(Repeat{
+			Sequence: hdr.Sequence,
+			Flags:    hdr.Flags & FlagKeyframe,
+			Samples:  samples,
+		})
+	}
+	d.link.sent(hdr.Sequence, now)
+	if keep && d.backlog != nil {
+		d.backlog.add(hdr.Sequence, now, samples)
+	}
+	return d.write(packet)
+}
+
+// encode encodes samples as a TypeBatch packet when batching, otherwise the
+// single sample as a TypeTelemetry packet. Backfilled telemetry has no
+// repeats.
+func (d *destination) encode(samples []juicer.Telemetry, backfill bool, repeats []Repeat) ([]byte, error) {
+	switch {
+	case d.batch != nil && backfill:
+		return d.encoder.BackfillBatch(samples)
+	case d.batch != nil:
+		return d.encoder.Batch(samples, repeats...)
+	case backfill:
+		return d.encoder.Backfill(&samples[0])
+	}
+	return d.encoder.Telemetry(&samples[0], repeats...)
+}
+
+// sendPacket encodes a packet other than telemetry and sends it.
+func (d *destination) sendPacket(kind string, encode func() ([]byte, error)) error {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	packet, err := encode()
+	if err != nil {
+		return errors.Wrapf(err, "unable to encode %s udp packet", kind)
+	}
+	return d.write(packet)
+}
+
+func (d *destination) write(packet []byte) error {
+	_, err := d.conn.Write(packet)
+	return errors.Wrapf(err, "unable to send to %s", d.name)
+}
+
+// checkLink logs when the link to the receiver is lost or returns.
+func (d *destination) checkLink(now time.Time) {
+	up := d.link.up(now)
+	if up == d.wasUp {
+		return
+	}
+	d.wasUp = up
+	logger := log.WithField("destination", d.name)
+	if d.backlog != nil {
+		pending, dropped := d.backlog.stats()
+		logger = logger.WithField("backlog", pending).WithField("dropped", dropped)
+	}
+	if up {
+		logger.Info("link to receiver is up")
+	} else {
+		logger.Warn("link to receiver lost")
+	}
+}
+
+// backfill sends the oldest telemetry that was not acknowledged if the link
+// is up. Backfilled telemetry is kept until it is acknowledged like live
+// telemetry.
+func (d *destination) backfill(now time.Time) {
+	if d.backlog == nil || !d.link.up(now) {
+		return
+	}
+	samples, ok := d.backlog.next(now, d.link.timeout)
+	if !ok {
+		return
+	}
+	if err := d.forward(samples, true, true); err != nil {
+		log.Error("unable to backfill telemetry ", err)
+	}
+}
+
+// receive reads the acks and messages sent by the receiver until ctx is
+// done, passing the messages to handleMessage.
+func (d *destination) receive(ctx context.Context, handleMessage func(juicer.PitMessage)) {
+	buf := make([]byte, maxPacketSize)
+	for ctx.Err() == nil {
+		n, err := d.conn.Read(buf)
+		if err != nil {
+			// such as ICMP port unreachable while the receiver is down
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		p, err := d.decode(buf[:n])
+		if err != nil || p.CarID != d.encoder.CarID {
+			continue
+		}
+		switch p.Type {
+		case TypeAck:
+			if p.Ack.Session != d.encoder.Session {
+				continue
+			}
+			d.link.ack(*p.Ack, time.Now())
+			if d.backlog != nil {
+				d.backlog.ack(*p.Ack)
+			}
+			if d.keyframes != nil {
+				d.keyframes.ack(*p.Ack)
+			}
+		case TypeMessage:
+			d.receiveMessage(p, handleMessage)
+		}
+	}
+}
+
+// decode decodes a packet from the receiver, which must be authenticated and
+// new if the forwarder has a key.
+func (d *destination) decode(buf []byte) (*Packet, error) {
+	if d.auth == nil {
+		return Decode(buf)
+	}
+	p, err := d.auth.Decode(buf)
+	if err != nil {
+		log.Debugf("dropping packet from %s: %v", d.name, err)
+		return nil, err
+	}
+	if !d.replay.accept(p.Session, p.Sequence) {
+		log.Debugf("dropping replayed packet %d from %s", p.Sequence, d.name)
+		return nil, ErrReplayed
+	}
+	return p, nil
+}
+
+// receiveMessage acknowledges a message from the pit, passing it to
+// handleMessage unless it was already received.
+func (d *destination) receiveMessage(p *Packet, handleMessage func(juicer.PitMessage)) {
+	err := d.sendPacket("message ack", func() ([]byte, error) {
+		return d.encoder.MessageAck(p.Message.ID)
+	})
+	if err != nil {
+		log.Error("unable to acknowledge pit message ", err)
+	}
+	if d.messages.seen(p.Session, p.Message.ID) {
+		return
+	}
+	handleMessage(*p.Message)
+}
+
+func (d *destination) logLink(now time.Time) {
+	stats := d.link.snapshot(now)
+	log.WithField("destination", d.name).
+		WithField("sent", stats.Sent).
+		WithField("lost", stats.Lost).
+		WithField("loss", fmt.Sprintf("%.1f%%", stats.Loss*100)).
+		WithField("rtt", stats.RTT.Round(time.Millisecond)).
+		WithField("jitter", stats.Jitter.Round(time.Millisecond)).
+		Info("link to receiver")
+}
@@ -0,0 +1,178 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func startReceiver(ctx context.Context, t *testing.T) (*Receiver, chan *Packet) {
+	r, err := NewReceiver("127.0.0.1:0")
+	assert.NoError(t, err)
+	packets := make(chan *Packet, 100)
+	go func() {
+		_ = r.Run(ctx, func(p *Packet, from net.Addr) {
+			if p.Type == TypeTelemetry || p.Type == TypeBatch || p.Type == TypeDelta {
+				packets <- p
+			}
+		})
+	}()
+	return r, packets
+}
+
+func receiverPort(r *Receiver) int {
+	return r.Addr().(*net.UDPAddr).Port
+}
+
+func assertNoPacket(t *testing.T, packets chan *Packet) {
+	select {
+	case p := <-packets:
+		t.Fatalf("unexpected packet %+v", p.Telemetry)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDestinationsConfig(t *testing.T) {
+	udp, err := NewUDPForwarderFromReader(bytes.NewBufferString(`
+mode = "failover"
+
+[[destination]]
+server = "127.0.0.1"
+port = 5001
+
+[[destination]]
+server = "127.0.0.1"
+port = 5002
+sendRateLimit = "1s"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, ModeFailover, udp.Config.Mode)
+	assert.Len(t, udp.destinations, 2)
+	assert.Equal(t, "127.0.0.1:5001", udp.destinations[0].name)
+	assert.Equal(t, sendRateLimit, udp.destinations[0].rateLimit)
+	assert.Equal(t, time.Second, udp.destinations[1].rateLimit)
+	assert.Equal(t, sendRateLimit, udp.ForwarderOptions().RateLimit.Duration)
+	assert.NoError(t, udp.Close())
+
+	// as a [[forwarder]] of the juicer configuration
+	config, err := juicer.LoadConfigFromReader(bytes.NewBufferString(`
+[[forwarder]]
+type = "udp"
+
+[[forwarder.destination]]
+server = "127.0.0.1"
+port = 5001
+`))
+	assert.NoError(t, err)
+	udp, err = NewUDPForwarderFromConfig(config.Forwarders[0])
+	assert.NoError(t, err)
+	assert.Equal(t, ModeBroadcast, udp.Config.Mode)
+	assert.Len(t, udp.destinations, 1)
+	assert.NoError(t, udp.Close())
+
+	_, err = NewUDPForwarderFromReader(bytes.NewBufferString(`mode = "roundrobin"`))
+	assert.Error(t, err)
+	_, err = NewUDPForwarderFromReader(bytes.NewBufferString(`
+server = "127.0.0.1"
+port = 5001
+
+[[destination]]
+server = "127.0.0.1"
+port = 5002
+`))
+	assert.Error(t, err, "both a server and destinations")
+}
+
+func TestBroadcast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pit, pitPackets := startReceiver(ctx, t)
+	cloud, cloudPackets := startReceiver(ctx, t)
+	config := defaultUDPConfig()
+	config.SendRateLimit = juicer.Duration{}
+	config.Destinations = []UDPDestination{
+		{Server: "127.0.0.1", Port: receiverPort(pit)},
+		{Server: "127.0.0.1", Port: receiverPort(cloud), SendRateLimit: juicer.Duration{Duration: time.Hour}},
+	}
+	udp, err := newUDPForwarder(config)
+	assert.NoError(t, err)
+	defer udp.Close()
+
+	// the cloud relay only receives telemetry at its own rate
+	for rpm := float32(1000); rpm <= 3000; rpm += 1000 {
+		assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: rpm}, &juicer.Telemetry{}))
+		assert.Equal(t, rpm, (<-pitPackets).Telemetry.RPM)
+	}
+	p := <-cloudPackets
+	assert.Equal(t, float32(1000), p.Telemetry.RPM)
+	assertNoPacket(t, cloudPackets)
+
+	// each destination has its own session
+	pitCar, ok := pit.Car(0)
+	assert.True(t, ok)
+	assert.NotEqual(t, pitCar.Session, p.Session)
+}
+
+func TestFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary, primaryPackets := startReceiver(ctx, t)
+	backup, backupPackets := startReceiver(ctx, t)
+	config := defaultUDPConfig()
+	config.Mode = ModeFailover
+	config.SendRateLimit = juicer.Duration{}
+	config.MinSendDelay = juicer.Duration{Duration: 50 * time.Millisecond}
+	config.AckTimeout = juicer.Duration{Duration: 200 * time.Millisecond}
+	config.Backlog = 0
+	config.Destinations = []UDPDestination{
+		{Server: "127.0.0.1", Port: receiverPort(primary)},
+		{Server: "127.0.0.1", Port: receiverPort(backup)},
+	}
+	udp, err := newUDPForwarder(config)
+	assert.NoError(t, err)
+	defer udp.Close()
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+	waitLink := func(d *destination, up bool) {
+		for deadline := time.Now().Add(time.Second); d.link.up(time.Now()) != up; {
+			if time.Now().After(deadline) {
+				t.Fatalf("link to %s is not up=%v", d.name, up)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	drain := func(packets chan *Packet) {
+		for len(packets) > 0 {
+			<-packets
+		}
+	}
+
+	// both are sent to until the primary's link is up
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 1000}, &juicer.Telemetry{}))
+	assert.Equal(t, float32(1000), (<-primaryPackets).Telemetry.RPM)
+	assert.Equal(t, float32(1000), (<-backupPackets).Telemetry.RPM)
+	waitLink(udp.destinations[0], true)
+	drain(backupPackets)
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 2000}, &juicer.Telemetry{}))
+	for p := <-primaryPackets; p.Telemetry.RPM != 2000; p = <-primaryPackets {
+	}
+	assertNoPacket(t, backupPackets)
+
+	// the backup takes over once the primary's link is lost
+	assert.NoError(t, primary.Close())
+	waitLink(udp.destinations[0], false)
+	waitLink(udp.destinations[1], true)
+	drain(backupPackets)
+	_ = udp.Forward(&juicer.Telemetry{RPM: 3000}, &juicer.Telemetry{})
+	for p := <-backupPackets; p.Telemetry.RPM != 3000; p = <-backupPackets {
+	}
+	// and the link stats are the backup's
+	assert.Equal(t, udp.destinations[1], udp.active(time.Now()))
+}
@@ -0,0 +1,27 @@
+package forwarder
+
+import (
+	"github.com/jd3nn1s/juicer"
+	"github.com/jd3nn1s/juicer/recorder"
+	"github.com/pkg/errors"
+)
+
+// New creates the forwarder selected by the type of a [[forwarder]] entry
+// in the juicer configuration.
+func New(fc juicer.ForwarderConfig) (juicer.Forwarder, error) {
+	switch fc.Type {
+	case "udp":
+		fwder, err := NewUDPForwarderFromConfig(fc)
+		if err != nil {
+			return nil, err
+		}
+		return fwder, nil
+	case "recorder":
+		fwder, err := recorder.NewFromConfig(fc)
+		if err != nil {
+			return nil, err
+		}
+		return fwder, nil
+	}
+	return nil, errors.Errorf("unknown forwarder type %q", fc.Type)
+}
@@ -0,0 +1,70 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/jd3nn1s/juicer/recorder"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port, pc, _ := startServer(ctx)
+	defer pc.Close()
+
+	config, err := juicer.LoadConfigFromReader(bytes.NewBufferString(`
+[[forwarder]]
+type = "udp"
+` + config(port) + `
+sendRateLimit = "50ms"
+
+[[forwarder]]
+type = "carrier-pigeon"
+`))
+	assert.NoError(t, err)
+
+	fwder, err := New(config.Forwarders[0])
+	assert.NoError(t, err)
+	assert.IsType(t, &UDPForwarder{}, fwder)
+	udp := fwder.(*UDPForwarder)
+	assert.Equal(t, port, udp.Config.Port)
+	assert.Equal(t, 50*time.Millisecond, udp.Config.SendRateLimit.Duration)
+	assert.Equal(t, minSendDelay, udp.Config.MinSendDelay.Duration)
+	assert.NoError(t, udp.Close())
+
+	_, err = New(config.Forwarders[1])
+	assert.Error(t, err)
+}
+
+func TestNewRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config, err := juicer.LoadConfigFromReader(bytes.NewBufferString(`
+[[forwarder]]
+type = "recorder"
+dir = "` + dir + `"
+maxSize = 1000
+
+[[forwarder]]
+type = "recorder"
+`))
+	assert.NoError(t, err)
+
+	fwder, err := New(config.Forwarders[0])
+	assert.NoError(t, err)
+	assert.IsType(t, &recorder.Recorder{}, fwder)
+	rec := fwder.(*recorder.Recorder)
+	assert.Equal(t, int64(1000), rec.Config.MaxSize)
+	assert.NoError(t, rec.Close())
+
+	_, err = New(config.Forwarders[1])
+	assert.Error(t, err, "recorder without a dir should be rejected")
+}
@@ -0,0 +1,196 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"sync"
+	"time"
+)
+
+// interval between updates of the link quality channels
+var linkUpdateInterval = time.Second
+
+// number of the most recent telemetry packets that LinkStats.Loss is
+// calculated over
+const lossWindow = 100
+
+// LinkStats is the quality of the link to the receiver, measured from the
+// acks of the telemetry packets sent.
+type LinkStats struct {
+	// telemetry packets sent, acknowledged and not acknowledged within the
+	// ack timeout
+	Sent  uint64
+	Acked uint64
+	Lost  uint64
+	// fraction of the recent telemetry packets that were lost, from 0 to 1
+	Loss float64
+	// smoothed round trip time and its mean deviation, zero until the first
+	// ack is received
+	RTT    time.Duration
+	Jitter time.Duration
+	// when the last ack was received
+	LastAck time.Time
+}
+
+// linkMonitor measures LinkStats. Packets are lost if they are not
+// acknowledged within timeout.
+type linkMonitor struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	stats LinkStats
+	// when each telemetry packet waiting for an ack was sent, by sequence
+	pending map[uint32]time.Time
+	// ring of whether each of the recent packets was lost, next is where
+	// the next outcome is recorded
+	outcomes [lossWindow]bool
+	next     int
+	count    int
+	lastRTT  time.Duration
+}
+
+func newLinkMonitor(timeout time.Duration) *linkMonitor {
+	return &linkMonitor{
+		timeout: timeout,
+		pending: map[uint32]time.Time{},
+	}
+}
+
+func (m *linkMonitor) sent(sequence uint32, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Sent++
+	m.pending[sequence] = now
+	m.expire(now)
+}
+
+func (m *linkMonitor) ack(ack Ack, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.LastAck = now
+	// acks are sent as each packet is received so the highest sequence is
+	// the packet that caused it
+	if sent, ok := m.pending[ack.Sequence]; ok {
+		m.sample(now.Sub(sent))
+	}
+	for seq := range m.pending {
+		if ack.Has(seq) {
+			delete(m.pending, seq)
+			m.stats.Acked++
+			m.record(false)
+		}
+	}
+	m.expire(now)
+}
+
+// sample updates the RTT and jitter as RFC 6298 and RFC 3550 do.
+func (m *linkMonitor) sample(rtt time.Duration) {
+	if m.stats.RTT == 0 {
+		m.stats.RTT = rtt
+		m.stats.Jitter = rtt / 2
+		m.lastRTT = rtt
+		return
+	}
+	m.stats.RTT += (rtt - m.stats.RTT) / 8
+	d := rtt - m.lastRTT
+	if d < 0 {
+		d = -d
+	}
+	m.stats.Jitter += (d - m.stats.Jitter) / 16
+	m.lastRTT = rtt
+}
+
+// expire counts the packets not acknowledged within the timeout as lost.
+func (m *linkMonitor) expire(now time.Time) {
+	for seq, sent := range m.pending {
+		if now.Sub(sent) >= m.timeout {
+			delete(m.pending, seq)
+			m.stats.Lost++
+			m.record(true)
+		}
+	}
+}
+
+func (m *linkMonitor) record(lost bool) {
+	m.outcomes[m.next] = lost
+	m.next = (m.next + 1) % lossWindow
+	if m.count < lossWindow {
+		m.count++
+	}
+	n := 0
+	for _, lost := range m.outcomes[:m.count] {
+		if lost {
+			n++
+		}
+	}
+	m.stats.Loss = float64(n) / float64(m.count)
+}
+
+// up reports whether an ack was received within the timeout.
+func (m *linkMonitor) up(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.stats.LastAck.IsZero() && now.Sub(m.stats.LastAck) < m.timeout
+}
+
+func (m *linkMonitor) snapshot(now time.Time) LinkStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(now)
+	return m.stats
+}
+
+// LinkSource updates the link quality channels from the stats of a
+// UDPForwarder, see UDPForwarder.LinkStats. The RTT and jitter are only
+// updated once an ack is received so that they become stale when the link is
+// lost.
+type LinkSource struct {
+	juicer.UpdateSender
+	stats func(now time.Time) LinkStats
+}
+
+func (s *LinkSource) Name() string {
+	return juicer.LinkSourceName
+}
+
+func (s *LinkSource) Open() error {
+	return nil
+}
+
+func (s *LinkSource) Close() error {
+	return nil
+}
+
+func (s *LinkSource) Start(ctx context.Context) error {
+	ticker := time.NewTicker(linkUpdateInterval)
+	defer ticker.Stop()
+	var lastAck time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			stats := s.stats(now)
+			if stats.Sent == 0 {
+				continue
+			}
+			values := []juicer.ChannelValue{
+				{Channel: juicer.ChannelLinkLoss, Value: stats.Loss * 100},
+			}
+			if stats.LastAck != lastAck {
+				lastAck = stats.LastAck
+				values = append(values,
+					juicer.ChannelValue{Channel: juicer.ChannelLinkRTT, Value: durationMillis(stats.RTT)},
+					juicer.ChannelValue{Channel: juicer.ChannelLinkJitter, Value: durationMillis(stats.Jitter)})
+			}
+			s.Send(juicer.Update{
+				Source: s.Name(),
+				Values: values,
+			})
+		}
+	}
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,92 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLinkMonitor(t *testing.T) {
+	m := newLinkMonitor(time.Second)
+	start := time.Now()
+	for seq := uint32(1); seq <= 4; seq++ {
+		m.sent(seq, start)
+	}
+	assert.False(t, m.up(start))
+	ack := Ack{Sequence: 1}
+	m.ack(ack, start.Add(100*time.Millisecond))
+	assert.True(t, m.up(start.Add(100*time.Millisecond)))
+	assert.False(t, m.up(start.Add(1100*time.Millisecond)))
+	stats := m.snapshot(start.Add(100 * time.Millisecond))
+	assert.Equal(t, uint64(4), stats.Sent)
+	assert.Equal(t, uint64(1), stats.Acked)
+	assert.Equal(t, 100*time.Millisecond, stats.RTT)
+	assert.Equal(t, 50*time.Millisecond, stats.Jitter)
+	assert.Zero(t, stats.Loss)
+
+	// 2 is lost and 3 arrives late
+	ack.add(4)
+	m.ack(ack, start.Add(180*time.Millisecond))
+	ack.add(3)
+	m.ack(ack, start.Add(900*time.Millisecond))
+	stats = m.snapshot(start.Add(time.Second))
+	assert.Equal(t, uint64(3), stats.Acked)
+	assert.Equal(t, uint64(1), stats.Lost)
+	assert.Equal(t, 0.25, stats.Loss)
+	assert.Equal(t, 100*time.Millisecond+(180-100)*time.Millisecond/8, stats.RTT)
+	assert.Equal(t, 50*time.Millisecond+(80-50)*time.Millisecond/16, stats.Jitter)
+	assert.Equal(t, start.Add(900*time.Millisecond), stats.LastAck)
+}
+
+func TestLinkSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oldLinkUpdateInterval := linkUpdateInterval
+	defer func() {
+		linkUpdateInterval = oldLinkUpdateInterval
+	}()
+	linkUpdateInterval = 10 * time.Millisecond
+
+	r, err := NewReceiver("127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		_ = r.Run(ctx, nil)
+	}()
+	config := defaultUDPConfig()
+	config.Server = "127.0.0.1"
+	config.Port = r.Addr().(*net.UDPAddr).Port
+	udp, err := newUDPForwarder(config)
+	assert.NoError(t, err)
+	defer udp.Close()
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+
+	updates := make(chan juicer.Update, 10)
+	src := udp.Source()
+	assert.Equal(t, juicer.LinkSourceName, src.Name())
+	src.SetUpdateChan(updates)
+	go func() {
+		_ = src.Start(ctx)
+	}()
+
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 1000}, &juicer.Telemetry{}))
+	for {
+		update := <-updates
+		telem := juicer.Telemetry{}
+		telem.Apply(update)
+		if telem.UpdatedAt(juicer.ChannelLinkRTT).IsZero() {
+			continue
+		}
+		assert.Zero(t, telem.LinkLoss)
+		assert.True(t, telem.LinkRTT > 0)
+		break
+	}
+	stats := udp.LinkStats()
+	assert.Equal(t, uint64(1), stats.Sent)
+	assert.Equal(t, uint64(1), stats.Acked)
+}
@@ -0,0 +1,66 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+)
+
+// messages the car remembers to recognise one that is sent again
+const recentMessages = 16
+
+type messageHeader struct {
+	ID   uint32
+	Code uint8
+}
+
+func writeMessage(buf *bytes.Buffer, msg juicer.PitMessage) {
+	// the error is always nil, messageHeader is a fixed size and buf grows
+	_ = binary.Write(buf, binary.LittleEndian, &messageHeader{
+		ID:   msg.ID,
+		Code: uint8(msg.Code),
+	})
+	writeString(buf, msg.Text)
+}
+
+func readMessage(r *bytes.Reader) (*juicer.PitMessage, error) {
+	hdr := messageHeader{}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "unable to read message")
+	}
+	text, err := readString(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read message text")
+	}
+	return &juicer.PitMessage{
+		ID:   hdr.ID,
+		Code: juicer.PitCode(hdr.Code),
+		Text: text,
+	}, nil
+}
+
+// messageKey identifies a message, the IDs are chosen by each receiver
+type messageKey struct {
+	session uint32
+	id      uint32
+}
+
+// messageFilter recognises messages that were already received.
+type messageFilter struct {
+	recent [recentMessages]messageKey
+	next   int
+}
+
+// seen reports whether a message was already received, recording it if not.
+func (f *messageFilter) seen(session uint32, id uint32) bool {
+	key := messageKey{session, id}
+	for _, k := range f.recent {
+		if k == key {
+			return true
+		}
+	}
+	f.recent[f.next] = key
+	f.next = (f.next + 1) % recentMessages
+	return false
+}
@@ -0,0 +1,726 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// The UDP wire protocol. Every value is little-endian and every packet
+// starts with a Header:
+//
+//	magic     [2]byte  "JU"
+//	version   uint8    ProtocolVersion
+//	type      uint8    TypeTelemetry, TypeTiming, TypeStatus, TypeAck,
+//	                   TypeMessage, TypeMessageAck, TypeBatch or TypeDelta
+//	flags     uint8    FlagBackfill, FlagAuth, FlagEncrypted, FlagKeyframe and
+//	                   FlagRedundant
+//	carID     uint16   identifies the car, from the forwarder configuration
+//	session   uint32   random, chosen when the forwarder is created
+//	sequence  uint32   incremented for every packet sent in the session
+//	time      int64    unix nanoseconds when the packet was encoded
+//
+// The body of a TypeTelemetry packet is
+//
+//	time      int64    Telemetry.Time
+//	monotonic int64    Telemetry.Monotonic
+//	count     uint8    number of fields
+//
+// followed by count fields of
+//
+//	tag       uint8    juicer.Channel
+//	kind      uint8    juicer.ChannelKind, 1 float32, 2 float64, 3 uint8,
+//	                   4 uint16
+//	flags     uint8    FieldStale
+//	updated   int64    unix nanoseconds, zero if the channel was never updated
+//	value     kind
+//
+// Fields carry their own kind so a decoder skips channels it does not know
+// about and channels missing from a packet are decoded as stale. Channels
+// can be added without changing the version, which only changes when the
+// layout above does.
+//
+// A TypeBatch packet carries several samples of telemetry so that they can
+// be sent at a higher rate than packets. Its body is a uint8 count of
+// samples followed by count samples, oldest first, each laid out as the
+// body of a TypeTelemetry packet. The first sample has every channel and the
+// rest only the channels that changed since the sample before, which keep
+// their value from it.
+//
+// A TypeTelemetry or TypeBatch packet with FlagKeyframe is a keyframe, whose
+// latest sample later TypeDelta packets are encoded from so that channels
+// which change slowly are not sent in every packet. The body of a TypeDelta
+// packet is
+//
+//	keyframe  uint32   sequence of the keyframe
+//	count     uint8    number of samples
+//
+// followed by count samples, oldest first, of
+//
+//	time      int32    milliseconds after the time of the keyframe
+//	monotonic int32    milliseconds after the monotonic time of the keyframe
+//	count     uint8    number of fields
+//
+// followed by count fields of
+//
+//	tag       uint8    juicer.Channel
+//	kind      uint8    juicer.ChannelKind, or 5 int16 and 6 int32 for
+//	                   channels sent with reduced precision, see precisions
+//	flags     uint8    FieldStale
+//	updated   int32    milliseconds after the time of the keyframe,
+//	                   math.MinInt32 if the channel was never updated
+//	value     kind
+//
+// The first sample has the channels that changed since the keyframe and the
+// rest those that changed since the sample before. A TypeDelta packet can
+// only be decoded by Keyframes, once the keyframe was received.
+//
+// A TypeTelemetry, TypeBatch or TypeDelta packet of live telemetry with
+// FlagRedundant repeats earlier packets, so that the receiver recovers
+// them if they were lost. Following its body is a uint8 count of packets
+// repeated, newest first, of
+//
+//	sequence  uint32   sequence of the packet repeated
+//	flags     uint8    FlagKeyframe if the packet repeated was a keyframe
+//	count     uint8    number of samples
+//
+// followed by count samples, newest first, each laid out as the body of a
+// TypeTelemetry packet with the channels that changed since the sample
+// written before it, starting from the oldest sample of the body. Only as
+// many packets as fit are repeated. Receivers drop packets that were already
+// received or recovered, see Recovery.
+//
+// The body of a TypeTiming packet, sent when a lap or sector is completed, is
+//
+//	lap         uint16  laps started
+//	lastLap     uint32  milliseconds, zero until a lap is completed
+//	bestLap     uint32  milliseconds
+//	sector      uint8   current sector, starting at 1
+//	lastSector  uint32  milliseconds
+//
+// The body of a TypeStatus packet is a uint8 count of sources followed by
+// count sources of
+//
+//	name        string  uint8 length followed by the bytes
+//	state       uint8   juicer.SourceState
+//	reconnects  uint32
+//	messages    uint64
+//	messageRate float32
+//	lastMessage int64   unix nanoseconds, zero if no message was received
+//	lastError   string  uint8 length followed by the bytes
+//
+// A TypeAck packet is sent by the receiver for every TypeTelemetry, TypeBatch
+// and TypeDelta packet so that the car knows the link is up. Its header has
+// the car ID of the car acknowledged and its body is
+//
+//	session     uint32  session of the car
+//	sequence    uint32  highest sequence received
+//	received    uint64  bit n is set if sequence-1-n was received
+//
+// Telemetry that was not acknowledged is sent again once the link is back,
+// with FlagBackfill set and a new sequence. Packets recovered from the
+// repeats of a later packet are acknowledged as if they were received.
+//
+// A TypeMessage packet is sent by the receiver to show a message to the
+// driver of a car. Its header has the car ID of the car and its body is
+//
+//	id          uint32  chosen by the receiver
+//	code        uint8   juicer.PitCode
+//	text        string  uint8 length followed by the bytes
+//
+// The car replies with a TypeMessageAck packet whose body is the uint32 ID
+// of the message. The receiver sends the message again until it is
+// acknowledged, so a car may receive it more than once.
+//
+// Decoders ignore anything following the body so that fields can be appended
+// to the timing, status, ack and message bodies without changing the
+// version.
+const ProtocolVersion uint8 = 1
+
+const (
+	TypeTelemetry  uint8 = 1
+	TypeTiming     uint8 = 2
+	TypeStatus     uint8 = 3
+	TypeAck        uint8 = 4
+	TypeMessage    uint8 = 5
+	TypeMessageAck uint8 = 6
+	TypeBatch      uint8 = 7
+	TypeDelta      uint8 = 8
+)
+
+// FlagBackfill is set in the header of telemetry sent again after the link
+// to the receiver was lost. It is older than the telemetry already received.
+// FlagAuth and FlagEncrypted are set in packets authenticated and encrypted
+// with a shared key, see Auth. FlagKeyframe is set in telemetry that
+// TypeDelta packets are encoded from. FlagRedundant is set in telemetry that
+// repeats earlier packets.
+const (
+	FlagBackfill  uint8 = 1 << 0
+	FlagAuth      uint8 = 1 << 1
+	FlagEncrypted uint8 = 1 << 2
+	FlagKeyframe  uint8 = 1 << 3
+	FlagRedundant uint8 = 1 << 4
+)
+
+// FieldStale is set in the flags of a field whose channel is stale.
+const FieldStale uint8 = 1 << 0
+
+// size of a Header
+const headerSize = 23
+
+// largest UDP payload that is not fragmented on an ethernet link
+const maxPacketSize = 1472
+
+var magic = [2]byte{'J', 'U'}
+
+var ErrNotJuicer = errors.New("not a juicer packet")
+var ErrEncrypted = errors.New("packet is encrypted")
+
+type Header struct {
+	Magic    [2]byte
+	Version  uint8
+	Type     uint8
+	Flags    uint8
+	CarID    uint16
+	Session  uint32
+	Sequence uint32
+	Time     int64
+}
+
+type fieldHeader struct {
+	Tag     uint8
+	Kind    uint8
+	Flags   uint8
+	Updated int64
+}
+
+// Packet is a decoded packet. Only the body matching the packet type is set,
+// except that Telemetry is also set to the latest sample of a TypeBatch or
+// TypeDelta packet.
+type Packet struct {
+	Header
+	Telemetry *juicer.Telemetry
+	// samples of a TypeBatch or TypeDelta packet, oldest first
+	Batch []juicer.Telemetry
+	// sequence of the keyframe of a TypeDelta packet, whose samples are
+	// decoded by Keyframes from Body
+	Keyframe uint32
+	// earlier packets repeated by a packet with FlagRedundant, newest first
+	Repeats []Repeat
+	// set on packets recovered from the repeats of a later packet, see
+	// Recovery
+	Recovered bool
+	Timing    *Timing
+	Status    []SourceStatus
+	Ack       *Ack
+	Message   *juicer.PitMessage
+	// ID of the message acknowledged by a TypeMessageAck packet
+	MessageAck uint32
+	// body of a packet type this decoder does not know about, or of a
+	// TypeDelta packet until it is decoded by Keyframes
+	Body []byte
+}
+
+// Encoder encodes the packets of a single session.
+type Encoder struct {
+	CarID   uint16
+	Session uint32
+
+	sequence uint32
+	auth     *Auth
+}
+
+// NewEncoder creates an encoder with a random session ID so that a receiver
+// can tell when the juicer on a car was restarted.
+func NewEncoder(carID uint16) (*Encoder, error) {
+	var session [4]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return nil, errors.Wrap(err, "unable to generate session id")
+	}
+	return &Encoder{
+		CarID:   carID,
+		Session: binary.LittleEndian.Uint32(session[:]),
+	}, nil
+}
+
+// SetAuth has the packets encoded authenticated, and encrypted if the Auth
+// encrypts. It must be called before any packet is encoded.
+func (e *Encoder) SetAuth(auth *Auth) {
+	e.auth = auth
+}
+
+func (e *Encoder) header(buf *bytes.Buffer, packetType uint8, flags uint8) error {
+	return e.headerFor(buf, packetType, flags, e.CarID)
+}
+
+func (e *Encoder) headerFor(buf *bytes.Buffer, packetType uint8, flags uint8, carID uint16) error {
+	if e.auth != nil {
+		flags |= e.auth.flags()
+	}
+	hdr := Header{
+		Magic:    magic,
+		Version:  ProtocolVersion,
+		Type:     packetType,
+		Flags:    flags,
+		CarID:    carID,
+		Session:  e.Session,
+		Sequence: atomic.AddUint32(&e.sequence, 1),
+		Time:     time.Now().UnixNano(),
+	}
+	return errors.Wrap(binary.Write(buf, binary.LittleEndian, &hdr),
+		"unable to write packet header")
+}
+
+// Telemetry encodes a TypeTelemetry packet with every channel, repeating
+// earlier packets if there are repeats.
+func (e *Encoder) Telemetry(telem *juicer.Telemetry, repeats ...Repeat) ([]byte, error) {
+	return e.telemetry(telem, 0, repeats)
+}
+
+// Backfill encodes a TypeTelemetry packet of telemetry that is being sent
+// again after the link was lost.
+func (e *Encoder) Backfill(telem *juicer.Telemetry) ([]byte, error) {
+	return e.telemetry(telem, FlagBackfill, nil)
+}
+
+func (e *Encoder) telemetry(telem *juicer.Telemetry, flags uint8, repeats []Repeat) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := e.header(buf, TypeTelemetry, flags|redundant(repeats)); err != nil {
+		return nil, err
+	}
+	if err := writeSample(buf, nil, telem); err != nil {
+		return nil, err
+	}
+	if err := e.writeRepeats(buf, telem, repeats); err != nil {
+		return nil, err
+	}
+	return e.finish(buf)
+}
+
+// Batch encodes a TypeBatch packet of samples, oldest first, repeating
+// earlier packets if there are repeats.
+func (e *Encoder) Batch(samples []juicer.Telemetry, repeats ...Repeat) ([]byte, error) {
+	return e.batch(samples, 0, repeats)
+}
+
+// BackfillBatch encodes a TypeBatch packet of samples that are being sent
+// again after the link was lost.
+func (e *Encoder) BackfillBatch(samples []juicer.Telemetry) ([]byte, error) {
+	return e.batch(samples, FlagBackfill, nil)
+}
+
+func (e *Encoder) batch(samples []juicer.Telemetry, flags uint8, repeats []Repeat) ([]byte, error) {
+	if len(samples) == 0 || len(samples) > math.MaxUint8 {
+		return nil, errors.Errorf("unable to batch %d samples", len(samples))
+	}
+	buf := &bytes.Buffer{}
+	if err := e.header(buf, TypeBatch, flags|redundant(repeats)); err != nil {
+		return nil, err
+	}
+	buf.WriteByte(uint8(len(samples)))
+	var prev *juicer.Telemetry
+	for n := range samples {
+		if err := writeSample(buf, prev, &samples[n]); err != nil {
+			return nil, errors.Wrapf(err, "unable to write sample %d", n)
+		}
+		prev = &samples[n]
+	}
+	if err := e.writeRepeats(buf, &samples[0], repeats); err != nil {
+		return nil, err
+	}
+	return e.finish(buf)
+}
+
+// Keyframe encodes samples as a keyframe, a TypeTelemetry packet if there is
+// a single sample and otherwise a TypeBatch packet.
+func (e *Encoder) Keyframe(samples []juicer.Telemetry, repeats ...Repeat) ([]byte, error) {
+	if len(samples) == 1 {
+		return e.telemetry(&samples[0], FlagKeyframe, repeats)
+	}
+	return e.batch(samples, FlagKeyframe, repeats)
+}
+
+// Delta encodes a TypeDelta packet of samples, oldest first, from a keyframe
+// that the receiver has.
+func (e *Encoder) Delta(key *Keyframe, samples []juicer.Telemetry, repeats ...Repeat) ([]byte, error) {
+	if len(samples) == 0 || len(samples) > math.MaxUint8 {
+		return nil, errors.Errorf("unable to encode a delta of %d samples", len(samples))
+	}
+	buf := &bytes.Buffer{}
+	if err := e.header(buf, TypeDelta, redundant(repeats)); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, key.Sequence); err != nil {
+		return nil, errors.Wrap(err, "unable to write delta")
+	}
+	buf.WriteByte(uint8(len(samples)))
+	prev := &key.Telemetry
+	for n := range samples {
+		if err := writeDeltaSample(buf, &key.Telemetry, prev, &samples[n]); err != nil {
+			return nil, errors.Wrapf(err, "unable to write sample %d", n)
+		}
+		prev = &samples[n]
+	}
+	if err := e.writeRepeats(buf, &samples[0], repeats); err != nil {
+		return nil, err
+	}
+	return e.finish(buf)
+}
+
+// redundant returns FlagRedundant if there are packets to repeat.
+func redundant(repeats []Repeat) uint8 {
+	if len(repeats) == 0 {
+		return 0
+	}
+	return FlagRedundant
+}
+
+// sampleChannels returns the channels of telem that changed since prev, or
+// every channel if prev is nil.
+func sampleChannels(prev *juicer.Telemetry, telem *juicer.Telemetry) []juicer.Channel {
+	if prev == nil {
+		return juicer.Channels()
+	}
+	var channels []juicer.Channel
+	for _, ch := range juicer.Channels() {
+		if telem.Updated[ch] != prev.Updated[ch] ||
+			telem.Stale.Has(ch) != prev.Stale.Has(ch) ||
+			telem.Get(ch) != prev.Get(ch) {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+// sampleSize returns the size of the sample written by writeSample.
+func sampleSize(prev *juicer.Telemetry, telem *juicer.Telemetry) int {
+	// time, monotonic and count
+	size := 17
+	for _, ch := range sampleChannels(prev, telem) {
+		size += binary.Size(fieldHeader{}) + ch.Kind().Size()
+	}
+	return size
+}
+
+// writeSample writes the body of a TypeTelemetry packet with the channels of
+// telem that changed since prev, or every channel if prev is nil.
+func writeSample(buf *bytes.Buffer, prev *juicer.Telemetry, telem *juicer.Telemetry) error {
+	channels := sampleChannels(prev, telem)
+	body := []interface{}{telem.Time, telem.Monotonic, uint8(len(channels))}
+	for _, v := range body {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return errors.Wrap(err, "unable to write telemetry")
+		}
+	}
+	for _, ch := range channels {
+		if err := writeField(buf, telem, ch); err != nil {
+			return errors.Wrapf(err, "unable to write channel %v", ch)
+		}
+	}
+	return nil
+}
+
+func writeField(w io.Writer, telem *juicer.Telemetry, ch juicer.Channel) error {
+	field := fieldHeader{
+		Tag:     uint8(ch),
+		Kind:    uint8(ch.Kind()),
+		Updated: telem.Updated[ch],
+	}
+	if telem.Stale.Has(ch) {
+		field.Flags |= FieldStale
+	}
+	if err := binary.Write(w, binary.LittleEndian, &field); err != nil {
+		return err
+	}
+	return writeValue(w, ch.Kind(), telem.Get(ch))
+}
+
+func writeValue(w io.Writer, kind juicer.ChannelKind, v float64) error {
+	switch kind {
+	case juicer.KindFloat32:
+		return binary.Write(w, binary.LittleEndian, float32(v))
+	case juicer.KindFloat64:
+		return binary.Write(w, binary.LittleEndian, v)
+	case juicer.KindUint8:
+		return binary.Write(w, binary.LittleEndian, uint8(v))
+	case juicer.KindUint16:
+		return binary.Write(w, binary.LittleEndian, uint16(v))
+	}
+	return errors.Errorf("unknown kind %v", kind)
+}
+
+// Timing encodes a TypeTiming packet from the lap channels of telem.
+func (e *Encoder) Timing(telem *juicer.Telemetry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := e.header(buf, TypeTiming, 0); err != nil {
+		return nil, err
+	}
+	timing := newTiming(telem)
+	if err := timing.write(buf); err != nil {
+		return nil, errors.Wrap(err, "unable to write timing")
+	}
+	return e.finish(buf)
+}
+
+// Status encodes a TypeStatus packet.
+func (e *Encoder) Status(sources []SourceStatus) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := e.header(buf, TypeStatus, 0); err != nil {
+		return nil, err
+	}
+	if len(sources) > math.MaxUint8 {
+		return nil, errors.Errorf("too many sources %d", len(sources))
+	}
+	buf.WriteByte(uint8(len(sources)))
+	for _, s := range sources {
+		if err := s.write(buf); err != nil {
+			return nil, errors.Wrapf(err, "unable to write status of %s", s.Name)
+		}
+	}
+	return e.finish(buf)
+}
+
+// Ack encodes a TypeAck packet acknowledging the telemetry of a car.
+func (e *Encoder) Ack(carID uint16, ack Ack) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := e.headerFor(buf, TypeAck, 0, carID); err != nil {
+		return nil, err
+	}
+	if err := ack.write(buf); err != nil {
+		return nil, errors.Wrap(err, "unable to write ack")
+	}
+	return e.finish(buf)
+}
+
+// Message encodes a TypeMessage packet for the driver of a car.
+func (e *Encoder) Message(carID uint16, msg juicer.PitMessage) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := e.headerFor(buf, TypeMessage, 0, carID); err != nil {
+		return nil, err
+	}
+	writeMessage(buf, msg)
+	return e.finish(buf)
+}
+
+// MessageAck encodes a TypeMessageAck packet acknowledging a message.
+func (e *Encoder) MessageAck(id uint32) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := e.header(buf, TypeMessageAck, 0); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, id); err != nil {
+		return nil, errors.Wrap(err, "unable to write message ack")
+	}
+	return e.finish(buf)
+}
+
+// finish authenticates an encoded packet if the encoder has an Auth and
+// checks that it fits in a packet.
+func (e *Encoder) finish(buf *bytes.Buffer) ([]byte, error) {
+	packet := buf.Bytes()
+	if e.auth != nil {
+		hdr, err := readHeader(packet)
+		if err != nil {
+			return nil, err
+		}
+		packet = e.auth.seal(packet, hdr)
+	}
+	if len(packet) > maxPacketSize {
+		return nil, errors.Errorf("packet of %d bytes exceeds %d", len(packet), maxPacketSize)
+	}
+	return packet, nil
+}
+
+func readHeader(buf []byte) (*Header, error) {
+	hdr := &Header{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, hdr); err != nil {
+		return nil, errors.Wrap(err, "unable to read packet header")
+	}
+	if hdr.Magic != magic {
+		return nil, ErrNotJuicer
+	}
+	if hdr.Version > ProtocolVersion {
+		return nil, errors.Errorf("unsupported protocol version %d", hdr.Version)
+	}
+	return hdr, nil
+}
+
+// Decode decodes a packet. Packets of a newer protocol version are an error
+// while packet types that are not known are returned with the Body set.
+// The samples of TypeDelta packets are decoded by Keyframes.
+// Authenticated packets are decoded without being verified, use Auth.Decode
+// to verify them. Encrypted packets can only be decoded by Auth.Decode.
+func Decode(buf []byte) (*Packet, error) {
+	hdr, err := readHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Flags&FlagEncrypted != 0 {
+		return nil, ErrEncrypted
+	}
+	return decode(buf)
+}
+
+// decode decodes a packet whose header was checked by readHeader and that is
+// not encrypted.
+func decode(buf []byte) (*Packet, error) {
+	rdr := bytes.NewReader(buf)
+	p := &Packet{}
+	// already read once
+	_ = binary.Read(rdr, binary.LittleEndian, &p.Header)
+	var err error
+	switch p.Type {
+	case TypeTelemetry:
+		if p.Telemetry, err = readSample(rdr, nil); err == nil && p.Flags&FlagRedundant != 0 {
+			p.Repeats, err = readRepeats(rdr, p.Telemetry)
+		}
+	case TypeBatch:
+		if p.Batch, err = readBatch(rdr); err == nil {
+			p.Telemetry = &p.Batch[len(p.Batch)-1]
+			if p.Flags&FlagRedundant != 0 {
+				p.Repeats, err = readRepeats(rdr, &p.Batch[0])
+			}
+		}
+	case TypeDelta:
+		if err = binary.Read(rdr, binary.LittleEndian, &p.Keyframe); err != nil {
+			err = errors.Wrap(err, "unable to read delta")
+		}
+		p.Body = buf[len(buf)-rdr.Len():]
+	case TypeTiming:
+		p.Timing, err = readTiming(rdr)
+	case TypeStatus:
+		p.Status, err = readStatus(rdr)
+	case TypeAck:
+		p.Ack, err = readAck(rdr)
+	case TypeMessage:
+		p.Message, err = readMessage(rdr)
+	case TypeMessageAck:
+		if err = binary.Read(rdr, binary.LittleEndian, &p.MessageAck); err != nil {
+			err = errors.Wrap(err, "unable to read message ack")
+		}
+	default:
+		p.Body = buf[len(buf)-rdr.Len():]
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readBatch(r *bytes.Reader) ([]juicer.Telemetry, error) {
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read batch")
+	}
+	if count == 0 {
+		return nil, errors.New("batch has no samples")
+	}
+	samples := make([]juicer.Telemetry, count)
+	var prev *juicer.Telemetry
+	for n := range samples {
+		telem, err := readSample(r, prev)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read sample %d", n)
+		}
+		samples[n] = *telem
+		prev = &samples[n]
+	}
+	return samples, nil
+}
+
+// readSample reads the body of a TypeTelemetry packet. Channels missing from
+// it keep their value from prev, or are stale if prev is nil.
+func readSample(r *bytes.Reader, prev *juicer.Telemetry) (*juicer.Telemetry, error) {
+	telem := &juicer.Telemetry{}
+	if prev != nil {
+		*telem = *prev
+	}
+	var count uint8
+	for _, v := range []interface{}{&telem.Time, &telem.Monotonic, &count} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return nil, errors.Wrap(err, "unable to read telemetry")
+		}
+	}
+	var present juicer.ChannelSet
+	for n := 0; n < int(count); n++ {
+		field := fieldHeader{}
+		if err := binary.Read(r, binary.LittleEndian, &field); err != nil {
+			return nil, errors.Wrapf(err, "unable to read field %d", n)
+		}
+		v, err := readValue(r, juicer.ChannelKind(field.Kind))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read field %d", n)
+		}
+		ch := juicer.Channel(field.Tag)
+		// sent by a newer juicer
+		if !ch.Valid() {
+			continue
+		}
+		present.Add(ch)
+		telem.Set(ch, v)
+		telem.Updated[ch] = field.Updated
+		if field.Flags&FieldStale != 0 {
+			telem.Stale.Add(ch)
+		} else {
+			telem.Stale.Remove(ch)
+		}
+	}
+	if prev != nil {
+		return telem, nil
+	}
+	for _, ch := range juicer.Channels() {
+		if !present.Has(ch) {
+			telem.Stale.Add(ch)
+		}
+	}
+	return telem, nil
+}
+
+func readValue(r io.Reader, kind juicer.ChannelKind) (float64, error) {
+	var err error
+	switch kind {
+	case juicer.KindFloat32:
+		var v float32
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return float64(v), err
+	case juicer.KindFloat64:
+		var v float64
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	case juicer.KindUint8:
+		var v uint8
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return float64(v), err
+	case juicer.KindUint16:
+		var v uint16
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return float64(v), err
+	}
+	return 0, errors.Errorf("unknown kind %d", kind)
+}
+
+func writeString(w *bytes.Buffer, s string) {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	w.WriteByte(uint8(len(s)))
+	w.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,300 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEncoder(t *testing.T) {
+	e, err := NewEncoder(7)
+	assert.NoError(t, err)
+
+	telem := juicer.Telemetry{
+		RPM:       3000,
+		FuelLevel: 40,
+		Latitude:  51.5,
+		Time:      100,
+		Monotonic: 200,
+	}
+	telem.Updated[juicer.ChannelRPM] = 100
+	telem.Stale.Add(juicer.ChannelSpeed)
+
+	for seq := uint32(1); seq <= 2; seq++ {
+		buf, err := e.Telemetry(&telem)
+		assert.NoError(t, err)
+		assert.Len(t, buf, telemetryPacketSize)
+
+		p, err := Decode(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, ProtocolVersion, p.Version)
+		assert.Equal(t, TypeTelemetry, p.Type)
+		assert.Equal(t, uint16(7), p.CarID)
+		assert.Equal(t, e.Session, p.Session)
+		assert.Equal(t, seq, p.Sequence)
+		assert.NotZero(t, p.Time)
+		assert.Equal(t, &telem, p.Telemetry)
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	hdr := Header{
+		Magic:   magic,
+		Version: ProtocolVersion,
+		Type:    TypeTelemetry,
+	}
+	fields := []interface{}{
+		&hdr, int64(1), int64(2), uint8(2),
+		// a channel added by a newer juicer is skipped
+		fieldHeader{Tag: 200, Kind: uint8(juicer.KindFloat64)}, float64(1),
+		fieldHeader{Tag: uint8(juicer.ChannelRPM), Kind: uint8(juicer.KindFloat32), Updated: 1}, float32(4000),
+	}
+	for _, f := range fields {
+		assert.NoError(t, binary.Write(buf, binary.LittleEndian, f))
+	}
+
+	p, err := Decode(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, float32(4000), p.Telemetry.RPM)
+	assert.Equal(t, int64(1), p.Telemetry.Updated[juicer.ChannelRPM])
+	// channels that were not sent are stale
+	assert.False(t, p.Telemetry.Stale.Has(juicer.ChannelRPM))
+	assert.True(t, p.Telemetry.Stale.Has(juicer.ChannelSpeed))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	e, err := NewEncoder(1)
+	assert.NoError(t, err)
+	buf, err := e.Telemetry(&juicer.Telemetry{})
+	assert.NoError(t, err)
+
+	_, err = Decode(buf[:10])
+	assert.Error(t, err)
+	_, err = Decode(buf[:len(buf)-1])
+	assert.Error(t, err)
+
+	newer := append([]byte{}, buf...)
+	newer[2] = ProtocolVersion + 1
+	_, err = Decode(newer)
+	assert.Error(t, err)
+
+	other := append([]byte{}, buf...)
+	other[0] = 'X'
+	_, err = Decode(other)
+	assert.Equal(t, ErrNotJuicer, err)
+
+	unknown := append([]byte{}, buf...)
+	unknown[3] = 99
+	p, err := Decode(unknown)
+	assert.NoError(t, err)
+	assert.Nil(t, p.Telemetry)
+	assert.Equal(t, buf[23:], p.Body)
+}
+
+func TestEncodeTiming(t *testing.T) {
+	e, err := NewEncoder(1)
+	assert.NoError(t, err)
+	buf, err := e.Timing(&juicer.Telemetry{
+		Lap:         3,
+		LastLapTime: 101.1,
+		BestLapTime: 99.9,
+
+		Sector:         2,
+		LastSectorTime: 30.5,
+	})
+	assert.NoError(t, err)
+
+	// fields appended by a newer juicer are ignored
+	buf = append(buf, 1, 2, 3)
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeTiming, p.Type)
+	assert.Equal(t, &Timing{
+		Lap:     3,
+		LastLap: 101100 * time.Millisecond,
+		BestLap: 99900 * time.Millisecond,
+
+		Sector:     2,
+		LastSector: 30500 * time.Millisecond,
+	}, p.Timing)
+}
+
+func TestEncodeStatus(t *testing.T) {
+	e, err := NewEncoder(1)
+	assert.NoError(t, err)
+	sources := []SourceStatus{
+		{
+			Name:        "gps",
+			State:       juicer.SourceConnected,
+			Reconnects:  2,
+			Messages:    100,
+			MessageRate: 10,
+			LastMessage: 5,
+		},
+		{
+			Name:      "ecu",
+			State:     juicer.SourceDisconnected,
+			LastError: "no response",
+		},
+	}
+	buf, err := e.Status(sources)
+	assert.NoError(t, err)
+
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeStatus, p.Type)
+	assert.Equal(t, sources, p.Status)
+}
+
+func TestEncodeBackfill(t *testing.T) {
+	e, err := NewEncoder(3)
+	assert.NoError(t, err)
+	telem := juicer.Telemetry{RPM: 4000, Time: 100}
+
+	buf, err := e.Telemetry(&telem)
+	assert.NoError(t, err)
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Zero(t, p.Flags)
+
+	buf, err = e.Backfill(&telem)
+	assert.NoError(t, err)
+	p, err = Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeTelemetry, p.Type)
+	assert.Equal(t, FlagBackfill, p.Flags)
+	assert.Equal(t, uint32(2), p.Sequence)
+	assert.Equal(t, &telem, p.Telemetry)
+}
+
+func TestEncodeBatch(t *testing.T) {
+	e, err := NewEncoder(3)
+	assert.NoError(t, err)
+	first := juicer.Telemetry{Time: 100, RPM: 4000, CoolantTemp: 90}
+	first.Stale.Add(juicer.ChannelOilTemp)
+	second := first
+	second.Time = 120
+	second.Latitude = 39.5401
+	second.Updated[juicer.ChannelLatitude] = 120
+	third := second
+	third.Time = 140
+	third.Stale.Remove(juicer.ChannelOilTemp)
+	samples := []juicer.Telemetry{first, second, third}
+
+	buf, err := e.Batch(samples)
+	assert.NoError(t, err)
+	// only the changed channels are sent after the first sample
+	size := headerSize + 1 + sampleSize(nil, &first) +
+		sampleSize(&first, &second) + sampleSize(&second, &third)
+	assert.Equal(t, size, len(buf))
+	assert.Equal(t, 17+11+8, sampleSize(&first, &second))
+	assert.Equal(t, 17+11+4, sampleSize(&second, &third))
+
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeBatch, p.Type)
+	assert.Equal(t, samples, p.Batch)
+	assert.Equal(t, &third, p.Telemetry)
+
+	buf, err = e.BackfillBatch(samples[:1])
+	assert.NoError(t, err)
+	p, err = Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, FlagBackfill, p.Flags)
+	assert.Equal(t, samples[:1], p.Batch)
+
+	_, err = e.Batch(nil)
+	assert.Error(t, err)
+}
+
+func TestBatch(t *testing.T) {
+	b := newBatch(3, false)
+	telem := juicer.Telemetry{Time: 1}
+	assert.True(t, b.fits(&telem))
+	assert.False(t, b.add(&telem, false))
+	// unchanged samples only have their time
+	telem.Time = 2
+	assert.Equal(t, 17, b.sampleSize(&telem))
+	assert.False(t, b.add(&telem, true))
+	telem.Time = 3
+	assert.True(t, b.add(&telem, false))
+
+	samples, keep := b.take()
+	assert.Len(t, samples, 3)
+	assert.True(t, keep)
+	samples, keep = b.take()
+	assert.Empty(t, samples)
+	assert.False(t, keep)
+
+	// samples with every channel changed fill a packet
+	b = newBatch(100, true)
+	n := 0
+	for telem := (juicer.Telemetry{}); b.fits(&telem); n++ {
+		b.add(&telem, true)
+		for _, ch := range juicer.Channels() {
+			telem.Updated[ch]++
+		}
+	}
+	e, err := NewEncoder(3)
+	assert.NoError(t, err)
+	auth, err := NewAuth(testKey, false)
+	assert.NoError(t, err)
+	e.SetAuth(auth)
+	samples, _ = b.take()
+	assert.Len(t, samples, n)
+	buf, err := e.Batch(samples)
+	assert.NoError(t, err)
+	assert.True(t, len(buf) > maxPacketSize-sampleSize(nil, &samples[0]))
+}
+
+func TestEncodeAck(t *testing.T) {
+	e, err := NewEncoder(0)
+	assert.NoError(t, err)
+	ack := Ack{Session: 1234, Sequence: 10, Received: 0x5}
+	buf, err := e.Ack(9, ack)
+	assert.NoError(t, err)
+
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeAck, p.Type)
+	assert.Equal(t, uint16(9), p.CarID)
+	assert.Equal(t, &ack, p.Ack)
+}
+
+func TestEncodeMessage(t *testing.T) {
+	e, err := NewEncoder(0)
+	assert.NoError(t, err)
+	msg := juicer.PitMessage{ID: 3, Code: juicer.PitFuel, Text: "2 laps"}
+	buf, err := e.Message(12, msg)
+	assert.NoError(t, err)
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeMessage, p.Type)
+	assert.Equal(t, uint16(12), p.CarID)
+	assert.Equal(t, &msg, p.Message)
+
+	e, err = NewEncoder(12)
+	assert.NoError(t, err)
+	buf, err = e.MessageAck(3)
+	assert.NoError(t, err)
+	p, err = Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeMessageAck, p.Type)
+	assert.Equal(t, uint32(3), p.MessageAck)
+}
+
+func TestMessageFilter(t *testing.T) {
+	f := messageFilter{}
+	assert.False(t, f.seen(1, 1))
+	assert.True(t, f.seen(1, 1))
+	// IDs are chosen by each receiver
+	assert.False(t, f.seen(2, 1))
+	for id := uint32(2); id < recentMessages+2; id++ {
+		assert.False(t, f.seen(1, id))
+	}
+	assert.False(t, f.seen(1, 1), "forgotten after newer messages")
+}
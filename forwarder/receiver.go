@@ -0,0 +1,360 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// interval between sending a message to a car again until it is
+// acknowledged
+var messageRetryInterval = time.Second
+
+// most times a message is sent before giving up
+const maxMessageAttempts = 10
+
+// CarState is what a Receiver knows about a car.
+type CarState struct {
+	CarID   uint16
+	Session uint32
+	Addr    net.Addr
+	// when the last packet from the car that was not a duplicate was
+	// received
+	LastSeen time.Time
+	// highest sequence received in the session
+	Sequence uint32
+	Packets  uint64
+	// telemetry packets that were backfilled after the link was lost, they
+	// are passed to the handler but do not replace Telemetry
+	Backfilled uint64
+	// TypeDelta packets dropped as their keyframe was not received
+	MissingKeyframes uint64
+	// telemetry packets that were lost and recovered from the repeats of a
+	// later packet, they are passed to the handler but do not replace
+	// Telemetry
+	Recovered uint64
+	// latest telemetry, lap timing and source status, nil until received.
+	// Telemetry may be a TypeBatch packet.
+	Telemetry *Packet
+	Timing    *Packet
+	Status    *Packet
+}
+
+// PacketHandler is called by a Receiver for every packet received.
+type PacketHandler func(p *Packet, from net.Addr)
+
+type pendingMessage struct {
+	carID    uint16
+	packet   []byte
+	attempts int
+}
+
+// Receiver is the pit side of the UDPForwarder. It decodes packets from any
+// number of cars, including deltas from their keyframes, and tracks when each
+// was last seen. Telemetry that was lost is recovered from the repeats of
+// later packets and duplicates are dropped, see Recovery. Telemetry is
+// acknowledged so that a car knows to backfill what was lost, and messages
+// can be sent to the driver of a car.
+type Receiver struct {
+	conn    net.PacketConn
+	encoder *Encoder
+	auth    *Auth
+
+	mu   sync.Mutex
+	cars map[uint16]*CarState
+	// telemetry received from each car in its current session
+	acks      map[uint16]*Ack
+	keyframes *Keyframes
+	recovery  *Recovery
+	// packets received from each car, only used with an Auth
+	replay map[uint16]*replayGuard
+	// messages not acknowledged yet, by ID
+	messages      map[uint32]*pendingMessage
+	lastMessageID uint32
+}
+
+// NewReceiver listens for packets on addr, such as ":5000".
+func NewReceiver(addr string) (*Receiver, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to listen on %s", addr)
+	}
+	// the receiver has no car ID, acks carry the ID of the car acknowledged
+	encoder, err := NewEncoder(0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Receiver{
+		conn:      conn,
+		encoder:   encoder,
+		cars:      map[uint16]*CarState{},
+		acks:      map[uint16]*Ack{},
+		keyframes: NewKeyframes(),
+		recovery:  NewRecovery(),
+		messages:  map[uint32]*pendingMessage{},
+		replay:    map[uint16]*replayGuard{},
+	}, nil
+}
+
+// SetAuth has the receiver drop packets that are not authenticated with the
+// key of auth or that were already received. The packets sent to the cars
+// are authenticated, and encrypted if auth encrypts. It must be called before
+// Run.
+func (r *Receiver) SetAuth(auth *Auth) {
+	r.auth = auth
+	r.encoder.SetAuth(auth)
+}
+
+func (r *Receiver) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+func (r *Receiver) Close() error {
+	return r.conn.Close()
+}
+
+// Run receives packets until ctx is done or the receiver is closed, calling
+// handler for each, after those recovered from its repeats. Packets that can
+// not be decoded or were already received are logged and dropped.
+func (r *Receiver) Run(ctx context.Context, handler PacketHandler) error {
+	go func() {
+		<-ctx.Done()
+		r.conn.Close()
+	}()
+	go r.resendMessages(ctx)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "unable to receive packet")
+		}
+		p, err := r.decode(buf[:n])
+		var ack *Ack
+		var recovered []*Packet
+		if err == nil {
+			ack, recovered, err = r.update(p, from)
+		}
+		if err != nil {
+			log.Warnf("dropping packet from %v: %v", from, err)
+			continue
+		}
+		if ack != nil {
+			r.sendAck(p.CarID, *ack, from)
+		}
+		if handler != nil {
+			for _, lost := range recovered {
+				handler(lost, from)
+			}
+			handler(p, from)
+		}
+	}
+}
+
+func (r *Receiver) decode(buf []byte) (*Packet, error) {
+	if r.auth == nil {
+		return Decode(buf)
+	}
+	p, err := r.auth.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	guard, ok := r.replay[p.CarID]
+	if !ok {
+		guard = newReplayGuard()
+		r.replay[p.CarID] = guard
+	}
+	if !guard.accept(p.Session, p.Sequence) {
+		return nil, ErrReplayed
+	}
+	return p, nil
+}
+
+// update records a packet, returning the ack to send for telemetry and the
+// packets recovered from its repeats. Deltas whose keyframe was not received
+// are counted and not acknowledged. Telemetry that was already received does
+// not update when the car was last seen.
+func (r *Receiver) update(p *Packet, from net.Addr) (*Ack, []*Packet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	car, ok := r.cars[p.CarID]
+	if !ok {
+		log.Infof("car %d connected from %v", p.CarID, from)
+		car = &CarState{CarID: p.CarID, Session: p.Session}
+		r.cars[p.CarID] = car
+	}
+	car.Packets++
+	if p.Type == TypeTelemetry || p.Type == TypeBatch || p.Type == TypeDelta {
+		return r.updateTelemetry(car, p, from)
+	}
+	car.seen(p, from)
+	switch p.Type {
+	case TypeTiming:
+		car.Timing = p
+	case TypeStatus:
+		car.Status = p
+	case TypeMessageAck:
+		if m, ok := r.messages[p.MessageAck]; ok && m.carID == p.CarID {
+			log.Infof("car %d acknowledged message %d", p.CarID, p.MessageAck)
+			delete(r.messages, p.MessageAck)
+		}
+	}
+	return nil, nil, nil
+}
+
+func (r *Receiver) updateTelemetry(car *CarState, p *Packet, from net.Addr) (*Ack, []*Packet, error) {
+	if err := r.keyframes.Update(p); err != nil {
+		if err == ErrMissingKeyframe {
+			car.MissingKeyframes++
+		}
+		return nil, nil, err
+	}
+	recovered, err := r.recovery.Update(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	car.seen(p, from)
+	for _, lost := range recovered {
+		// keeps the keyframes that were lost, there are no deltas
+		_ = r.keyframes.Update(lost)
+	}
+	car.Recovered += uint64(len(recovered))
+	if p.Flags&FlagBackfill != 0 {
+		car.Backfilled++
+	} else {
+		car.Telemetry = p
+	}
+	ack, ok := r.acks[p.CarID]
+	if !ok || ack.Session != p.Session {
+		ack = &Ack{Session: p.Session, Sequence: p.Sequence}
+		r.acks[p.CarID] = ack
+	}
+	for _, lost := range recovered {
+		ack.add(lost.Sequence)
+	}
+	ack.add(p.Sequence)
+	acked := *ack
+	return &acked, recovered, nil
+}
+
+// seen records that a packet was received from the car that was not a
+// duplicate.
+func (car *CarState) seen(p *Packet, from net.Addr) {
+	if car.Session != p.Session {
+		log.Infof("car %d started a new session", p.CarID)
+		car.Session = p.Session
+		car.Sequence = p.Sequence
+	}
+	car.Addr = from
+	car.LastSeen = time.Now()
+	// a packet that arrives out of order does not move the sequence back
+	if p.Sequence > car.Sequence {
+		car.Sequence = p.Sequence
+	}
+}
+
+// SendMessage sends a message to the driver of a car, returning its ID. It
+// is sent again until the car acknowledges it, which is seen by the
+// PacketHandler as a TypeMessageAck packet with the ID.
+func (r *Receiver) SendMessage(carID uint16, code juicer.PitCode, text string) (uint32, error) {
+	r.mu.Lock()
+	car, ok := r.cars[carID]
+	if !ok {
+		r.mu.Unlock()
+		return 0, errors.Errorf("car %d has not been seen", carID)
+	}
+	r.lastMessageID++
+	msg := juicer.PitMessage{
+		ID:   r.lastMessageID,
+		Code: code,
+		Text: text,
+	}
+	packet, err := r.encoder.Message(carID, msg)
+	if err != nil {
+		r.mu.Unlock()
+		return 0, errors.Wrap(err, "unable to encode message")
+	}
+	r.messages[msg.ID] = &pendingMessage{
+		carID:    carID,
+		packet:   packet,
+		attempts: 1,
+	}
+	addr := car.Addr
+	r.mu.Unlock()
+	if _, err := r.conn.WriteTo(packet, addr); err != nil {
+		// sent again by resendMessages
+		log.Warnf("unable to send message %d to car %d: %v", msg.ID, carID, err)
+	}
+	return msg.ID, nil
+}
+
+// resendMessages sends the messages that were not acknowledged again, to the
+// address each car was last seen at, until ctx is done.
+func (r *Receiver) resendMessages(ctx context.Context) {
+	ticker := time.NewTicker(messageRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		for id, m := range r.messages {
+			if m.attempts >= maxMessageAttempts {
+				log.Warnf("car %d did not acknowledge message %d", m.carID, id)
+				delete(r.messages, id)
+				continue
+			}
+			m.attempts++
+			if _, err := r.conn.WriteTo(m.packet, r.cars[m.carID].Addr); err != nil {
+				log.Warnf("unable to send message %d to car %d: %v", id, m.carID, err)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Receiver) sendAck(carID uint16, ack Ack, to net.Addr) {
+	packet, err := r.encoder.Ack(carID, ack)
+	if err == nil {
+		_, err = r.conn.WriteTo(packet, to)
+	}
+	if err != nil {
+		log.Warnf("unable to acknowledge car %d at %v: %v", carID, to, err)
+	}
+}
+
+// Cars returns the state of every car seen, ordered by car ID.
+func (r *Receiver) Cars() []CarState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cars := make([]CarState, 0, len(r.cars))
+	for _, car := range r.cars {
+		cars = append(cars, *car)
+	}
+	sort.Slice(cars, func(i, j int) bool {
+		return cars[i].CarID < cars[j].CarID
+	})
+	return cars
+}
+
+// Car returns the state of a single car.
+func (r *Receiver) Car(carID uint16) (CarState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if car, ok := r.cars[carID]; ok {
+		return *car, true
+	}
+	return CarState{}, false
+}
@@ -0,0 +1,479 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReceiver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := NewReceiver("127.0.0.1:0")
+	assert.NoError(t, err)
+	packets := make(chan *Packet, 1)
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx, func(p *Packet, from net.Addr) {
+			packets <- p
+		})
+	}()
+
+	udp, err := newUDPForwarder(UDPConfig{
+		Server:     "127.0.0.1",
+		Port:       r.Addr().(*net.UDPAddr).Port,
+		CarID:      42,
+		AckTimeout: juicer.Duration{Duration: time.Second},
+	})
+	assert.NoError(t, err)
+	defer udp.Close()
+
+	telem := juicer.Telemetry{RPM: 5000}
+	assert.NoError(t, udp.Forward(&telem, &juicer.Telemetry{}))
+
+	p := <-packets
+	assert.Equal(t, TypeTelemetry, p.Type)
+	assert.Equal(t, uint16(42), p.CarID)
+	assert.Equal(t, float32(5000), p.Telemetry.RPM)
+
+	car, ok := r.Car(42)
+	assert.True(t, ok)
+	assert.Equal(t, udp.destinations[0].encoder.Session, car.Session)
+	assert.Equal(t, uint64(1), car.Packets)
+	assert.False(t, car.LastSeen.IsZero())
+	assert.Equal(t, p, car.Telemetry)
+	assert.Len(t, r.Cars(), 1)
+
+	// packets that are not from a juicer are dropped
+	conn, err := net.Dial("udp", r.Addr().String())
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	conn.Close()
+	assert.NoError(t, udp.Forward(&telem, &telem))
+	p = <-packets
+	assert.Equal(t, uint32(2), p.Sequence)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestReceiverBackfill(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := NewReceiver("127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := r.Addr().String()
+	packets := make(chan *Packet, 100)
+	run := func(r *Receiver) {
+		go func() {
+			_ = r.Run(ctx, func(p *Packet, from net.Addr) {
+				if p.Type == TypeTelemetry {
+					packets <- p
+				}
+			})
+		}()
+	}
+	run(r)
+
+	udp, err := newUDPForwarder(UDPConfig{
+		Server:       "127.0.0.1",
+		Port:         r.Addr().(*net.UDPAddr).Port,
+		CarID:        5,
+		MinSendDelay: juicer.Duration{Duration: 50 * time.Millisecond},
+		Backlog:      10,
+		AckTimeout:   juicer.Duration{Duration: 200 * time.Millisecond},
+		BackfillRate: 100,
+	})
+	assert.NoError(t, err)
+	defer udp.Close()
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 1000}, &juicer.Telemetry{}))
+	p := <-packets
+	assert.Zero(t, p.Flags&FlagBackfill)
+	for deadline := time.Now().Add(time.Second); !udp.destinations[0].link.up(time.Now()); {
+		if time.Now().After(deadline) {
+			t.Fatal("telemetry was not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the link is lost while telemetry is sent, which may fail once the
+	// port is unreachable
+	assert.NoError(t, r.Close())
+	for rpm := float32(2000); rpm <= 3000; rpm += 1000 {
+		_ = udp.Forward(&juicer.Telemetry{RPM: rpm}, &juicer.Telemetry{})
+	}
+	time.Sleep(300 * time.Millisecond)
+	for len(packets) > 0 {
+		<-packets
+	}
+
+	// and returns, the telemetry that was lost is backfilled
+	r, err = NewReceiver(addr)
+	assert.NoError(t, err)
+	defer r.Close()
+	run(r)
+	var backfilled []float32
+	timeout := time.After(2 * time.Second)
+	for len(backfilled) < 2 {
+		select {
+		case p := <-packets:
+			if p.Flags&FlagBackfill != 0 {
+				backfilled = append(backfilled, p.Telemetry.RPM)
+			}
+		case <-timeout:
+			t.Fatalf("backfilled %v", backfilled)
+		}
+	}
+	assert.Equal(t, []float32{2000, 3000}, backfilled)
+	for deadline := time.Now().Add(time.Second); ; {
+		if pending, _ := udp.destinations[0].backlog.stats(); pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backfill was not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	car, ok := r.Car(5)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), car.Backfilled)
+	assert.Equal(t, float32(3000), car.Telemetry.Telemetry.RPM)
+}
+
+func TestReceiverMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := NewReceiver("127.0.0.1:0")
+	assert.NoError(t, err)
+	acks := make(chan uint32, 1)
+	go func() {
+		_ = r.Run(ctx, func(p *Packet, from net.Addr) {
+			if p.Type == TypeMessageAck {
+				acks <- p.MessageAck
+			}
+		})
+	}()
+	_, err = r.SendMessage(8, juicer.PitBox, "")
+	assert.Error(t, err, "car not seen yet")
+
+	config := defaultUDPConfig()
+	config.Server = "127.0.0.1"
+	config.Port = r.Addr().(*net.UDPAddr).Port
+	config.CarID = 8
+	udp, err := newUDPForwarder(config)
+	assert.NoError(t, err)
+	defer udp.Close()
+	messages := make(chan juicer.PitMessage, 1)
+	udp.ReceivePitMessages(func(msg juicer.PitMessage) {
+		messages <- msg
+	})
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{}, &juicer.Telemetry{}))
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, ok := r.Car(8); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("car was not seen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	id, err := r.SendMessage(8, juicer.PitBox, "this lap")
+	assert.NoError(t, err)
+	assert.Equal(t, juicer.PitMessage{ID: id, Code: juicer.PitBox, Text: "this lap"}, <-messages)
+	assert.Equal(t, id, <-acks)
+	r.mu.Lock()
+	assert.Empty(t, r.messages)
+	r.mu.Unlock()
+}
+
+func TestReceiverAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := NewReceiver("127.0.0.1:0")
+	assert.NoError(t, err)
+	auth, err := NewAuth(testKey, false)
+	assert.NoError(t, err)
+	r.SetAuth(auth)
+	packets := make(chan *Packet, 10)
+	go func() {
+		_ = r.Run(ctx, func(p *Packet, from net.Addr) {
+			packets <- p
+		})
+	}()
+
+	config := defaultUDPConfig()
+	config.Server = "127.0.0.1"
+	config.Port = r.Addr().(*net.UDPAddr).Port
+	config.Key = hex.EncodeToString(testKey)
+	config.Encrypt = true
+	udp, err := newUDPForwarder(config)
+	assert.NoError(t, err)
+	defer udp.Close()
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 1000}, &juicer.Telemetry{}))
+	p := <-packets
+	assert.Equal(t, FlagAuth|FlagEncrypted, p.Flags)
+	assert.Equal(t, float32(1000), p.Telemetry.RPM)
+	// the receiver's ack is authenticated too
+	for deadline := time.Now().Add(time.Second); udp.LinkStats().Acked == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("telemetry was not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// packets without the key and replayed packets are dropped
+	conn, err := net.Dial("udp", r.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	e, err := NewEncoder(0)
+	assert.NoError(t, err)
+	buf, err := e.Telemetry(&juicer.Telemetry{RPM: 2000})
+	assert.NoError(t, err)
+	_, err = conn.Write(buf)
+	assert.NoError(t, err)
+	e.SetAuth(auth)
+	buf, err = e.Telemetry(&juicer.Telemetry{RPM: 3000})
+	assert.NoError(t, err)
+	for n := 0; n < 2; n++ {
+		_, err = conn.Write(buf)
+		assert.NoError(t, err)
+	}
+	e.sequence--
+	buf, err = e.Telemetry(&juicer.Telemetry{RPM: 4000})
+	assert.NoError(t, err)
+	_, err = conn.Write(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 5000}, &juicer.Telemetry{}))
+
+	var rpms []float32
+	for len(rpms) < 2 {
+		rpms = append(rpms, (<-packets).Telemetry.RPM)
+	}
+	assert.Contains(t, rpms, float32(3000))
+	assert.Contains(t, rpms, float32(5000))
+	select {
+	case p := <-packets:
+		t.Fatalf("unexpected packet %+v", p.Telemetry)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReceiverBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, batches := startReceiver(ctx, t)
+	config := defaultUDPConfig()
+	config.Server = "127.0.0.1"
+	config.Port = receiverPort(r)
+	config.SendRateLimit = juicer.Duration{}
+	config.BatchSize = 3
+	config.BatchInterval = juicer.Duration{Duration: 50 * time.Millisecond}
+	udp, err := newUDPForwarder(config)
+	assert.NoError(t, err)
+	defer udp.Close()
+
+	// batches are sent once full, or by Flush
+	for rpm := float32(1000); rpm <= 5000; rpm += 1000 {
+		assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: rpm}, &juicer.Telemetry{}))
+	}
+	p := <-batches
+	assert.Equal(t, TypeBatch, p.Type)
+	assert.Len(t, p.Batch, 3)
+	assert.Equal(t, float32(3000), p.Telemetry.RPM)
+	n, err := udp.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	p = <-batches
+	assert.Len(t, p.Batch, 2)
+	assert.Equal(t, float32(4000), p.Batch[0].RPM)
+	car, ok := r.Car(0)
+	assert.True(t, ok)
+	assert.Equal(t, p, car.Telemetry)
+
+	// and every BatchInterval
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 6000}, &juicer.Telemetry{}))
+	select {
+	case p = <-batches:
+		assert.Len(t, p.Batch, 1)
+		assert.Equal(t, float32(6000), p.Telemetry.RPM)
+	case <-time.After(time.Second):
+		t.Fatal("batch was not sent")
+	}
+	for deadline := time.Now().Add(time.Second); udp.LinkStats().Acked < 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("batches were not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReceiverDelta(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, packets := startReceiver(ctx, t)
+	config := defaultUDPConfig()
+	config.Server = "127.0.0.1"
+	config.Port = receiverPort(r)
+	config.SendRateLimit = juicer.Duration{}
+	config.KeyframeInterval = juicer.Duration{Duration: time.Hour}
+	config.AckTimeout = juicer.Duration{Duration: 300 * time.Millisecond}
+	udp, err := newUDPForwarder(config)
+	assert.NoError(t, err)
+	defer udp.Close()
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+
+	// a keyframe is sent until one is acknowledged
+	telem := juicer.Telemetry{RPM: 1000, OilTemp: 90}
+	assert.NoError(t, udp.Forward(&telem, &juicer.Telemetry{}))
+	p := <-packets
+	assert.Equal(t, TypeTelemetry, p.Type)
+	assert.Equal(t, FlagKeyframe, p.Flags)
+	keyframes := udp.destinations[0].keyframes
+	for deadline := time.Now().Add(time.Second); keyframes.reference(time.Now(), true) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("keyframe was not acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	telem.RPM = 2000
+	assert.NoError(t, udp.Forward(&telem, &juicer.Telemetry{}))
+	p = <-packets
+	assert.Equal(t, TypeDelta, p.Type)
+	assert.Equal(t, &telem, p.Telemetry)
+	car, ok := r.Car(0)
+	assert.True(t, ok)
+	assert.Equal(t, p, car.Telemetry)
+
+	// a receiver that was restarted drops the deltas until it receives a
+	// keyframe, once the link is lost
+	assert.NoError(t, r.Close())
+	restarted, err := NewReceiver(r.Addr().String())
+	assert.NoError(t, err)
+	defer restarted.Close()
+	packets = make(chan *Packet, 10)
+	go func() {
+		_ = restarted.Run(ctx, func(p *Packet, from net.Addr) {
+			if p.Type == TypeTelemetry || p.Type == TypeDelta {
+				packets <- p
+			}
+		})
+	}()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if time.Now().After(deadline) {
+			t.Fatal("no keyframe was sent")
+		}
+		telem.RPM++
+		_ = udp.Forward(&telem, &juicer.Telemetry{})
+		select {
+		case p = <-packets:
+		case <-time.After(50 * time.Millisecond):
+			continue
+		}
+		// deltas that were dropped may be backfilled first
+		if p.Flags&FlagKeyframe != 0 {
+			break
+		}
+	}
+	car, ok = restarted.Car(0)
+	assert.True(t, ok)
+	assert.NotZero(t, car.MissingKeyframes)
+}
+
+func TestReceiverRedundancy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, packets := startReceiver(ctx, t)
+	conn, err := net.Dial("udp", r.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	e, err := NewEncoder(9)
+	assert.NoError(t, err)
+	repeats := newRepeater(2)
+	encode := func(rpm float32) []byte {
+		telem := juicer.Telemetry{RPM: rpm}
+		packet, err := e.Telemetry(&telem, repeats.repeats()...)
+		assert.NoError(t, err)
+		hdr, err := readHeader(packet)
+		assert.NoError(t, err)
+		repeats.sent(Repeat{Sequence: hdr.Sequence, Samples: []juicer.Telemetry{telem}})
+		return packet
+	}
+	write := func(packet []byte) {
+		_, err := conn.Write(packet)
+		assert.NoError(t, err)
+	}
+
+	// a burst of two lost packets is recovered from the next, oldest first
+	write(encode(1000))
+	lost := encode(2000)
+	encode(3000)
+	write(encode(4000))
+	for _, rpm := range []float32{1000, 2000, 3000, 4000} {
+		p := <-packets
+		assert.Equal(t, rpm, p.Telemetry.RPM)
+		assert.Equal(t, rpm == 2000 || rpm == 3000, p.Recovered)
+	}
+	// and acknowledged
+	buf := make([]byte, maxPacketSize)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	for {
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		p, err := Decode(buf[:n])
+		assert.NoError(t, err)
+		if p.Ack.Sequence == 4 {
+			assert.True(t, p.Ack.Has(2))
+			assert.True(t, p.Ack.Has(3))
+			break
+		}
+	}
+
+	// a lost packet that arrives late is dropped
+	write(lost)
+	write(encode(5000))
+	assert.Equal(t, float32(5000), (<-packets).Telemetry.RPM)
+	car, ok := r.Car(9)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), car.Recovered)
+	assert.Equal(t, float32(5000), car.Telemetry.Telemetry.RPM)
+	assert.Equal(t, uint32(5), car.Sequence)
+
+	// nor does it keep the car alive or move its sequence back
+	dup, err := Decode(lost)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, _, err = r.update(dup, conn.LocalAddr())
+	assert.Equal(t, ErrDuplicate, err)
+	seen, _ := r.Car(9)
+	assert.Equal(t, car.LastSeen, seen.LastSeen)
+	assert.Equal(t, uint32(5), seen.Sequence)
+}
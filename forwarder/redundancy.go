@@ -0,0 +1,203 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+)
+
+// ErrDuplicate is returned by Recovery for a telemetry packet that was
+// already received, or recovered from the repeats of a later packet.
+var ErrDuplicate = errors.New("telemetry was already received")
+
+// most packets a UDPForwarder repeats, older ones are outside the window of
+// sequences that Recovery deduplicates
+const maxRedundancy = 64
+
+// Repeat is a copy of an earlier packet of live telemetry, carried by a
+// packet with FlagRedundant so that it can be recovered if it was lost.
+type Repeat struct {
+	// sequence of the packet repeated
+	Sequence uint32
+	// FlagKeyframe if the packet repeated was a keyframe
+	Flags uint8
+	// oldest first
+	Samples []juicer.Telemetry
+}
+
+// writeRepeats writes the repeats of a packet with FlagRedundant following
+// its body, as many as fit in the packet. first is the oldest sample of the
+// body.
+func (e *Encoder) writeRepeats(buf *bytes.Buffer, first *juicer.Telemetry, repeats []Repeat) error {
+	if len(repeats) == 0 {
+		return nil
+	}
+	limit := maxPacketSize
+	if e.auth != nil {
+		limit -= authTagSize
+	}
+	start := buf.Len()
+	buf.WriteByte(0)
+	count := 0
+	prev := first
+	for _, rep := range repeats {
+		if count == math.MaxUint8 {
+			break
+		}
+		n := buf.Len()
+		next, err := writeRepeat(buf, prev, &rep)
+		if err != nil {
+			return errors.Wrapf(err, "unable to write repeat of %d", rep.Sequence)
+		}
+		if buf.Len() > limit {
+			buf.Truncate(n)
+			break
+		}
+		prev = next
+		count++
+	}
+	buf.Bytes()[start] = uint8(count)
+	return nil
+}
+
+// writeRepeat writes the samples of rep newest first, returning the oldest
+// which the next repeat is written from.
+func writeRepeat(buf *bytes.Buffer, prev *juicer.Telemetry, rep *Repeat) (*juicer.Telemetry, error) {
+	if len(rep.Samples) == 0 || len(rep.Samples) > math.MaxUint8 {
+		return nil, errors.Errorf("unable to repeat %d samples", len(rep.Samples))
+	}
+	body := []interface{}{rep.Sequence, rep.Flags & FlagKeyframe, uint8(len(rep.Samples))}
+	for _, v := range body {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	for n := len(rep.Samples) - 1; n >= 0; n-- {
+		if err := writeSample(buf, prev, &rep.Samples[n]); err != nil {
+			return nil, errors.Wrapf(err, "unable to write sample %d", n)
+		}
+		prev = &rep.Samples[n]
+	}
+	return prev, nil
+}
+
+func readRepeats(r *bytes.Reader, first *juicer.Telemetry) ([]Repeat, error) {
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read repeats")
+	}
+	repeats := make([]Repeat, count)
+	prev := first
+	for n := range repeats {
+		rep := &repeats[n]
+		var samples uint8
+		for _, v := range []interface{}{&rep.Sequence, &rep.Flags, &samples} {
+			if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+				return nil, errors.Wrapf(err, "unable to read repeat %d", n)
+			}
+		}
+		if samples == 0 {
+			return nil, errors.Errorf("repeat %d has no samples", n)
+		}
+		rep.Samples = make([]juicer.Telemetry, samples)
+		for i := len(rep.Samples) - 1; i >= 0; i-- {
+			telem, err := readSample(r, prev)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to read sample %d of repeat %d", i, n)
+			}
+			rep.Samples[i] = *telem
+			prev = &rep.Samples[i]
+		}
+	}
+	return repeats, nil
+}
+
+// packet returns the packet recovered from a repeat, with the header of the
+// packet that carried it but its own sequence.
+func (rep *Repeat) packet(carrier *Packet) *Packet {
+	p := &Packet{
+		Header:    carrier.Header,
+		Telemetry: &rep.Samples[len(rep.Samples)-1],
+		Recovered: true,
+	}
+	p.Sequence = rep.Sequence
+	p.Flags = carrier.Flags&(FlagAuth|FlagEncrypted) | rep.Flags&FlagKeyframe
+	p.Type = TypeTelemetry
+	if len(rep.Samples) > 1 {
+		p.Type = TypeBatch
+		p.Batch = rep.Samples
+	}
+	return p
+}
+
+// Recovery deduplicates the telemetry packets of each car by their sequence
+// and recovers the packets that were lost from the repeats of later packets
+// with FlagRedundant. It is not safe for concurrent use.
+type Recovery struct {
+	cars map[uint16]*replayGuard
+}
+
+func NewRecovery() *Recovery {
+	return &Recovery{
+		cars: map[uint16]*replayGuard{},
+	}
+}
+
+// Update records that a telemetry packet was received, returning
+// ErrDuplicate if it was already received or recovered. Otherwise it
+// returns the packets recovered from its repeats that were not received,
+// oldest first and with Recovered set. The repeats of a TypeDelta packet are
+// only decoded once it is updated by Keyframes.
+func (r *Recovery) Update(p *Packet) ([]*Packet, error) {
+	guard, ok := r.cars[p.CarID]
+	if !ok {
+		guard = newReplayGuard()
+		r.cars[p.CarID] = guard
+	}
+	if !guard.accept(p.Session, p.Sequence) {
+		return nil, ErrDuplicate
+	}
+	var recovered []*Packet
+	for n := len(p.Repeats) - 1; n >= 0; n-- {
+		if guard.accept(p.Session, p.Repeats[n].Sequence) {
+			recovered = append(recovered, p.Repeats[n].packet(p))
+		}
+	}
+	return recovered, nil
+}
+
+// repeater keeps the latest packets of live telemetry sent to a destination
+// to repeat in the packets that follow.
+type repeater struct {
+	size int
+
+	mu sync.Mutex
+	// newest first, replaced rather than modified so it can be shared
+	packets []Repeat
+}
+
+func newRepeater(size int) *repeater {
+	return &repeater{
+		size: size,
+	}
+}
+
+// repeats returns the packets to repeat, newest first.
+func (r *repeater) repeats() []Repeat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.packets
+}
+
+func (r *repeater) sent(rep Repeat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keep := r.packets
+	if len(keep) == r.size {
+		keep = keep[:r.size-1]
+	}
+	r.packets = append([]Repeat{rep}, keep...)
+}
@@ -0,0 +1,89 @@
+package forwarder
+
+import (
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRecovery(t *testing.T) {
+	e, err := NewEncoder(3)
+	assert.NoError(t, err)
+	samples := make([]juicer.Telemetry, 4)
+	for n := range samples {
+		samples[n] = juicer.Telemetry{
+			Time:     int64(n + 1),
+			RPM:      float32(1000 + 100*n),
+			OilTemp:  90,
+			Latitude: 39.54,
+		}
+	}
+	samples[2].OilTemp = 91
+	repeats := newRepeater(2)
+	packets := make([]*Packet, len(samples))
+	for n := range samples {
+		var buf []byte
+		if n == len(samples)-1 {
+			buf, err = e.Batch(samples[n:], repeats.repeats()...)
+		} else {
+			buf, err = e.Telemetry(&samples[n], repeats.repeats()...)
+		}
+		assert.NoError(t, err)
+		packets[n], err = Decode(buf)
+		assert.NoError(t, err)
+		repeats.sent(Repeat{Sequence: packets[n].Sequence, Samples: samples[n : n+1]})
+	}
+	assert.Zero(t, packets[0].Flags&FlagRedundant)
+	assert.Equal(t, FlagRedundant, packets[2].Flags)
+	assert.Len(t, packets[2].Repeats, 2)
+	assert.Equal(t, packets[1].Sequence, packets[2].Repeats[0].Sequence)
+	assert.Equal(t, samples[1:2], packets[2].Repeats[0].Samples)
+	assert.Equal(t, samples[0:1], packets[2].Repeats[1].Samples)
+	assert.Len(t, packets[3].Repeats, 2)
+
+	// the second packet is lost and recovered from the third
+	recovery := NewRecovery()
+	recovered, err := recovery.Update(packets[0])
+	assert.NoError(t, err)
+	assert.Empty(t, recovered)
+	recovered, err = recovery.Update(packets[2])
+	assert.NoError(t, err)
+	assert.Len(t, recovered, 1)
+	assert.True(t, recovered[0].Recovered)
+	assert.Equal(t, TypeTelemetry, recovered[0].Type)
+	assert.Equal(t, packets[1].Sequence, recovered[0].Sequence)
+	assert.Equal(t, &samples[1], recovered[0].Telemetry)
+	// and dropped if it arrives late
+	_, err = recovery.Update(packets[1])
+	assert.Equal(t, ErrDuplicate, err)
+	_, err = recovery.Update(packets[2])
+	assert.Equal(t, ErrDuplicate, err)
+	recovered, err = recovery.Update(packets[3])
+	assert.NoError(t, err)
+	assert.Empty(t, recovered)
+
+	// only the repeats that fit are sent
+	large := Repeat{Sequence: 1, Samples: make([]juicer.Telemetry, 255)}
+	buf, err := e.Telemetry(&samples[0], Repeat{Sequence: 2, Samples: samples[:1]}, large)
+	assert.NoError(t, err)
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Len(t, p.Repeats, 1)
+
+	// the repeats of a delta are decoded with it
+	key := &Keyframe{Sequence: packets[0].Sequence, Telemetry: samples[0]}
+	buf, err = e.Delta(key, samples[3:], repeats.repeats()...)
+	assert.NoError(t, err)
+	p, err = Decode(buf)
+	assert.NoError(t, err)
+	assert.Nil(t, p.Repeats)
+	keyframes := NewKeyframes()
+	assert.NoError(t, keyframes.Update(&Packet{
+		Header:    Header{CarID: 3, Session: e.Session, Sequence: key.Sequence, Flags: FlagKeyframe},
+		Telemetry: &samples[0],
+	}))
+	assert.NoError(t, keyframes.Update(p))
+	assert.Len(t, p.Repeats, 2)
+	assert.Equal(t, samples[3:], p.Repeats[0].Samples)
+	assert.Equal(t, samples[2:3], p.Repeats[1].Samples)
+}
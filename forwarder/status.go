@@ -0,0 +1,86 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+)
+
+// SourceStatus is the status of a single source sent in a TypeStatus packet.
+type SourceStatus struct {
+	Name        string
+	State       juicer.SourceState
+	Reconnects  uint32
+	Messages    uint64
+	MessageRate float32
+	// unix nanoseconds, zero if no message has been received
+	LastMessage int64
+	LastError   string
+}
+
+func newSourceStatus(source juicer.SourceHealth) SourceStatus {
+	status := SourceStatus{
+		Name:        source.Name,
+		State:       source.State,
+		Reconnects:  uint32(source.Reconnects),
+		Messages:    source.Messages,
+		MessageRate: float32(source.MessageRate),
+		LastError:   source.LastError,
+	}
+	if !source.LastMessage.IsZero() {
+		status.LastMessage = source.LastMessage.UnixNano()
+	}
+	return status
+}
+
+type sourceCounters struct {
+	State       uint8
+	Reconnects  uint32
+	Messages    uint64
+	MessageRate float32
+	LastMessage int64
+}
+
+func (s *SourceStatus) write(buf *bytes.Buffer) error {
+	writeString(buf, s.Name)
+	counters := sourceCounters{
+		State:       uint8(s.State),
+		Reconnects:  s.Reconnects,
+		Messages:    s.Messages,
+		MessageRate: s.MessageRate,
+		LastMessage: s.LastMessage,
+	}
+	if err := binary.Write(buf, binary.LittleEndian, &counters); err != nil {
+		return err
+	}
+	writeString(buf, s.LastError)
+	return nil
+}
+
+func readStatus(r *bytes.Reader) ([]SourceStatus, error) {
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read source count")
+	}
+	sources := make([]SourceStatus, count)
+	for n := range sources {
+		s := &sources[n]
+		counters := sourceCounters{}
+		if s.Name, err = readString(r); err != nil {
+			return nil, errors.Wrapf(err, "unable to read source %d", n)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &counters); err != nil {
+			return nil, errors.Wrapf(err, "unable to read source %d", n)
+		}
+		if s.LastError, err = readString(r); err != nil {
+			return nil, errors.Wrapf(err, "unable to read source %d", n)
+		}
+		s.State = juicer.SourceState(counters.State)
+		s.Reconnects = counters.Reconnects
+		s.Messages = counters.Messages
+		s.MessageRate = counters.MessageRate
+		s.LastMessage = counters.LastMessage
+	}
+	return sources, nil
+}
@@ -0,0 +1,46 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	port, pc, dataChan := startServer(ctx)
+	defer pc.Close()
+
+	oldStatusInterval := statusInterval
+	defer func() {
+		statusInterval = oldStatusInterval
+	}()
+	statusInterval = 10 * time.Millisecond
+
+	udp, err := NewUDPForwarderFromReader(bytes.NewBufferString(config(port)))
+	assert.NoError(t, err)
+
+	jc := juicer.NewJuicer()
+	jc.AddForwarder(udp)
+	go func() {
+		_ = udp.Start(ctx)
+	}()
+
+	recvData := <-dataChan
+	p, err := Decode(recvData.data[:recvData.len])
+	assert.NoError(t, err)
+	assert.Equal(t, TypeStatus, p.Type)
+	sources := p.Status
+	// the forwarder's link source is added with it
+	assert.Len(t, sources, 4)
+	assert.Equal(t, "canbus", sources[0].Name)
+	assert.Equal(t, juicer.LinkSourceName, sources[3].Name)
+	assert.Equal(t, juicer.SourceStopped, sources[0].State)
+	assert.Equal(t, "", sources[0].LastError)
+	assert.NoError(t, udp.Close())
+}
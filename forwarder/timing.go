@@ -0,0 +1,80 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Timing is the lap timing sent in a TypeTiming packet.
+type Timing struct {
+	// laps started, zero before the start/finish line is first crossed
+	Lap     uint16
+	LastLap time.Duration
+	BestLap time.Duration
+	// current sector, starting at 1
+	Sector     uint8
+	LastSector time.Duration
+}
+
+type timingBody struct {
+	Lap        uint16
+	LastLap    uint32
+	BestLap    uint32
+	Sector     uint8
+	LastSector uint32
+}
+
+func newTiming(telem *juicer.Telemetry) Timing {
+	return Timing{
+		Lap:     telem.Lap,
+		LastLap: seconds(telem.LastLapTime),
+		BestLap: seconds(telem.BestLapTime),
+
+		Sector:     telem.Sector,
+		LastSector: seconds(telem.LastSectorTime),
+	}
+}
+
+// timingChanged reports whether the lap channels differ between a and b.
+func timingChanged(a, b *juicer.Telemetry) bool {
+	return a.Lap != b.Lap ||
+		a.LastLapTime != b.LastLapTime ||
+		a.BestLapTime != b.BestLapTime ||
+		a.Sector != b.Sector ||
+		a.LastSectorTime != b.LastSectorTime
+}
+
+func seconds(s float32) time.Duration {
+	return (time.Duration(float64(s)*float64(time.Second)) + time.Millisecond/2).
+		Truncate(time.Millisecond)
+}
+
+func (t *Timing) write(buf *bytes.Buffer) error {
+	body := timingBody{
+		Lap:     t.Lap,
+		LastLap: uint32(t.LastLap / time.Millisecond),
+		BestLap: uint32(t.BestLap / time.Millisecond),
+
+		Sector:     t.Sector,
+		LastSector: uint32(t.LastSector / time.Millisecond),
+	}
+	return binary.Write(buf, binary.LittleEndian, &body)
+}
+
+func readTiming(r *bytes.Reader) (*Timing, error) {
+	body := timingBody{}
+	if err := binary.Read(r, binary.LittleEndian, &body); err != nil {
+		return nil, errors.Wrap(err, "unable to read timing")
+	}
+	return &Timing{
+		Lap:     body.Lap,
+		LastLap: time.Duration(body.LastLap) * time.Millisecond,
+		BestLap: time.Duration(body.BestLap) * time.Millisecond,
+
+		Sector:     body.Sector,
+		LastSector: time.Duration(body.LastSector) * time.Millisecond,
+	}, nil
+}
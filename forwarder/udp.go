@@ -1,49 +1,123 @@
 package forwarder
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
-	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/jd3nn1s/juicer"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
-	"net"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
-	"unsafe"
 )
 
-type Header struct {
-	Type uint8
-}
-
-var maxTelemetrySize = int(unsafe.Sizeof(Header{}) + unsafe.Sizeof(juicer.Telemetry{}))
-
 var minSendDelay = time.Second
 var sendRateLimit = 100 * time.Millisecond
+var statusInterval = 5 * time.Second
+var ackTimeout = 3 * time.Second
+var linkLogInterval = 30 * time.Second
+var batchInterval = 250 * time.Millisecond
+
+const (
+	// telemetry kept for backfill, 30 minutes at the default send rate
+	defaultBacklog = 18000
+	// telemetry packets backfilled per second
+	defaultBackfillRate = 20
+)
 
+// Modes of sending to the destinations of a UDPForwarder.
 const (
-	TypeTelemetry uint8 = 1
-	TypeTiming    uint8 = 2
+	// send to every destination, such as a pit laptop on the local Wi-Fi and
+	// a cloud relay
+	ModeBroadcast = "broadcast"
+	// send to the first destination whose link is up, and to those before it
+	// so that their acks show when they return. Send to all of them while no
+	// link is up.
+	ModeFailover = "failover"
 )
 
 type UDPConfig struct {
+	// the destination when Destinations is empty
 	Server string
 	Port   int
+	// receivers to send to in the order of preference, see Mode
+	Destinations []UDPDestination `toml:"destination"`
+	// ModeBroadcast if empty
+	Mode string
+	// identifies the car to the receiver
+	CarID uint16
+
+	// minimum interval between telemetry packets, or samples when batching
+	SendRateLimit juicer.Duration
+	// maximum interval between packets, telemetry is re-sent if unchanged.
+	// Zero disables re-sending.
+	MinSendDelay juicer.Duration
+	// most samples of telemetry sent in a TypeBatch packet, fewer are sent
+	// if they do not fit in a packet. Zero or one disables batching.
+	BatchSize int
+	// maximum time a sample waits for its batch to be sent
+	BatchInterval juicer.Duration
+	// interval between keyframes with every channel, the telemetry sent
+	// between them only has the channels that changed since the keyframe,
+	// some with reduced precision. Zero sends every channel in every packet.
+	KeyframeInterval juicer.Duration
+	// earlier packets of telemetry repeated in each packet, so that the
+	// receiver recovers short bursts of loss without them being backfilled.
+	// Only as many as fit in a packet are repeated, each is a sample unless
+	// batching. Zero disables repeating.
+	Redundancy int
+	// interval between source status packets, zero disables them
+	StatusInterval juicer.Duration
+
+	// telemetry packets kept until the receiver acknowledges them, zero
+	// disables backfill
+	Backlog int
+	// the link is lost when no ack is received for this long, telemetry not
+	// acknowledged within it is backfilled
+	AckTimeout juicer.Duration
+	// telemetry packets backfilled per second once the link returns
+	BackfillRate int
+	// interval between logging the link stats, zero disables it
+	LinkLogInterval juicer.Duration
+
+	// shared key of KeySize bytes written as hex, such as from
+	// openssl rand -hex 32. Packets are authenticated with it when it is set
+	// and packets from the receiver must be.
+	Key string
+	// encrypt packets as well as authenticating them
+	Encrypt bool
 }
 
+// UDPForwarder sends telemetry to one or more Receivers, each at its own
+// rate. With a BatchSize several samples are sent in each packet, so that
+// they can be sent at a higher rate without the overhead of a packet each.
+// With a KeyframeInterval only the channels that changed since a keyframe
+// the receiver acknowledged are sent, see Keyframes. With Redundancy each
+// packet repeats the packets before it, see Recovery.
+// Unless Backlog is zero the telemetry is kept until the receiver
+// acknowledges it. When no ack is received within AckTimeout the link is
+// lost, and once it returns the telemetry that was not acknowledged is
+// backfilled, at BackfillRate so that live telemetry keeps priority.
+//
+// The acks are also used to measure the packet loss, round trip time and
+// jitter of the link, which are updated in the link quality channels by the
+// forwarder's Source. Messages sent by the receiver for the driver are
+// acknowledged and passed to the handler given to ReceivePitMessages.
 type UDPForwarder struct {
 	Config *UDPConfig
 
-	conn    net.Conn
-	fwdChan chan *juicer.Telemetry
-	wg      sync.WaitGroup
+	destinations []*destination
+	health       *juicer.Health
+	linkSource   *LinkSource
+	pitHandler   func(juicer.PitMessage)
+
+	// protects last which is re-sent to show the car is alive
+	mu   sync.Mutex
+	last *juicer.Telemetry
 }
 
 func NewUDPForwarder(fileName string) (*UDPForwarder, error) {
@@ -63,97 +137,349 @@ func NewUDPForwarderFromReader(configReader io.Reader) (*UDPForwarder, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to read config reader")
 	}
-	config := UDPConfig{}
+	config := defaultUDPConfig()
 	if _, err := toml.Decode(string(configData), &config); err != nil {
 		return nil, errors.Wrapf(err, "unable to load udp forwarder configuration")
 	}
+	return newUDPForwarder(config)
+}
+
+// NewUDPForwarderFromConfig creates a UDP forwarder from a [[forwarder]]
+// entry of the juicer configuration.
+func NewUDPForwarderFromConfig(fc juicer.ForwarderConfig) (*UDPForwarder, error) {
+	config := defaultUDPConfig()
+	if err := fc.Decode(&config); err != nil {
+		return nil, errors.Wrapf(err, "unable to load udp forwarder configuration")
+	}
+	return newUDPForwarder(config)
+}
+
+func defaultUDPConfig() UDPConfig {
+	return UDPConfig{
+		SendRateLimit:   juicer.Duration{Duration: sendRateLimit},
+		MinSendDelay:    juicer.Duration{Duration: minSendDelay},
+		StatusInterval:  juicer.Duration{Duration: statusInterval},
+		Backlog:         defaultBacklog,
+		AckTimeout:      juicer.Duration{Duration: ackTimeout},
+		BackfillRate:    defaultBackfillRate,
+		LinkLogInterval: juicer.Duration{Duration: linkLogInterval},
+		BatchInterval:   juicer.Duration{Duration: batchInterval},
+	}
+}
+
+func newUDPForwarder(config UDPConfig) (*UDPForwarder, error) {
+	if config.AckTimeout.Duration <= 0 {
+		return nil, errors.New("udp forwarder needs an ackTimeout")
+	}
+	if config.MinSendDelay.Duration < 0 {
+		return nil, errors.New("udp forwarder minSendDelay is negative")
+	}
+	switch config.Mode {
+	case "":
+		config.Mode = ModeBroadcast
+	case ModeBroadcast, ModeFailover:
+	default:
+		return nil, errors.Errorf("udp forwarder mode %q is not %s or %s",
+			config.Mode, ModeBroadcast, ModeFailover)
+	}
+	dests := config.Destinations
+	if len(dests) == 0 {
+		dests = []UDPDestination{{Server: config.Server, Port: config.Port}}
+	} else if config.Server != "" {
+		return nil, errors.New("udp forwarder has both a server and destinations")
+	}
+	if config.SendRateLimit.Duration < 0 {
+		return nil, errors.New("udp forwarder sendRateLimit is negative")
+	}
+	for _, dest := range dests {
+		if dest.SendRateLimit.Duration < 0 {
+			return nil, errors.Errorf("udp forwarder sendRateLimit of %s:%d is negative",
+				dest.Server, dest.Port)
+		}
+	}
+	var auth *Auth
+	if config.Key != "" {
+		key, err := ParseKey(config.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "udp forwarder key")
+		}
+		if auth, err = NewAuth(key, config.Encrypt); err != nil {
+			return nil, err
+		}
+	} else if config.Encrypt {
+		return nil, errors.New("udp forwarder encryption needs a key")
+	}
+	if config.BatchSize > math.MaxUint8 {
+		return nil, errors.Errorf("udp forwarder batchSize is more than %d", math.MaxUint8)
+	}
+	if config.BatchSize > 1 && config.BatchInterval.Duration <= 0 {
+		return nil, errors.New("udp forwarder batching needs a batchInterval")
+	}
+	if config.Redundancy > maxRedundancy {
+		return nil, errors.Errorf("udp forwarder redundancy is more than %d", maxRedundancy)
+	}
+	if config.Backlog > 0 && config.BackfillRate <= 0 {
+		return nil, errors.New("udp forwarder backfill needs a backfillRate")
+	}
 	udp := &UDPForwarder{
-		Config:  &config,
-		fwdChan: make(chan *juicer.Telemetry, 1),
+		Config: &config,
+	}
+	udp.linkSource = &LinkSource{stats: udp.linkStats}
+	for _, dest := range dests {
+		d, err := newDestination(&config, dest, auth)
+		if err != nil {
+			udp.Close()
+			return nil, err
+		}
+		udp.destinations = append(udp.destinations, d)
 	}
-	if err = udp.connect(); err != nil {
-		return nil, err
+	for _, d := range udp.destinations {
+		d.slack = udp.rateLimit() / 2
 	}
 	return udp, nil
 }
 
+// WatchHealth enables sending TypeStatus packets with the status of the
+// juicer's sources.
+func (udp *UDPForwarder) WatchHealth(health *juicer.Health) {
+	udp.health = health
+}
+
+// Source returns the source of the link quality channels.
+func (udp *UDPForwarder) Source() juicer.Source {
+	return udp.linkSource
+}
+
+// ReceivePitMessages sets the handler of the messages from the pit. It must
+// be called before Start.
+func (udp *UDPForwarder) ReceivePitMessages(handler func(juicer.PitMessage)) {
+	udp.pitHandler = handler
+}
+
+// LinkStats returns the quality of the link to the first destination whose
+// link is up, or to the first destination if none are.
+func (udp *UDPForwarder) LinkStats() LinkStats {
+	return udp.linkStats(time.Now())
+}
+
+func (udp *UDPForwarder) linkStats(now time.Time) LinkStats {
+	return udp.active(now).link.snapshot(now)
+}
+
+func (udp *UDPForwarder) active(now time.Time) *destination {
+	for _, d := range udp.destinations {
+		if d.link.up(now) {
+			return d
+		}
+	}
+	return udp.destinations[0]
+}
+
+// targets returns the destinations to send to according to the mode.
+func (udp *UDPForwarder) targets(now time.Time) []*destination {
+	if udp.Config.Mode != ModeFailover {
+		return udp.destinations
+	}
+	for i, d := range udp.destinations {
+		if d.link.up(now) {
+			return udp.destinations[:i+1]
+		}
+	}
+	return udp.destinations
+}
+
 func (udp *UDPForwarder) Close() error {
-	return udp.conn.Close()
+	var err error
+	for _, d := range udp.destinations {
+		if closeErr := d.conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ForwarderOptions has the juicer deliver only the latest telemetry, at most
+// once per the shortest SendRateLimit of the destinations.
+func (udp *UDPForwarder) ForwarderOptions() juicer.ForwarderOptions {
+	opts := juicer.DefaultForwarderOptions()
+	opts.RateLimit = juicer.Duration{Duration: udp.rateLimit()}
+	return opts
 }
 
+// rateLimit returns the shortest SendRateLimit of the destinations.
+func (udp *UDPForwarder) rateLimit() time.Duration {
+	rateLimit := udp.destinations[0].rateLimit
+	for _, d := range udp.destinations[1:] {
+		if d.rateLimit < rateLimit {
+			rateLimit = d.rateLimit
+		}
+	}
+	return rateLimit
+}
+
+// Forward sends telemetry to the destinations it is due at, and timing to
+// all of them when it changed. It returns the first error of the
+// destinations, having tried all of them.
 func (udp *UDPForwarder) Forward(newTelemetry *juicer.Telemetry, prevTelemetry *juicer.Telemetry) error {
 	telemCopy := *newTelemetry
-	select {
-	// copy telemetry as we're processing it on another go-routine
-	case udp.fwdChan <- &telemCopy:
-	default:
-		// if channel is full, skip
+	udp.mu.Lock()
+	// copy telemetry as it is re-sent from the Start go-routine
+	udp.last = &telemCopy
+	udp.mu.Unlock()
+	now := time.Now()
+	sendTiming := timingChanged(newTelemetry, prevTelemetry)
+	var err error
+	for _, d := range udp.targets(now) {
+		due, _ := d.due(now)
+		if due {
+			if sendErr := d.send(&telemCopy, true); err == nil {
+				err = sendErr
+			}
+		}
+		if sendTiming {
+			if timingErr := udp.sendTiming(d, newTelemetry); err == nil {
+				err = timingErr
+			}
+		}
 	}
-	return nil
+	return err
 }
 
 func (udp *UDPForwarder) Start(ctx context.Context) error {
-	limiter := time.Tick(sendRateLimit)
-	ticker := time.NewTicker(minSendDelay / 2)
+	minSendDelay := udp.Config.MinSendDelay.Duration
+	// the link is checked as often when telemetry is not re-sent
+	tickInterval := udp.Config.AckTimeout.Duration / 2
+	if minSendDelay > 0 {
+		tickInterval = minSendDelay / 2
+	}
+	ticker := time.NewTicker(tickInterval)
 	defer ticker.Stop()
-	lastSent := time.Now()
-	var t *juicer.Telemetry
+	var statusTick <-chan time.Time
+	if udp.health != nil && udp.Config.StatusInterval.Duration > 0 {
+		statusTicker := time.NewTicker(udp.Config.StatusInterval.Duration)
+		defer statusTicker.Stop()
+		statusTick = statusTicker.C
+	}
+	var logTick <-chan time.Time
+	if udp.Config.LinkLogInterval.Duration > 0 {
+		logTicker := time.NewTicker(udp.Config.LinkLogInterval.Duration)
+		defer logTicker.Stop()
+		logTick = logTicker.C
+	}
+	for _, d := range udp.destinations {
+		go d.receive(ctx, udp.handleMessage)
+	}
+	var batchTick <-chan time.Time
+	if udp.Config.BatchSize > 1 {
+		batchTicker := time.NewTicker(udp.Config.BatchInterval.Duration)
+		defer batchTicker.Stop()
+		batchTick = batchTicker.C
+	}
+	var backfillTick <-chan time.Time
+	if udp.Config.Backlog > 0 {
+		backfillTicker := time.NewTicker(time.Second / time.Duration(udp.Config.BackfillRate))
+		defer backfillTicker.Stop()
+		backfillTick = backfillTicker.C
+	}
 	for {
-		<-limiter
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case t = <-udp.fwdChan:
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
+		case <-batchTick:
+			for _, d := range udp.destinations {
+				if _, err := d.flush(); err != nil {
+					log.Error("unable to forward telemetry to server ", err)
+				}
+			}
+		case now := <-backfillTick:
+			for _, d := range udp.destinations {
+				d.backfill(now)
+			}
+		case now := <-logTick:
+			for _, d := range udp.destinations {
+				d.logLink(now)
+			}
+		case <-statusTick:
+			if err := udp.sendStatus(); err != nil {
+				log.Error("unable to send status to server ", err)
+			}
+		case now := <-ticker.C:
+			for _, d := range udp.destinations {
+				d.checkLink(now)
+			}
+			if minSendDelay <= 0 {
+				continue
+			}
+			udp.mu.Lock()
+			t := udp.last
+			udp.mu.Unlock()
+			if t == nil { // don't send if no data yet
+				continue
+			}
 			// we need to send data at least every second to let the
 			// server know we are alive
-			select {
-			case t = <-udp.fwdChan:
-			// if there is pending data we should send it
-			default:
-				if t == nil || // don't send if no data yet
-					time.Now().Sub(lastSent) < minSendDelay {
+			for _, d := range udp.targets(now) {
+				if _, idle := d.due(now); idle < minSendDelay {
 					continue
 				}
+				if err := d.send(t, false); err != nil {
+					log.Error("unable to forward telemetry to server ", err)
+				}
 			}
 		}
-		if err := udp.forward(t); err != nil {
-			log.Error("unable to forward telemetry to server ", err)
-		}
-		lastSent = time.Now()
 	}
 }
 
-func (udp *UDPForwarder) forward(telem *juicer.Telemetry) error {
-	buf := bytes.NewBuffer([]byte{})
-	hdr := Header{
-		Type: TypeTelemetry,
+// Flush sends the batched samples, returning how many were sent to each
+// destination combined.
+func (udp *UDPForwarder) Flush() (int, error) {
+	if udp.Config.BatchSize <= 1 {
+		return 0, nil
 	}
-	if err := binary.Write(buf, binary.LittleEndian, &hdr); err != nil {
-		return errors.Wrap(err, "unable to write udp packet header")
+	total := 0
+	var err error
+	for _, d := range udp.destinations {
+		n, flushErr := d.flush()
+		if flushErr != nil {
+			if err == nil {
+				err = flushErr
+			}
+			continue
+		}
+		total += n
 	}
-	if err := binary.Write(buf, binary.LittleEndian, telem); err != nil {
-		return errors.Wrap(err, "unable to write telemetry udp packet")
+	return total, err
+}
+
+// handleMessage passes a message from the pit to the handler.
+func (udp *UDPForwarder) handleMessage(msg juicer.PitMessage) {
+	if udp.pitHandler == nil {
+		log.WithField("code", msg.Code).
+			Infof("message from the pit: %s", msg.Text)
+		return
 	}
-	return binary.Write(udp.conn, binary.LittleEndian, buf.Bytes())
+	udp.pitHandler(msg)
 }
 
-func (udp *UDPForwarder) connect() error {
-	writeBufSize := maxTelemetrySize * 2
+func (udp *UDPForwarder) sendTiming(d *destination, telem *juicer.Telemetry) error {
+	return d.sendPacket("timing", func() ([]byte, error) {
+		return d.encoder.Timing(telem)
+	})
+}
 
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d",
-		udp.Config.Server,
-		udp.Config.Port))
-	if err != nil {
-		return err
+func (udp *UDPForwarder) sendStatus() error {
+	var sources []SourceStatus
+	for _, source := range udp.health.Sources() {
+		sources = append(sources, newSourceStatus(source))
 	}
-	udpConn := conn.(*net.UDPConn)
-	if err = udpConn.SetWriteBuffer(writeBufSize); err != nil {
-		return errors.Wrapf(err, "unable to set OS write buffer to %v", writeBufSize)
+	var err error
+	for _, d := range udp.targets(time.Now()) {
+		sendErr := d.sendPacket("status", func() ([]byte, error) {
+			return d.encoder.Status(sources)
+		})
+		if err == nil {
+			err = sendErr
+		}
 	}
-
-	udp.conn = conn
-	return nil
+	return err
 }
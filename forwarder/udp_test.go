@@ -3,7 +3,6 @@ package forwarder
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
 	"github.com/jd3nn1s/juicer"
 	"github.com/stretchr/testify/assert"
@@ -52,6 +51,10 @@ func startServer(ctx context.Context) (int, net.PacketConn, chan udpRecv) {
 	return udpAddr.Port, pc, dataChan
 }
 
+// header, telemetry time, monotonic and count, then a field header for every
+// channel followed by 18 float32, 2 float64, 3 uint8 and 1 uint16 values
+const telemetryPacketSize = 23 + 17 + 24*11 + 18*4 + 2*8 + 3*1 + 1*2
+
 func config(port int) string {
 	return fmt.Sprintf(`
 Server = "127.0.0.1"
@@ -60,13 +63,10 @@ Port = %d
 }
 
 func decodePacket(t *testing.T, buf []byte) *juicer.Telemetry {
-	hdr := Header{}
-	recvTelem := juicer.Telemetry{}
-	rdr := bytes.NewReader(buf)
-	assert.NoError(t, binary.Read(rdr, binary.LittleEndian, &hdr))
-	assert.Equal(t, TypeTelemetry, hdr.Type)
-	assert.NoError(t, binary.Read(rdr, binary.LittleEndian, &recvTelem))
-	return &recvTelem
+	p, err := Decode(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeTelemetry, p.Type)
+	return p.Telemetry
 }
 
 func TestTicker(t *testing.T) {
@@ -98,16 +98,16 @@ func TestTicker(t *testing.T) {
 	assert.NoError(t, udp.Forward(&telem, &juicer.Telemetry{}))
 
 	recvData := <-dataChan
-	assert.Equal(t, 63, recvData.len)
+	assert.Equal(t, telemetryPacketSize, recvData.len)
 
 	for n := 0; n < 3; n++ {
 		start := time.Now()
 		recvData := <-dataChan
 		delay := time.Now().Sub(start)
-		assert.Equal(t, 63, recvData.len)
+		assert.Equal(t, telemetryPacketSize, recvData.len)
 		assert.True(t, delay >= minSendDelay)
 		assert.True(t, delay < minSendDelay+time.Millisecond*10)
-		assert.Equal(t, &telem, decodePacket(t, recvData.data))
+		assert.Equal(t, &telem, decodePacket(t, recvData.data[:recvData.len]))
 	}
 }
 
@@ -141,14 +141,86 @@ func TestUDPForwarder(t *testing.T) {
 		Track:          13,
 		GPSSpeed:       14,
 		GasPedalAngle:  15,
+		Time:           16,
+		Monotonic:      17,
 	}
+	newTelem.Updated[juicer.ChannelRPM] = 18
+	newTelem.Stale.Add(juicer.ChannelOilTemp)
 	prevTelem := juicer.Telemetry{}
 	assert.NoError(t, udp.Forward(&newTelem, &prevTelem))
 
 	recvData := <-dataChan
-	assert.Equal(t, 63, recvData.len)
+	assert.Equal(t, telemetryPacketSize, recvData.len)
 
-	recvTelem := decodePacket(t, recvData.data)
+	recvTelem := decodePacket(t, recvData.data[:recvData.len])
 	assert.Equal(t, &newTelem, recvTelem)
 	assert.NoError(t, udp.Close())
 }
+
+func TestUDPForwarderTiming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	port, pc, dataChan := startServer(ctx)
+	defer pc.Close()
+
+	udp, err := NewUDPForwarderFromReader(bytes.NewBufferString(config(port)))
+	assert.NoError(t, err)
+
+	prevTelem := juicer.Telemetry{Lap: 1}
+	newTelem := juicer.Telemetry{
+		Lap:         2,
+		LastLapTime: 95.25,
+		BestLapTime: 95.25,
+	}
+	assert.NoError(t, udp.Forward(&newTelem, &prevTelem))
+
+	recvData := <-dataChan
+	assert.Equal(t, telemetryPacketSize, recvData.len)
+	recvData = <-dataChan
+	p, err := Decode(recvData.data[:recvData.len])
+	assert.NoError(t, err)
+	assert.Equal(t, TypeTiming, p.Type)
+	assert.Equal(t, &Timing{
+		Lap:     2,
+		LastLap: 95250 * time.Millisecond,
+		BestLap: 95250 * time.Millisecond,
+	}, p.Timing)
+	assert.NoError(t, udp.Close())
+}
+
+func TestForwarderOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	port, pc, _ := startServer(ctx)
+	defer pc.Close()
+
+	udp, err := NewUDPForwarderFromReader(bytes.NewBufferString(config(port)))
+	assert.NoError(t, err)
+	opts := udp.ForwarderOptions()
+	assert.Equal(t, 1, opts.QueueSize)
+	assert.Equal(t, juicer.DropOldest, opts.Overflow)
+	assert.Equal(t, sendRateLimit, opts.RateLimit.Duration)
+	assert.NoError(t, udp.Close())
+}
+
+func TestUDPForwarderDurations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// telemetry is not re-sent without a minSendDelay
+	udp, err := NewUDPForwarderFromReader(bytes.NewBufferString(`
+server = "127.0.0.1"
+port = 5001
+minSendDelay = "0s"
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, udp.Forward(&juicer.Telemetry{RPM: 1000}, &juicer.Telemetry{}))
+	assert.Equal(t, context.DeadlineExceeded, udp.Start(ctx))
+	assert.NoError(t, udp.Close())
+
+	for _, negative := range []string{`minSendDelay = "-1s"`, `sendRateLimit = "-1s"`} {
+		_, err = NewUDPForwarderFromReader(bytes.NewBufferString(negative))
+		assert.Error(t, err, negative)
+	}
+}
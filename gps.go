@@ -9,16 +9,19 @@ import (
 
 const (
 	// maximum horizontal dilution of precision
-	maxHDOP = 500
+	defaultMaxHDOP = 500
 )
 
 type gpsRetryable struct {
+	UpdateSender
 	c GPS
-	sendChan chan<- gpsData
+	portName string
+	maxHDOP  int
+	capture  Capturer
 }
 
 func (g *gpsRetryable) Open() error {
-	c, err := gpsConnect(gpsPortName)
+	c, err := gpsConnect(g.portName)
 	g.c = c
 	return err
 }
@@ -44,11 +47,14 @@ func (g *gpsRetryable) Name() string {
 }
 
 func (g*gpsRetryable) navDataFn(navData skytraq.NavData) {
+	if g.capture != nil {
+		g.capture.NavData(navData)
+	}
 	if navData.Fix == skytraq.FixNone {
 		log.Warnf("no satellite fix")
 		return
 	}
-	if navData.HDOP > maxHDOP {
+	if navData.HDOP > g.maxHDOP {
 		log.WithField("HDOP", navData.HDOP).Warn("poor resolution")
 		return
 	}
@@ -59,27 +65,19 @@ func (g*gpsRetryable) navDataFn(navData skytraq.NavData) {
 		track = 0
 	}
 
-	select {
-	case g.sendChan <- gpsData{
+	data := gpsData{
 		Latitude:  navData.Latitude,
 		Longitude: navData.Longitude,
 		Altitude:  navData.Altitude,
 		Speed:     speed,
 		Track:     track,
-	}:
-	default:
 	}
+	g.Send(Update{
+		Source: g.Name(),
+		Values: data.values(),
+	})
 }
 
 var gpsConnect = func(p string) (GPS, error) {
 	return skytraq.Connect(p)
 }
-
-func runGPS(ctx context.Context, sendChan chan<- gpsData) {
-	err := retry(ctx, &gpsRetryable{
-		sendChan: sendChan,
-	})
-	if err != nil {
-		log.Errorf("gps done: %v", err)
-	}
-}
\ No newline at end of file
@@ -22,8 +22,9 @@ func TestRunGPS(t *testing.T) {
 	}
 
 	gpsRetryable := &gpsRetryable{
-		sendChan: jc.gpsChan,
+		maxHDOP: defaultMaxHDOP,
 	}
+	gpsRetryable.SetUpdateChan(jc.updateChan)
 
 	// close before opening
 	assert.NoError(t, gpsRetryable.Close())
@@ -65,7 +66,7 @@ func TestRunGPS(t *testing.T) {
 	}
 
 	// read some data
-	<-jc.gpsChan
+	<-jc.updateChan
 
 	cancel()
 	wg.Wait()
@@ -74,8 +75,9 @@ func TestRunGPS(t *testing.T) {
 func TestNavDataFn(t *testing.T) {
 	jc := NewJuicer()
 	gpsRetryable := gpsRetryable{
-		sendChan: jc.gpsChan,
+		maxHDOP: defaultMaxHDOP,
 	}
+	gpsRetryable.SetUpdateChan(jc.updateChan)
 
 	navData := skytraq.NavData{
 		Fix:            skytraq.FixNone,
@@ -90,34 +92,37 @@ func TestNavDataFn(t *testing.T) {
 	}
 
 	gpsRetryable.navDataFn(navData)
-	assertNoData(t, jc.gpsChan,"unexpected data on channel as there is no fix")
+	assertNoData(t, jc.updateChan,"unexpected data on channel as there is no fix")
 
 	navData.Fix = skytraq.Fix3D
 	gpsRetryable.navDataFn(navData)
-	telem := <-jc.gpsChan
-	assert.Equal(t, 2, telem.Latitude)
-	assert.Equal(t, 3, telem.Longitude)
-	assert.Equal(t, 4, telem.Altitude)
-	assert.Equal(t, float64(8.602325267042627), telem.Speed)
-	assert.Equal(t, float64(0.6202494859828215), telem.Track)
-
-	navData.HDOP = maxHDOP + 1
+	update := <-jc.updateChan
+	assert.Equal(t, "gps", update.Source)
+	telem := Telemetry{}
+	telem.Apply(update)
+	assert.Equal(t, 0.0000002, telem.Latitude)
+	assert.Equal(t, 0.0000003, telem.Longitude)
+	assert.Equal(t, float32(0.04), telem.Altitude)
+	assert.Equal(t, float32(8.602325267042627), telem.GPSSpeed)
+	assert.Equal(t, float32(0.6202494859828215), telem.Track)
+
+	navData.HDOP = defaultMaxHDOP + 1
 	gpsRetryable.navDataFn(navData)
-	assertNoData(t, jc.gpsChan,"unexpected data on channel as there is high HDOP")
+	assertNoData(t, jc.updateChan,"unexpected data on channel as there is high HDOP")
 
 	// no VY or VX should return 0 track
 	navData.HDOP = 0
 	navData.VY = 0
 	navData.VX = 0
 	gpsRetryable.navDataFn(navData)
-	telem = <-jc.gpsChan
-	assert.Equal(t, float64(0), telem.Track)
+	telem.Apply(<-jc.updateChan)
+	assert.Equal(t, float32(0), telem.Track)
 }
 
-func assertNoData(t *testing.T, gpsChan <-chan gpsData, msg string) {
+func assertNoData(t *testing.T, updateChan <-chan Update, msg string) {
 	select {
-	case <-gpsChan:
+	case <-updateChan:
 		assert.Fail(t, msg)
 	default:
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,171 @@
+package juicer
+
+import (
+	"sync"
+	"time"
+)
+
+// window over which SourceHealth.MessageRate is calculated
+var messageRateWindow = 5 * time.Second
+
+type SourceState uint8
+
+const (
+	// the source has not been started or has been closed
+	SourceStopped SourceState = iota
+	// the source is being opened
+	SourceConnecting
+	// the source has been opened and is running
+	SourceConnected
+	// the source failed and is waiting to be reopened
+	SourceDisconnected
+)
+
+func (s SourceState) String() string {
+	switch s {
+	case SourceStopped:
+		return "stopped"
+	case SourceConnecting:
+		return "connecting"
+	case SourceConnected:
+		return "connected"
+	case SourceDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// SourceHealth is the connection status of a source.
+type SourceHealth struct {
+	Name  string
+	State SourceState
+	// when the source was last opened
+	ConnectedSince time.Time
+	// number of times the source was reopened after an error
+	Reconnects    int
+	LastError     string
+	LastErrorTime time.Time
+	// number of updates received from the source
+	Messages uint64
+	// updates per second
+	MessageRate float64
+	LastMessage time.Time
+
+	opens       int
+	windowStart time.Time
+	windowCount int
+}
+
+func (s *SourceHealth) updateRate(now time.Time) {
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < messageRateWindow {
+		return
+	}
+	s.MessageRate = float64(s.windowCount) / elapsed.Seconds()
+	s.windowStart = now
+	s.windowCount = 0
+}
+
+// Health tracks the status of the sources of a juicer. It is fed by the
+// retrier and by the updates sent by each source and is safe for concurrent
+// use.
+type Health struct {
+	mu      sync.Mutex
+	sources []*SourceHealth
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// Sources returns the status of every source in the order they were added.
+func (h *Health) Sources() []SourceHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	sources := make([]SourceHealth, 0, len(h.sources))
+	for _, s := range h.sources {
+		s.updateRate(now)
+		sources = append(sources, *s)
+	}
+	return sources
+}
+
+// Source returns the status of a single source.
+func (h *Health) Source(name string) (SourceHealth, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.sources {
+		if s.Name == name {
+			s.updateRate(time.Now())
+			return *s, true
+		}
+	}
+	return SourceHealth{}, false
+}
+
+// update calls fn with the status of a source while holding the lock. It
+// does nothing on a nil Health so that retryables can be run without one.
+func (h *Health) update(name string, fn func(s *SourceHealth)) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.sources {
+		if s.Name == name {
+			fn(s)
+			return
+		}
+	}
+	s := &SourceHealth{
+		Name:        name,
+		windowStart: time.Now(),
+	}
+	h.sources = append(h.sources, s)
+	fn(s)
+}
+
+func (h *Health) register(name string) {
+	h.update(name, func(s *SourceHealth) {})
+}
+
+func (h *Health) connecting(name string) {
+	h.update(name, func(s *SourceHealth) {
+		s.State = SourceConnecting
+	})
+}
+
+func (h *Health) connected(name string) {
+	h.update(name, func(s *SourceHealth) {
+		s.State = SourceConnected
+		s.ConnectedSince = time.Now()
+		if s.opens > 0 {
+			s.Reconnects++
+		}
+		s.opens++
+	})
+}
+
+func (h *Health) failed(name string, err error) {
+	h.update(name, func(s *SourceHealth) {
+		s.State = SourceDisconnected
+		s.LastError = err.Error()
+		s.LastErrorTime = time.Now()
+	})
+}
+
+func (h *Health) stopped(name string) {
+	h.update(name, func(s *SourceHealth) {
+		s.State = SourceStopped
+	})
+}
+
+func (h *Health) message(name string, t time.Time) {
+	h.update(name, func(s *SourceHealth) {
+		s.Messages++
+		s.windowCount++
+		s.LastMessage = t
+		s.updateRate(t)
+	})
+}
@@ -0,0 +1,90 @@
+package juicer
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryHealth(t *testing.T) {
+	health := NewHealth()
+	r := retryable{
+		startedChan: make(chan struct{}),
+		stopChan:    make(chan error),
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_ = retry(ctx, &r, 0, health)
+		wg.Done()
+	}()
+	<-r.startedChan
+	s, ok := health.Source(r.Name())
+	assert.True(t, ok)
+	assert.Equal(t, SourceConnected, s.State)
+	assert.Equal(t, 0, s.Reconnects)
+	assert.False(t, s.ConnectedSince.IsZero())
+
+	r.stopChan <- errors.New("link dropped")
+	<-r.startedChan
+	s, _ = health.Source(r.Name())
+	assert.Equal(t, SourceConnected, s.State)
+	assert.Equal(t, 1, s.Reconnects)
+	assert.Equal(t, "link dropped", s.LastError)
+	assert.False(t, s.LastErrorTime.IsZero())
+
+	cancel()
+	wg.Wait()
+	s, _ = health.Source(r.Name())
+	assert.Equal(t, SourceStopped, s.State)
+	assert.Equal(t, "link dropped", s.LastError, "shutting down is not an error")
+}
+
+func TestHealthMessages(t *testing.T) {
+	jc := NewJuicer()
+	sources := jc.Health().Sources()
+	assert.Len(t, sources, 3)
+	for _, s := range sources {
+		assert.Equal(t, SourceStopped, s.State)
+	}
+
+	updateTime := time.Now()
+	jc.updateChan <- Update{
+		Source: "gps",
+		Time:   updateTime,
+	}
+	jc.CheckChannels()
+
+	s, ok := jc.Health().Source("gps")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), s.Messages)
+	assert.True(t, updateTime.Equal(s.LastMessage))
+
+	_, ok = jc.Health().Source("imu")
+	assert.False(t, ok)
+}
+
+func TestMessageRate(t *testing.T) {
+	health := NewHealth()
+	health.register("gps")
+	now := time.Now()
+	for n := 0; n < 10; n++ {
+		health.message("gps", now.Add(time.Duration(n)*messageRateWindow/10))
+	}
+	s, _ := health.Source("gps")
+	assert.Equal(t, float64(0), s.MessageRate, "rate should not be calculated until the window has passed")
+
+	health.message("gps", now.Add(messageRateWindow))
+	s, _ = health.Source("gps")
+	assert.InDelta(t, 11/messageRateWindow.Seconds(), s.MessageRate, 0.1)
+}
+
+func TestSourceStateString(t *testing.T) {
+	assert.Equal(t, "connected", SourceConnected.String())
+	assert.Equal(t, "unknown", SourceState(100).String())
+}
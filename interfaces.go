@@ -2,6 +2,7 @@ package juicer
 
 import (
 	"context"
+	"github.com/brutella/can"
 	"github.com/jd3nn1s/juicer/lemoncan"
 	"github.com/jd3nn1s/kw1281"
 	"github.com/jd3nn1s/skytraq"
@@ -22,12 +23,73 @@ type CANBus interface {
 	Close() error
 	Start(context.Context, lemoncan.Callbacks) error
 	SendSpeed(int) error
+	SendDelta(int) error
+	SendMessage(id uint8, code uint8, text string) error
+}
+
+// Capturer is given the messages read from the sensors before they are
+// decoded, so that decoding problems can be reproduced from a capture.
+type Capturer interface {
+	CANFrame(can.Frame)
+	KW1281Block(kw1281.MeasurementGroup, []*kw1281.Measurement)
+	NavData(skytraq.NavData)
 }
 
 type MetricSender interface {
 	SendSpeed(int) error
+	SendDelta(int) error
+}
+
+// Source is a Retryable that sends telemetry updates to the juicer.
+// SetUpdateChan is called by Juicer.AddSource before the source is started.
+type Source interface {
+	Retryable
+	SetUpdateChan(chan<- Update)
 }
 
 type Forwarder interface {
 	Forward(newTelemetry *Telemetry, prevTelemetry *Telemetry) error
-}
\ No newline at end of file
+}
+
+// OptionsForwarder is implemented by forwarders that need options other than
+// DefaultForwarderOptions when they are added with AddForwarder.
+type OptionsForwarder interface {
+	ForwarderOptions() ForwarderOptions
+}
+
+// HealthWatcher is implemented by forwarders that report the status of the
+// sources. WatchHealth is called by Juicer.AddForwarder.
+type HealthWatcher interface {
+	WatchHealth(*Health)
+}
+
+// PitMessageReceiver is implemented by forwarders that receive messages from
+// the pit. ReceivePitMessages is called by Juicer.AddForwarder with a handler
+// that shows the messages to the driver.
+type PitMessageReceiver interface {
+	ReceivePitMessages(handler func(PitMessage))
+}
+
+// LinkSourceName is the name of the source that updates the link quality
+// channels.
+const LinkSourceName = "link"
+
+// SourceForwarder is implemented by forwarders that also update channels,
+// such as the quality of the link they send telemetry over. The source is
+// added by Juicer.AddForwarder.
+type SourceForwarder interface {
+	Source() Source
+}
+
+// Lifecycle is implemented by forwarders that need to run alongside the
+// juicer. Start is called by Juicer.Start and Close once Run has returned.
+type Lifecycle interface {
+	Start(ctx context.Context) error
+	Close() error
+}
+
+// Flusher is implemented by forwarders that buffer telemetry. Flush is called
+// on shutdown before Close and returns the number of samples sent.
+type Flusher interface {
+	Flush() (int, error)
+}
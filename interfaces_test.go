@@ -2,6 +2,8 @@ package juicer
 
 import (
 	"context"
+	"fmt"
+	"github.com/brutella/can"
 	"github.com/jd3nn1s/juicer/lemoncan"
 	"github.com/jd3nn1s/kw1281"
 	"github.com/jd3nn1s/skytraq"
@@ -27,6 +29,9 @@ type canBusStub struct {
 	sensorStub
 	speed int
 	speedCallCount int
+	delta int
+	deltaCallCount int
+	messages []string
 	callbacks lemoncan.Callbacks
 }
 
@@ -104,11 +109,93 @@ func (c *canBusStub) SendSpeed(speed int) error {
 	return nil
 }
 
+func (c *canBusStub) SendDelta(delta int) error {
+	c.deltaCallCount++
+	c.delta = delta
+	return nil
+}
+
+func (c *canBusStub) SendMessage(id uint8, code uint8, text string) error {
+	c.messages = append(c.messages, fmt.Sprintf("%d %s %s", id, PitCode(code), text))
+	return nil
+}
+
 type forwarderStub struct {
 	telemetry *Telemetry
+	fwdChan   chan Telemetry
 }
 
 func (fwd* forwarderStub) Forward(newTelemetry *Telemetry, prevTelemetry *Telemetry) error {
 	fwd.telemetry = newTelemetry
+	if fwd.fwdChan != nil {
+		select {
+		case fwd.fwdChan <- *newTelemetry:
+		default:
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+type lifecycleStub struct {
+	forwarderStub
+	started chan struct{}
+	flushed int
+	closed  bool
+}
+
+func (fwd *lifecycleStub) Start(ctx context.Context) error {
+	close(fwd.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (fwd *lifecycleStub) Flush() (int, error) {
+	fwd.flushed++
+	return 1, nil
+}
+
+func (fwd *lifecycleStub) Close() error {
+	fwd.closed = true
+	return nil
+}
+
+type sourceStub struct {
+	UpdateSender
+	retryable
+}
+
+type sourceForwarderStub struct {
+	forwarderStub
+	source *sourceStub
+}
+
+func (fwd *sourceForwarderStub) Source() Source {
+	return fwd.source
+}
+
+type pitMessageStub struct {
+	forwarderStub
+	handler func(PitMessage)
+}
+
+func (fwd *pitMessageStub) ReceivePitMessages(handler func(PitMessage)) {
+	fwd.handler = handler
+}
+
+type capturerStub struct {
+	frames   []can.Frame
+	blocks   []kw1281.MeasurementGroup
+	navDatas []skytraq.NavData
+}
+
+func (c *capturerStub) CANFrame(frame can.Frame) {
+	c.frames = append(c.frames, frame)
+}
+
+func (c *capturerStub) KW1281Block(group kw1281.MeasurementGroup, measurements []*kw1281.Measurement) {
+	c.blocks = append(c.blocks, group)
+}
+
+func (c *capturerStub) NavData(navData skytraq.NavData) {
+	c.navDatas = append(c.navDatas, navData)
+}
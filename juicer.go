@@ -3,107 +3,452 @@ package juicer
 import (
 	"context"
 	log "github.com/sirupsen/logrus"
-	"math"
+	"sync"
+	"time"
 )
 
+// maximum time to wait for sources and forwarders to stop on shutdown
+var shutdownTimeout = 5 * time.Second
+
+var defaultStaleTimeout = 3 * time.Second
+
 const (
-	ecuPortName    = "/dev/obd"
-	gpsPortName    = "/dev/ttyAMA0"
-	canBusPortName = "can0"
+	defaultECUPortName    = "/dev/obd"
+	defaultGPSPortName    = "/dev/ttyAMA0"
+	defaultCANBusPortName = "can0"
 
-	channelBufferSize = 1
+	// shared by all sources
+	updateBufferSize = 8
+
+	staleCheckInterval = 250 * time.Millisecond
 )
 
 type Juicer struct {
+	config *Config
+
 	PrevTelemetry Telemetry
 	Telemetry     Telemetry
 
-	gpsChan       chan gpsData
-	ecuChan       chan ecuData
-	canSensorChan chan canSensorData
+	updateChan chan Update
+
+	// used to calculate Telemetry.Monotonic
+	created time.Time
+	// when each channel was last updated and the source that updated it
+	updated   [maxChannel + 1]time.Time
+	updatedBy [maxChannel + 1]string
+	// stale timeout for each source name
+	staleTimeouts map[string]time.Duration
+	// check staleness against the time of the latest update, not the clock
+	updateClock bool
+	latest      time.Time
+	// Merged channels of the updates merged, closed once the forwarders are
+	// idle
+	merged []chan struct{}
 
 	canSensorBus *canBusRetryable
 
-	forwarders []Forwarder
+	sources    []Source
+	forwarders []*forwarderQueue
+	health     *Health
 	testMode   bool
+
+	// tracks the source go-routines started by Start
+	wg sync.WaitGroup
+	// tracks the forwarder go-routines started by Start
+	fwdWG sync.WaitGroup
+	// tracks the forwarder queue go-routines started by Run
+	queueWG sync.WaitGroup
 }
 
 func NewJuicer() *Juicer {
+	return NewJuicerFromConfig(DefaultConfig())
+}
+
+func NewJuicerFromConfig(config *Config) *Juicer {
 	jc := &Juicer{
-		forwarders: make([]Forwarder, 0),
+		config:        config,
+		updateChan:    make(chan Update, updateBufferSize),
+		created:       time.Now(),
+		staleTimeouts: make(map[string]time.Duration),
+		sources:       make([]Source, 0),
+		forwarders:    make([]*forwarderQueue, 0),
+		health:        NewHealth(),
 	}
-	jc.mkChannels()
+	jc.Telemetry.Stale = jc.staleChannels(jc.created)
 
-	canSensorBus := newCANBus(jc.canSensorChan)
-	jc.canSensorBus = canSensorBus
+	if config.CANBus.Enabled {
+		canSensorBus := newCANBus(config.CANBus.Interface)
+		jc.canSensorBus = canSensorBus
+		jc.AddSource(canSensorBus)
+		jc.SetStaleTimeout(canSensorBus.Name(), config.CANBus.StaleTimeout.Duration)
 
-	jc.AddForwarder(&CANForwarder{
-		canSensorBus: canSensorBus,
-	})
+		jc.AddForwarder(&CANForwarder{
+			canSensorBus: canSensorBus,
+		})
+	}
+	if config.ECU.Enabled {
+		ecu := &ecuRetryable{
+			portName: config.ECU.Port,
+		}
+		jc.AddSource(ecu)
+		jc.SetStaleTimeout(ecu.Name(), config.ECU.StaleTimeout.Duration)
+	}
+	if config.GPS.Enabled {
+		gps := &gpsRetryable{
+			portName: config.GPS.Port,
+			maxHDOP:  config.GPS.MaxHDOP,
+		}
+		jc.AddSource(gps)
+		jc.SetStaleTimeout(gps.Name(), config.GPS.StaleTimeout.Duration)
+	}
+	if config.Track.Enabled {
+		lapTimer := newLapTimer(config.Track)
+		jc.AddSource(lapTimer)
+		jc.AddForwarder(lapTimer)
+	}
 	return jc
 }
 
+// SetStaleTimeout sets how long the channels updated by a source keep their
+// value before they are marked as stale. Channels of sources without a
+// timeout never become stale once they have been updated.
+func (jc *Juicer) SetStaleTimeout(source string, timeout time.Duration) {
+	jc.staleTimeouts[source] = timeout
+}
+
+// AddSource registers a source to be started by Start. It must be called
+// before Start.
+func (jc *Juicer) AddSource(src Source) {
+	src.SetUpdateChan(jc.updateChan)
+	jc.sources = append(jc.sources, src)
+	jc.health.register(src.Name())
+}
+
+// AddForwarder registers a forwarder to be called when the telemetry
+// changes, using the options from OptionsForwarder if it is implemented.
+// Forwarders that implement HealthWatcher are given the health of the
+// juicer's sources and the source of those that implement SourceForwarder is
+// added with the default stale timeout. Messages received by those that
+// implement PitMessageReceiver are shown on the driver's dash.
 func (jc *Juicer) AddForwarder(fwder Forwarder) {
-	jc.forwarders = append(jc.forwarders, fwder)
+	jc.AddForwarderWithOptions(fwder, forwarderOptions(fwder))
+}
+
+// AddForwarderFromConfig is AddForwarder with the options overridden by the
+// forwarder's configuration entry.
+func (jc *Juicer) AddForwarderFromConfig(fwder Forwarder, fc ForwarderConfig) {
+	jc.AddForwarderWithOptions(fwder, fc.Options(forwarderOptions(fwder)))
+}
+
+func forwarderOptions(fwder Forwarder) ForwarderOptions {
+	if of, ok := fwder.(OptionsForwarder); ok {
+		return of.ForwarderOptions()
+	}
+	return DefaultForwarderOptions()
+}
+
+func (jc *Juicer) AddForwarderWithOptions(fwder Forwarder, opts ForwarderOptions) {
+	if hw, ok := fwder.(HealthWatcher); ok {
+		hw.WatchHealth(jc.health)
+	}
+	if pr, ok := fwder.(PitMessageReceiver); ok {
+		pr.ReceivePitMessages(jc.showPitMessage)
+	}
+	if sf, ok := fwder.(SourceForwarder); ok {
+		src := sf.Source()
+		jc.AddSource(src)
+		jc.SetStaleTimeout(src.Name(), defaultStaleTimeout)
+	}
+	jc.forwarders = append(jc.forwarders, newForwarderQueue(fwder, opts))
+}
+
+// SetCapturer captures the messages read by the ECU, GPS and CAN bus sources.
+// It must be called before Start.
+func (jc *Juicer) SetCapturer(capture Capturer) {
+	for _, src := range jc.sources {
+		switch s := src.(type) {
+		case *ecuRetryable:
+			s.capture = capture
+		case *gpsRetryable:
+			s.capture = capture
+		case *canBusRetryable:
+			s.capture = capture
+		}
+	}
+}
+
+// SetOverflowPolicy changes the overflow policy of every forwarder added so
+// far. It must be called before Run. Replays use Block so that no telemetry
+// is dropped when playing back faster than the forwarders can keep up.
+func (jc *Juicer) SetOverflowPolicy(policy OverflowPolicy) {
+	for _, q := range jc.forwarders {
+		q.opts.Overflow = policy
+	}
+}
+
+// ForwarderStats returns the delivery counters of each forwarder in the order
+// they were added.
+func (jc *Juicer) ForwarderStats() []ForwarderStats {
+	stats := make([]ForwarderStats, 0, len(jc.forwarders))
+	for _, q := range jc.forwarders {
+		stats = append(stats, q.stats())
+	}
+	return stats
+}
+
+// Health returns the connection status of the sources.
+func (jc *Juicer) Health() *Health {
+	return jc.health
 }
 
 func (jc *Juicer) Start(ctx context.Context) {
+	for _, q := range jc.forwarders {
+		if lc, ok := q.fwder.(Lifecycle); ok {
+			jc.fwdWG.Add(1)
+			go func(q *forwarderQueue) {
+				defer jc.fwdWG.Done()
+				if err := lc.Start(ctx); err != nil && err != ctx.Err() {
+					log.Errorf("forwarder %s stopped: %v", q.name(), err)
+				}
+			}(q)
+		}
+	}
+
 	if jc.testMode {
 		log.Warn("starting in test mode")
 		jc.runTestMode(ctx)
+	}
+	for _, src := range jc.sources {
+		if jc.testMode && isSensor(src) {
+			continue
+		}
+		src := src
+		jc.goRun(func() { jc.runRetryable(ctx, src) })
+	}
+}
+
+// isSensor reports whether src reads the ECU, GPS or CAN bus, which test
+// mode replaces with generated data.
+func isSensor(src Source) bool {
+	switch src.(type) {
+	case *ecuRetryable, *gpsRetryable, *canBusRetryable:
+		return true
+	}
+	return false
+}
+
+func (jc *Juicer) runRetryable(ctx context.Context, r Retryable) {
+	err := retry(ctx, r, jc.config.RetrySleep.Duration, jc.health)
+	if err != nil {
+		log.Errorf("%s done: %v", r.Name(), err)
+	}
+}
+
+// Run merges data from the sources started by Start into Telemetry and
+// queues it for the forwarders whenever it changes. It blocks until ctx is
+// done, then waits for the sources and forwarders to stop before flushing and
+// closing the forwarders.
+func (jc *Juicer) Run(ctx context.Context) error {
+	for _, q := range jc.forwarders {
+		jc.queueWG.Add(1)
+		go func(q *forwarderQueue) {
+			defer jc.queueWG.Done()
+			q.run(ctx)
+		}(q)
+	}
+	defer jc.shutdown()
+	ticker := time.NewTicker(staleCheckInterval)
+	defer ticker.Stop()
+	for {
+		changed, err := jc.checkChannels(ctx, ticker.C)
+		if err != nil {
+			return err
+		}
+		if changed {
+			jc.telemetryUpdate(ctx)
+		}
+		jc.closeMerged()
+	}
+}
+
+// closeMerged closes the Merged channels of the updates merged once there
+// are no more updates to merge and the forwarders have finished with the
+// telemetry. Otherwise it is tried again after the next update or stale
+// check.
+func (jc *Juicer) closeMerged() {
+	if len(jc.merged) == 0 || len(jc.updateChan) > 0 {
 		return
 	}
-	go jc.canSensorBus.runCAN(ctx)
-	go runECU(ctx, jc.ecuChan)
-	go runGPS(ctx, jc.gpsChan)
+	for _, q := range jc.forwarders {
+		if !q.idle() {
+			return
+		}
+	}
+	for _, merged := range jc.merged {
+		close(merged)
+	}
+	jc.merged = nil
+}
+
+func (jc *Juicer) shutdown() {
+	timeout := jc.config.ShutdownTimeout.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logger := log.WithField("timeout", timeout)
+	if !waitTimeout(ctx, &jc.wg) {
+		logger.Warn("timed out waiting for sources to stop")
+	}
+	// both are waited for so that the queues have stopped if they can
+	fwdStopped := waitTimeout(ctx, &jc.fwdWG)
+	queuesStopped := waitTimeout(ctx, &jc.queueWG)
+	if !fwdStopped || !queuesStopped {
+		logger.Warn("timed out waiting for forwarders to stop")
+	}
+
+	flushed, closed := 0, 0
+	for _, q := range jc.forwarders {
+		// a queue that is still delivering is not drained alongside it
+		if q.stopped() {
+			flushed += q.drain()
+		} else {
+			log.Warnf("forwarder %s is still busy, its queue is not drained", q.name())
+		}
+		if f, ok := q.fwder.(Flusher); ok {
+			n, err := f.Flush()
+			if err != nil {
+				log.Errorf("unable to flush forwarder %s: %v", q.name(), err)
+			}
+			flushed += n
+		}
+		if lc, ok := q.fwder.(Lifecycle); ok {
+			if err := lc.Close(); err != nil {
+				log.Errorf("unable to close forwarder %s: %v", q.name(), err)
+				continue
+			}
+			closed++
+		}
+	}
+	for _, stats := range jc.ForwarderStats() {
+		log.WithField("delivered", stats.Delivered).
+			WithField("dropped", stats.Dropped).
+			WithField("errors", stats.Errors).
+			Infof("forwarder %s", stats.Name)
+	}
+	log.WithField("flushed", flushed).
+		WithField("closed", closed).
+		Info("juicer shutdown complete")
+}
+
+func waitTimeout(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (jc *Juicer) goRun(fn func()) {
+	jc.wg.Add(1)
+	go func() {
+		defer jc.wg.Done()
+		fn()
+	}()
+}
+
+// SetUpdateClock checks the channels for staleness against the time of the
+// latest update rather than the wall clock. A replay uses it as the times of
+// its updates follow the recording, however fast it is played back. It must
+// be called before Run.
+func (jc *Juicer) SetUpdateClock(updateClock bool) {
+	jc.updateClock = updateClock
 }
 
+// SetTestMode replaces the ECU, GPS and CAN bus sources with generated data,
+// the other sources are still started. It must be called before Start.
 func (jc *Juicer) SetTestMode(testMode bool) {
 	jc.testMode = testMode
 }
 
+// TelemetryUpdate queues the current telemetry for every forwarder.
 func (jc *Juicer) TelemetryUpdate() {
-	for _, fwder := range jc.forwarders {
-		if err := fwder.Forward(&jc.PrevTelemetry, &jc.Telemetry); err != nil {
-			log.Errorf("unable to send to forwarder %v %v", fwder, err)
-		}
-	}
+	jc.telemetryUpdate(context.Background())
 }
 
-func (jc *Juicer) mkChannels() {
-	jc.gpsChan = make(chan gpsData, channelBufferSize)
-	jc.ecuChan = make(chan ecuData, channelBufferSize)
-	jc.canSensorChan = make(chan canSensorData, channelBufferSize)
+func (jc *Juicer) telemetryUpdate(ctx context.Context) {
+	for _, q := range jc.forwarders {
+		q.push(ctx, jc.Telemetry)
+	}
 }
 
 func (jc *Juicer) CheckChannels() (changed bool) {
+	changed, _ = jc.checkChannels(context.Background(), nil)
+	return changed
+}
+
+// checkChannels waits for an update from a source or for staleTick and
+// reports whether the telemetry values or staleness changed. The update times
+// are always recorded even if no values changed.
+func (jc *Juicer) checkChannels(ctx context.Context, staleTick <-chan time.Time) (bool, error) {
 	newTelemetry := jc.Telemetry
 	select {
-	case gpsData := <-jc.gpsChan:
-		newTelemetry.Latitude = float64(gpsData.Latitude) / math.Pow(10, 7)
-		newTelemetry.Longitude = float64(gpsData.Longitude) / math.Pow(10, 7)
-		newTelemetry.Altitude = float32(gpsData.Altitude) / 100.0
-		newTelemetry.Track = float32(gpsData.Track)
-		newTelemetry.GPSSpeed = float32(gpsData.Speed)
-	case ecuData := <-jc.ecuChan:
-		newTelemetry.GasPedalAngle = uint8(ecuData.GasPedalAngle)
-		newTelemetry.RPM = ecuData.RPM
-		newTelemetry.OilPressure = ecuData.OilPressure
-		newTelemetry.Speed = float32(ecuData.Speed)
-		newTelemetry.AirIntakeTemp = ecuData.AirIntakeTemp
-		newTelemetry.BatteryVoltage = ecuData.BatteryVoltage
-	case canSensorData := <-jc.canSensorChan:
-		newTelemetry.FuelRemaining = canSensorData.FuelRemaining
-		newTelemetry.FuelLevel = uint8(canSensorData.FuelLevel)
-		newTelemetry.CoolantTemp = float32(canSensorData.CoolantTemp)
-		newTelemetry.OilTemp = float32(canSensorData.OilTemp)
-	}
-	if jc.Telemetry != newTelemetry {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case update := <-jc.updateChan:
+		if update.Time.IsZero() {
+			update.Time = time.Now()
+		}
+		newTelemetry.Apply(update)
+		newTelemetry.Monotonic = int64(update.Time.Sub(jc.created))
+		jc.health.message(update.Source, update.Time)
+		for _, v := range update.Values {
+			if v.Channel.Valid() {
+				jc.updated[v.Channel] = update.Time
+				jc.updatedBy[v.Channel] = update.Source
+			}
+		}
+		if update.Time.After(jc.latest) {
+			jc.latest = update.Time
+		}
+		if update.Merged != nil {
+			jc.merged = append(jc.merged, update.Merged)
+		}
+	case <-staleTick:
+	}
+	now := time.Now()
+	if jc.updateClock {
+		now = jc.latest
+	}
+	newTelemetry.Stale = jc.staleChannels(now)
+
+	changed := !sameValues(jc.Telemetry, newTelemetry)
+	if changed {
 		jc.PrevTelemetry = jc.Telemetry
-		jc.Telemetry = newTelemetry
-		return true
 	}
-	return false
+	jc.Telemetry = newTelemetry
+	return changed, nil
+}
+
+func (jc *Juicer) staleChannels(now time.Time) ChannelSet {
+	var stale ChannelSet
+	for _, ch := range Channels() {
+		updated := jc.updated[ch]
+		if updated.IsZero() {
+			stale.Add(ch)
+			continue
+		}
+		timeout := jc.staleTimeouts[jc.updatedBy[ch]]
+		if timeout > 0 && now.Sub(updated) > timeout {
+			stale.Add(ch)
+		}
+	}
+	return stale
 }
 
 func castToFloat32(val interface{}) float32 {
@@ -1,8 +1,11 @@
 package juicer
 
 import (
+	"context"
+	"github.com/jd3nn1s/skytraq"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestCheckChannelsGPS(t *testing.T) {
@@ -16,7 +19,7 @@ func TestCheckChannelsGPS(t *testing.T) {
 		Speed:     5,
 	}
 
-	jc.gpsChan <- gps
+	jc.updateChan <- update(gps.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, 0.0000001, jc.Telemetry.Latitude)
 	assert.Equal(t, 0.0000002, jc.Telemetry.Longitude)
@@ -25,19 +28,19 @@ func TestCheckChannelsGPS(t *testing.T) {
 	assert.Equal(t, float32(5.0), jc.Telemetry.GPSSpeed)
 
 	// send the same data
-	jc.gpsChan <- gps
+	jc.updateChan <- update(gps.values())
 	prevTelem := jc.Telemetry
 	assert.False(t, jc.CheckChannels())
-	assert.Equal(t, prevTelem, jc.Telemetry)
+	assert.True(t, sameValues(prevTelem, jc.Telemetry))
 
 	// send different data
-	jc.gpsChan <- gpsData{
+	jc.updateChan <- update(gpsData{
 		Latitude:  6,
 		Longitude: 7,
 		Altitude:  8,
 		Track:     9,
 		Speed:     10,
-	}
+	}.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, 0.0000006, jc.Telemetry.Latitude)
 	assert.Equal(t, 0.0000007, jc.Telemetry.Longitude)
@@ -59,7 +62,7 @@ func TestCheckChannelECU(t *testing.T) {
 		BatteryVoltage: 7,
 	}
 
-	jc.ecuChan <- ecu
+	jc.updateChan <- update(ecu.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, uint8(1), jc.Telemetry.GasPedalAngle)
 	assert.Equal(t, float32(2), jc.Telemetry.RPM)
@@ -70,12 +73,12 @@ func TestCheckChannelECU(t *testing.T) {
 	assert.Equal(t, float32(7), jc.Telemetry.BatteryVoltage)
 
 	// send the same data
-	jc.ecuChan <- ecu
+	jc.updateChan <- update(ecu.values())
 	prevTelem := jc.Telemetry
 	assert.False(t, jc.CheckChannels())
-	assert.Equal(t, prevTelem, jc.Telemetry)
+	assert.True(t, sameValues(prevTelem, jc.Telemetry))
 
-	jc.ecuChan <- ecuData{
+	jc.updateChan <- update(ecuData{
 		GasPedalAngle:  8,
 		RPM:            9,
 		OilPressure:    10,
@@ -83,7 +86,7 @@ func TestCheckChannelECU(t *testing.T) {
 		CoolantTemp:    12,
 		AirIntakeTemp:  13,
 		BatteryVoltage: 14,
-	}
+	}.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, uint8(8), jc.Telemetry.GasPedalAngle)
 	assert.Equal(t, float32(9), jc.Telemetry.RPM)
@@ -103,24 +106,24 @@ func TestCheckChannelCAN(t *testing.T) {
 		CoolantTemp:   3,
 		OilTemp:       4,
 	}
-	jc.canSensorChan <- can
+	jc.updateChan <- update(can.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, float32(1), jc.Telemetry.FuelRemaining)
 	assert.Equal(t, uint8(2), jc.Telemetry.FuelLevel)
 	assert.Equal(t, float32(3), jc.Telemetry.CoolantTemp)
 	assert.Equal(t, float32(4), jc.Telemetry.OilTemp)
 
-	jc.canSensorChan <- can
+	jc.updateChan <- update(can.values())
 	prevTelem := jc.Telemetry
 	assert.False(t, jc.CheckChannels())
-	assert.Equal(t, prevTelem, jc.Telemetry)
+	assert.True(t, sameValues(prevTelem, jc.Telemetry))
 
-	jc.canSensorChan <- canSensorData{
+	jc.updateChan <- update(canSensorData{
 		FuelRemaining: 5,
 		FuelLevel:     6,
 		CoolantTemp:   7,
 		OilTemp:       8,
-	}
+	}.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, float32(5), jc.Telemetry.FuelRemaining)
 	assert.Equal(t, uint8(6), jc.Telemetry.FuelLevel)
@@ -131,15 +134,15 @@ func TestCheckChannelCAN(t *testing.T) {
 func TestInterleaved(t *testing.T) {
 	jc := NewJuicer()
 
-	jc.canSensorChan <- canSensorData{
+	jc.updateChan <- update(canSensorData{
 		FuelRemaining: 1,
-	}
+	}.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, float32(1), jc.Telemetry.FuelRemaining)
 
-	jc.ecuChan <- ecuData{
+	jc.updateChan <- update(ecuData{
 		GasPedalAngle:  8,
-	}
+	}.values())
 	assert.True(t, jc.CheckChannels())
 	assert.Equal(t, float32(1), jc.Telemetry.FuelRemaining)
 	assert.Equal(t, uint8(8), jc.Telemetry.GasPedalAngle)
@@ -162,22 +165,342 @@ func TestSendSpeed(t *testing.T) {
 	prevT := Telemetry{}
 	newT := Telemetry{}
 	newT.Speed = 100
-	assert.NoError(t, fwder.Forward(&prevT, &newT))
+	assert.NoError(t, fwder.Forward(&newT, &prevT))
 	assert.Equal(t, 100, canStub.speed)
 	assert.Equal(t, 1, canStub.speedCallCount)
 
 	prevT = newT
-	assert.NoError(t, fwder.Forward(&prevT, &newT))
+	assert.NoError(t, fwder.Forward(&newT, &prevT))
 	assert.Equal(t, 1, canStub.speedCallCount, "unexpected call after unchanged telemetry")
 
 	newT.Speed = 200
-	assert.NoError(t, fwder.Forward(&prevT, &newT))
+	assert.NoError(t, fwder.Forward(&newT, &prevT))
 	assert.Equal(t, 200, canStub.speed)
 	assert.Equal(t, 2, canStub.speedCallCount)
 }
 
+func TestSendDelta(t *testing.T) {
+	canStub := canBusStub{}
+	fwder := &CANForwarder{
+		canSensorBus: &canBusRetryable{
+			c: &canStub,
+		},
+	}
+
+	prevT := Telemetry{}
+	newT := Telemetry{Delta: -1.5}
+	newT.Stale.Add(ChannelDelta)
+	assert.NoError(t, fwder.Forward(&newT, &prevT))
+	assert.Equal(t, 0, canStub.deltaCallCount, "unexpected call with a stale delta")
+
+	newT.Stale.Remove(ChannelDelta)
+	assert.NoError(t, fwder.Forward(&newT, &prevT))
+	assert.Equal(t, -1500, canStub.delta)
+	assert.Equal(t, 1, canStub.deltaCallCount)
+	assert.Equal(t, 0, canStub.speedCallCount)
+}
+
 func TestAddForwarder(t *testing.T) {
 	jc := NewJuicer()
 	fwder := forwarderStub{}
 	jc.AddForwarder(&fwder)
-}
\ No newline at end of file
+}
+
+func TestAddSourceForwarder(t *testing.T) {
+	jc := NewJuicer()
+	fwder := sourceForwarderStub{
+		source: &sourceStub{},
+	}
+	jc.AddForwarder(&fwder)
+	assert.Contains(t, jc.sources, fwder.source)
+	_, ok := jc.Health().Source(fwder.source.Name())
+	assert.True(t, ok)
+}
+
+func TestSetCapturer(t *testing.T) {
+	jc := NewJuicer()
+	capture := &capturerStub{}
+	jc.SetCapturer(capture)
+	for _, src := range jc.sources {
+		switch s := src.(type) {
+		case *ecuRetryable:
+			assert.Equal(t, capture, s.capture)
+		case *canBusRetryable:
+			assert.Equal(t, capture, s.capture)
+		case *gpsRetryable:
+			assert.Equal(t, capture, s.capture)
+			// captured even though it is discarded
+			navData := skytraq.NavData{Fix: skytraq.FixNone, Latitude: 1}
+			s.navDataFn(navData)
+			assert.Equal(t, []skytraq.NavData{navData}, capture.navDatas)
+		}
+	}
+}
+
+func TestPitMessage(t *testing.T) {
+	canStub := canBusStub{}
+	jc := NewJuicer()
+	jc.canSensorBus = &canBusRetryable{
+		c: &canStub,
+	}
+	fwder := pitMessageStub{}
+	jc.AddForwarder(&fwder)
+	fwder.handler(PitMessage{ID: 258, Code: PitBox, Text: "this lap"})
+	assert.Equal(t, []string{"2 BOX this lap"}, canStub.messages)
+}
+
+func TestParsePitCode(t *testing.T) {
+	for _, code := range []PitCode{PitBox, PitFuel, PitSlow} {
+		parsed, ok := ParsePitCode(code.String())
+		assert.True(t, ok)
+		assert.Equal(t, code, parsed)
+	}
+	code, ok := ParsePitCode("slow")
+	assert.True(t, ok)
+	assert.Equal(t, PitSlow, code)
+	_, ok = ParsePitCode("PARK")
+	assert.False(t, ok)
+	_, ok = ParsePitCode("text")
+	assert.False(t, ok, "text is not an instruction")
+	assert.Equal(t, "UNKNOWN", PitCode(100).String())
+}
+
+func TestRun(t *testing.T) {
+	jc := NewJuicer()
+	fwder := forwarderStub{
+		fwdChan: make(chan Telemetry, 1),
+	}
+	jc.AddForwarder(&fwder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		errChan <- jc.Run(ctx)
+	}()
+
+	jc.updateChan <- update(ecuData{
+		RPM: 1000,
+	}.values())
+	telem := <-fwder.fwdChan
+	assert.Equal(t, float32(1000), telem.RPM)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errChan)
+}
+
+func TestRunTestMode(t *testing.T) {
+	jc := NewJuicer()
+	fwder := forwarderStub{
+		fwdChan: make(chan Telemetry, 1),
+	}
+	jc.AddForwarder(&fwder)
+	src := sourceStub{
+		retryable: retryable{
+			startedChan: make(chan struct{}),
+			stopChan:    make(chan error),
+		},
+	}
+	jc.AddSource(&src)
+	jc.SetTestMode(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jc.Start(ctx)
+	errChan := make(chan error)
+	go func() {
+		errChan <- jc.Run(ctx)
+	}()
+	<-fwder.fwdChan
+	// sources that are not sensors still run in test mode
+	<-src.startedChan
+
+	// Run should not return until the test mode go-routines have exited
+	cancel()
+	assert.Equal(t, context.Canceled, <-errChan)
+}
+
+func TestRunMerged(t *testing.T) {
+	jc := NewJuicer()
+	fwder := newSlowForwarder()
+	jc.AddForwarderWithOptions(fwder, ForwarderOptions{QueueSize: 10, Overflow: Block})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		errChan <- jc.Run(ctx)
+	}()
+	merged := make(chan struct{})
+	jc.updateChan <- Update{
+		Source: "ecu",
+		Values: ecuData{RPM: 1000}.values(),
+		Merged: merged,
+	}
+
+	// not until the forwarder has finished with the telemetry
+	select {
+	case <-merged:
+		assert.Fail(t, "merged before the telemetry was forwarded")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(fwder.release)
+	assert.Equal(t, float32(1000), (<-fwder.received).RPM)
+	<-merged
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errChan)
+}
+
+func TestShutdown(t *testing.T) {
+	jc := NewJuicer()
+	fwder := lifecycleStub{
+		started: make(chan struct{}),
+	}
+	jc.AddForwarder(&fwder)
+	jc.SetTestMode(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jc.Start(ctx)
+	<-fwder.started
+
+	cancel()
+	assert.Equal(t, context.Canceled, jc.Run(ctx))
+	assert.Equal(t, 1, fwder.flushed)
+	assert.True(t, fwder.closed)
+}
+
+func TestShutdownBusyForwarder(t *testing.T) {
+	config := DefaultConfig()
+	config.ShutdownTimeout = Duration{50 * time.Millisecond}
+	jc := NewJuicerFromConfig(config)
+	fwder := newSlowForwarder()
+	defer close(fwder.release)
+	jc.AddForwarderWithOptions(fwder, ForwarderOptions{QueueSize: 10})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		errChan <- jc.Run(ctx)
+	}()
+	for rpm := 1000; rpm <= 2000; rpm += 1000 {
+		jc.updateChan <- update(ecuData{
+			RPM: float32(rpm),
+		}.values())
+	}
+
+	// the queue of a forwarder stuck in Forward is not drained
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errChan)
+	assert.Empty(t, fwder.received)
+}
+func TestAddSource(t *testing.T) {
+	config := DefaultConfig()
+	config.ECU.Enabled = false
+	config.GPS.Enabled = false
+	config.CANBus.Enabled = false
+	jc := NewJuicerFromConfig(config)
+
+	src := sourceStub{
+		retryable: retryable{
+			startedChan: make(chan struct{}),
+			stopChan:    make(chan error),
+		},
+	}
+	jc.AddSource(&src)
+	fwder := forwarderStub{
+		fwdChan: make(chan Telemetry, 1),
+	}
+	jc.AddForwarder(&fwder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jc.Start(ctx)
+	errChan := make(chan error)
+	go func() {
+		errChan <- jc.Run(ctx)
+	}()
+
+	<-src.startedChan
+	src.Send(Update{
+		Source: src.Name(),
+		Values: []ChannelValue{
+			{ChannelOilTemp, 95},
+		},
+	})
+	telem := <-fwder.fwdChan
+	assert.Equal(t, float32(95), telem.OilTemp)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-errChan)
+	assert.True(t, src.hasClosed)
+}
+func TestTimestamps(t *testing.T) {
+	jc := NewJuicer()
+	assert.True(t, jc.Telemetry.Stale.Has(ChannelOilTemp), "never updated channels should be stale")
+
+	updateTime := time.Now()
+	jc.updateChan <- Update{
+		Source: "canbus",
+		Time:   updateTime,
+		Values: []ChannelValue{
+			{ChannelOilTemp, 90},
+		},
+	}
+	assert.True(t, jc.CheckChannels())
+	assert.Equal(t, updateTime.UnixNano(), jc.Telemetry.Time)
+	assert.Equal(t, int64(updateTime.Sub(jc.created)), jc.Telemetry.Monotonic)
+	assert.True(t, updateTime.Equal(jc.Telemetry.UpdatedAt(ChannelOilTemp)))
+	assert.True(t, jc.Telemetry.UpdatedAt(ChannelRPM).IsZero())
+	assert.False(t, jc.Telemetry.Stale.Has(ChannelOilTemp))
+	assert.True(t, jc.Telemetry.Stale.Has(ChannelRPM))
+
+	// an unchanged value should still record the update time
+	updateTime = updateTime.Add(time.Millisecond)
+	jc.updateChan <- Update{
+		Source: "canbus",
+		Time:   updateTime,
+		Values: []ChannelValue{
+			{ChannelOilTemp, 90},
+		},
+	}
+	assert.False(t, jc.CheckChannels())
+	assert.True(t, updateTime.Equal(jc.Telemetry.UpdatedAt(ChannelOilTemp)))
+}
+
+func TestStale(t *testing.T) {
+	jc := NewJuicer()
+	jc.SetStaleTimeout("canbus", time.Millisecond)
+	jc.SetStaleTimeout("ecu", 0)
+
+	jc.updateChan <- Update{
+		Source: "canbus",
+		Values: []ChannelValue{
+			{ChannelOilTemp, 90},
+		},
+	}
+	jc.updateChan <- Update{
+		Source: "ecu",
+		Values: []ChannelValue{
+			{ChannelRPM, 3000},
+		},
+	}
+	assert.True(t, jc.CheckChannels())
+	assert.True(t, jc.CheckChannels())
+	assert.False(t, jc.Telemetry.Stale.Has(ChannelOilTemp))
+	assert.False(t, jc.Telemetry.Stale.Has(ChannelRPM))
+
+	time.Sleep(2 * time.Millisecond)
+	tick := make(chan time.Time, 1)
+	tick <- time.Now()
+	changed, err := jc.checkChannels(context.Background(), tick)
+	assert.NoError(t, err)
+	assert.True(t, changed, "channels becoming stale should be a change")
+	assert.True(t, jc.Telemetry.Stale.Has(ChannelOilTemp))
+	assert.False(t, jc.Telemetry.Stale.Has(ChannelRPM), "sources without a timeout should not become stale")
+	assert.Equal(t, float32(90), jc.Telemetry.OilTemp, "stale channels should keep their value")
+	assert.False(t, jc.PrevTelemetry.Stale.Has(ChannelOilTemp))
+}
+
+func update(values []ChannelValue) Update {
+	return Update{
+		Values: values,
+	}
+}
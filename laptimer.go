@@ -0,0 +1,303 @@
+package juicer
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+const (
+	lapTimerName      = "laptimer"
+	defaultMinLapTime = 20 * time.Second
+
+	// number of reference lap segments ahead of the last match that are
+	// searched for the current position, so that a part of the track that
+	// passes close by is not matched instead
+	referenceSearchWindow = 50
+)
+
+// Point is a latitude and longitude in degrees.
+type Point [2]float64
+
+// xy returns the position of p in metres on a plane touching the earth at
+// latitude lat, which is close enough to flat at the scale of a race track.
+func (p Point) xy(lat float64) (float64, float64) {
+	const metresPerDegree = 111320
+	return p[1] * metresPerDegree * math.Cos(lat*math.Pi/180),
+		p[0] * metresPerDegree
+}
+
+// towards returns the point a fraction t of the way from p to q.
+func (p Point) towards(q Point, t float64) Point {
+	return Point{p[0] + (q[0]-p[0])*t, p[1] + (q[1]-p[1])*t}
+}
+
+// Line is a line segment between two points, such as a start/finish line.
+// It is written as [[lat, lon], [lat, lon]] in juicer.toml.
+type Line [2]Point
+
+// TrackConfig configures lap timing.
+type TrackConfig struct {
+	Enabled     bool
+	Name        string
+	StartFinish Line
+	// sector lines in the order they are crossed, the last sector ends at
+	// the start/finish line
+	Sectors []Line
+	// crossings of the start/finish line that are sooner than this after
+	// the start of the lap are ignored
+	MinLapTime Duration
+}
+
+// crossing reports whether the path from p to q crosses the line and how far
+// along the path, from 0 to 1, it does so. A path that ends on the line
+// crosses it, one that starts on it does not so that a fix on the line is
+// not counted twice.
+func (l Line) crossing(p, q Point) (float64, bool) {
+	lat := l[0][0]
+	px, py := p.xy(lat)
+	qx, qy := q.xy(lat)
+	ax, ay := l[0].xy(lat)
+	bx, by := l[1].xy(lat)
+
+	rx, ry := qx-px, qy-py
+	sx, sy := bx-ax, by-ay
+	denom := rx*sy - ry*sx
+	if denom == 0 {
+		return 0, false
+	}
+	dx, dy := ax-px, ay-py
+	t := (dx*sy - dy*sx) / denom
+	u := (dx*ry - dy*rx) / denom
+	if t <= 0 || t > 1 || u < 0 || u > 1 {
+		return 0, false
+	}
+	return t, true
+}
+
+// tracePoint is a position during a lap and the time since the lap started.
+type tracePoint struct {
+	p       Point
+	elapsed time.Duration
+}
+
+// LapTimer times laps from the GPS position. It is a Forwarder that watches
+// for the start/finish and sector lines being crossed between two GPS fixes
+// and a Source that sends the lap timing channels. The time of a crossing is
+// interpolated between the fixes.
+//
+// The trace of the best lap is kept as the reference lap. The predictive
+// delta is the time into the current lap less the time the reference lap
+// took to get to the same place.
+type LapTimer struct {
+	UpdateSender
+	track TrackConfig
+
+	// previous GPS fix and when it was read in unix nanoseconds
+	fix     Point
+	fixTime int64
+
+	lap         uint16
+	lapStart    int64
+	lastLap     time.Duration
+	bestLap     time.Duration
+	sector      uint8
+	sectorStart int64
+	lastSector  time.Duration
+
+	trace     []tracePoint
+	reference []tracePoint
+	// index of the reference segment last matched to the current position
+	refIndex int
+	delta    time.Duration
+	hasDelta bool
+
+	// when the lap channels were last sent in unix nanoseconds
+	sentAt int64
+}
+
+func newLapTimer(track TrackConfig) *LapTimer {
+	return &LapTimer{
+		track: track,
+	}
+}
+
+func (lt *LapTimer) Name() string {
+	return lapTimerName
+}
+
+func (lt *LapTimer) Open() error {
+	return nil
+}
+
+func (lt *LapTimer) Close() error {
+	return nil
+}
+
+// Start does nothing as the laps are timed by Forward.
+func (lt *LapTimer) Start(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// ForwarderOptions queues telemetry so that no GPS fix is missed.
+func (lt *LapTimer) ForwarderOptions() ForwarderOptions {
+	opts := DefaultForwarderOptions()
+	opts.QueueSize = updateBufferSize
+	return opts
+}
+
+func (lt *LapTimer) Forward(newTelemetry *Telemetry, prevTelemetry *Telemetry) error {
+	fixTime := newTelemetry.Updated[ChannelLatitude]
+	if fixTime > lt.fixTime &&
+		!newTelemetry.Stale.Has(ChannelLatitude) &&
+		!newTelemetry.Stale.Has(ChannelLongitude) {
+		fix := Point{newTelemetry.Latitude, newTelemetry.Longitude}
+		prevFix, prevFixTime := lt.fix, lt.fixTime
+		lt.fix, lt.fixTime = fix, fixTime
+		if prevFixTime != 0 && lt.moved(prevFix, prevFixTime, fix, fixTime) {
+			return nil
+		}
+	}
+	if lt.lap == 0 {
+		return nil
+	}
+	// the last update may have been dropped by a busy juicer, telemetry
+	// from sources that updated after it was sent should include it
+	if newTelemetry.Time <= lt.sentAt {
+		return nil
+	}
+	for _, v := range lt.values() {
+		if newTelemetry.Get(v.Channel) != v.Value {
+			lt.send(time.Time{})
+			break
+		}
+	}
+	return nil
+}
+
+// moved times the path between two GPS fixes and reports whether an update
+// was sent.
+func (lt *LapTimer) moved(prev Point, prevTime int64, fix Point, fixTime int64) bool {
+	interpolate := func(t float64) (Point, int64) {
+		return prev.towards(fix, t), prevTime + int64(t*float64(fixTime-prevTime))
+	}
+	if t, ok := lt.track.StartFinish.crossing(prev, fix); ok {
+		if p, at := interpolate(t); lt.crossed(p, at) {
+			lt.record(fix, fixTime)
+			lt.send(time.Unix(0, at))
+			return true
+		}
+	}
+	if lt.lap == 0 {
+		return false
+	}
+	lt.record(fix, fixTime)
+	if next := int(lt.sector) - 1; next < len(lt.track.Sectors) {
+		if t, ok := lt.track.Sectors[next].crossing(prev, fix); ok {
+			_, at := interpolate(t)
+			lt.lastSector = time.Duration(at - lt.sectorStart)
+			lt.sector++
+			lt.sectorStart = at
+			lt.send(time.Unix(0, at))
+			return true
+		}
+	}
+	if lt.hasDelta {
+		lt.send(time.Unix(0, fixTime))
+		return true
+	}
+	return false
+}
+
+// crossed starts a new lap at the start/finish line crossing at p, unless it
+// is too soon after the start of the current lap.
+func (lt *LapTimer) crossed(p Point, at int64) bool {
+	if lt.lap > 0 {
+		lapTime := time.Duration(at - lt.lapStart)
+		if lapTime < lt.track.MinLapTime.Duration {
+			return false
+		}
+		lt.lastLap = lapTime
+		lt.lastSector = time.Duration(at - lt.sectorStart)
+		lt.trace = append(lt.trace, tracePoint{p, lapTime})
+		if lt.bestLap == 0 || lapTime < lt.bestLap {
+			lt.bestLap = lapTime
+			lt.reference = lt.trace
+		}
+	}
+	lt.lap++
+	lt.lapStart = at
+	lt.sector = 1
+	lt.sectorStart = at
+	lt.trace = []tracePoint{{p, 0}}
+	lt.refIndex = 0
+	return true
+}
+
+// record adds a fix to the trace of the current lap and updates the delta.
+func (lt *LapTimer) record(p Point, at int64) {
+	elapsed := time.Duration(at - lt.lapStart)
+	lt.trace = append(lt.trace, tracePoint{p, elapsed})
+	if ref, ok := lt.referenceElapsed(p); ok {
+		lt.delta = elapsed - ref
+		lt.hasDelta = true
+	}
+}
+
+// referenceElapsed returns how long into the reference lap it was at the
+// point closest to p.
+func (lt *LapTimer) referenceElapsed(p Point) (time.Duration, bool) {
+	ref := lt.reference
+	if len(ref) < 2 {
+		return 0, false
+	}
+	lat := ref[0].p[0]
+	px, py := p.xy(lat)
+	best, bestDist, bestT := lt.refIndex, math.Inf(1), 0.0
+	for i := lt.refIndex; i < len(ref)-1 && i <= lt.refIndex+referenceSearchWindow; i++ {
+		ax, ay := ref[i].p.xy(lat)
+		bx, by := ref[i+1].p.xy(lat)
+		sx, sy := bx-ax, by-ay
+		t := 0.0
+		if l := sx*sx + sy*sy; l > 0 {
+			t = math.Max(0, math.Min(1, ((px-ax)*sx+(py-ay)*sy)/l))
+		}
+		dx, dy := ax+sx*t-px, ay+sy*t-py
+		if d := dx*dx + dy*dy; d < bestDist {
+			best, bestDist, bestT = i, d, t
+		}
+	}
+	lt.refIndex = best
+	a, b := ref[best].elapsed, ref[best+1].elapsed
+	return a + time.Duration(bestT*float64(b-a)), true
+}
+
+func (lt *LapTimer) values() []ChannelValue {
+	values := []ChannelValue{
+		{ChannelLap, float64(lt.lap)},
+		{ChannelLastLapTime, seconds(lt.lastLap)},
+		{ChannelBestLapTime, seconds(lt.bestLap)},
+		{ChannelSector, float64(lt.sector)},
+		{ChannelLastSectorTime, seconds(lt.lastSector)},
+	}
+	// the delta is stale until there is a reference lap
+	if lt.hasDelta {
+		values = append(values, ChannelValue{ChannelDelta, seconds(lt.delta)})
+	}
+	return values
+}
+
+// seconds returns d as it is stored in a float32 channel.
+func seconds(d time.Duration) float64 {
+	return float64(float32(d.Seconds()))
+}
+
+func (lt *LapTimer) send(at time.Time) {
+	lt.sentAt = time.Now().UnixNano()
+	lt.Send(Update{
+		Source: lt.Name(),
+		Time:   at,
+		Values: lt.values(),
+	})
+}
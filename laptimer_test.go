@@ -0,0 +1,191 @@
+package juicer
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testLine = Line{{0, -0.001}, {0, 0.001}}
+
+func TestLineCrossing(t *testing.T) {
+	at, ok := testLine.crossing(Point{-0.0001, 0}, Point{0.0003, 0})
+	assert.True(t, ok)
+	assert.InDelta(t, 0.25, at, 1e-9)
+
+	// either direction
+	_, ok = testLine.crossing(Point{0.0001, 0}, Point{-0.0001, 0})
+	assert.True(t, ok)
+
+	// past the end of the line
+	_, ok = testLine.crossing(Point{-0.0001, 0.002}, Point{0.0001, 0.002})
+	assert.False(t, ok)
+
+	// parallel
+	_, ok = testLine.crossing(Point{0.0001, -0.001}, Point{0.0001, 0.001})
+	assert.False(t, ok)
+
+	// a fix on the line is only counted once
+	_, ok = testLine.crossing(Point{-0.0001, 0}, Point{0, 0})
+	assert.True(t, ok)
+	_, ok = testLine.crossing(Point{0, 0}, Point{0.0001, 0})
+	assert.False(t, ok)
+}
+
+func gpsFix(lat, lon float64, at time.Duration) *Telemetry {
+	telem := &Telemetry{
+		Latitude:  lat,
+		Longitude: lon,
+		Time:      int64(at),
+	}
+	telem.Updated[ChannelLatitude] = int64(at)
+	telem.Updated[ChannelLongitude] = int64(at)
+	return telem
+}
+
+func TestLapTimer(t *testing.T) {
+	updateChan := make(chan Update, 10)
+	lt := newLapTimer(TrackConfig{
+		StartFinish: testLine,
+		MinLapTime:  Duration{10 * time.Second},
+	})
+	lt.SetUpdateChan(updateChan)
+
+	forward := func(lat, lon float64, at time.Duration) {
+		assert.NoError(t, lt.Forward(gpsFix(lat, lon, at), &Telemetry{}))
+	}
+
+	// out lap
+	forward(-0.0001, 0, time.Second)
+	assert.Len(t, updateChan, 0)
+	forward(0.0001, 0, 2*time.Second)
+	update := <-updateChan
+	assert.Equal(t, lapTimerName, update.Source)
+	assert.Equal(t, time.Unix(0, int64(1500*time.Millisecond)), update.Time)
+	assert.Equal(t, []ChannelValue{
+		{ChannelLap, 1},
+		{ChannelLastLapTime, 0},
+		{ChannelBestLapTime, 0},
+		{ChannelSector, 1},
+		{ChannelLastSectorTime, 0},
+	}, update.Values)
+
+	// too soon to be a lap
+	forward(-0.0001, 0, 3*time.Second)
+	assert.Len(t, updateChan, 0)
+
+	// around the track, passing the end of the line
+	forward(-0.0001, 0.005, 50*time.Second)
+	forward(-0.0001, 0, 60*time.Second)
+	forward(0.0003, 0, 61*time.Second)
+	update = <-updateChan
+	// the first lap is now the reference for the delta
+	assert.Equal(t, []ChannelValue{
+		{ChannelLap, 2},
+		{ChannelLastLapTime, 58.75},
+		{ChannelBestLapTime, 58.75},
+		{ChannelSector, 1},
+		{ChannelLastSectorTime, 58.75},
+	}, update.Values[:5])
+
+	forward(0.0003, 0.005, 100*time.Second)
+	forward(-0.0001, 0.005, 120*time.Second)
+	forward(-0.0001, 0, 130*time.Second)
+	forward(0.0001, 0, 131*time.Second)
+	update = lastUpdate(updateChan)
+	assert.Equal(t, []ChannelValue{
+		{ChannelLap, 3},
+		{ChannelLastLapTime, 70.25},
+		{ChannelBestLapTime, 58.75},
+		{ChannelSector, 1},
+		{ChannelLastSectorTime, 70.25},
+	}, update.Values[:5])
+}
+
+func lastUpdate(updateChan chan Update) Update {
+	update := <-updateChan
+	for len(updateChan) > 0 {
+		update = <-updateChan
+	}
+	return update
+}
+
+// the track is a loop north from the start/finish line along longitude 0
+// and back south along longitude 0.005, past the end of the line
+func lap(forward func(lat, lon float64, at time.Duration), start, step time.Duration) {
+	for k := 1; k <= 10; k++ {
+		forward(0.001*float64(k)-0.0005, 0, start+time.Duration(k-1)*step)
+	}
+	forward(0.0095, 0.005, start+20*step)
+	forward(-0.0005, 0.005, start+30*step)
+	forward(-0.0005, 0, start+39*step)
+}
+
+func TestLapTimerSectorsAndDelta(t *testing.T) {
+	updateChan := make(chan Update, 100)
+	lt := newLapTimer(TrackConfig{
+		StartFinish: testLine,
+		Sectors:     []Line{{{0.005, -0.001}, {0.005, 0.001}}},
+	})
+	lt.SetUpdateChan(updateChan)
+
+	forward := func(lat, lon float64, at time.Duration) {
+		assert.NoError(t, lt.Forward(gpsFix(lat, lon, at), &Telemetry{}))
+	}
+
+	// the line is crossed half way between the first two fixes of a lap
+	forward(-0.0005, 0, time.Second)
+	lap(forward, 2*time.Second, time.Second)
+	update := <-updateChan
+	assert.Equal(t, ChannelValue{ChannelLap, 1}, update.Values[0])
+
+	update = <-updateChan
+	assert.Equal(t, time.Unix(0, int64(6500*time.Millisecond)), update.Time)
+	assert.Equal(t, ChannelValue{ChannelSector, 2}, update.Values[3])
+	assert.Equal(t, ChannelValue{ChannelLastSectorTime, 5}, update.Values[4])
+	assert.Len(t, updateChan, 0, "no delta without a reference lap")
+
+	// a lap twice as slow
+	lap(forward, 42*time.Second, 2*time.Second)
+	update = <-updateChan
+	assert.Equal(t, []ChannelValue{
+		{ChannelLap, 2},
+		{ChannelLastLapTime, 40},
+		{ChannelBestLapTime, 40},
+		{ChannelSector, 1},
+		{ChannelLastSectorTime, 35},
+		{ChannelDelta, 0},
+	}, update.Values)
+	for k := 2; k <= 5; k++ {
+		update = <-updateChan
+		assert.Equal(t, ChannelValue{ChannelDelta, float64(k - 1)}, update.Values[5])
+	}
+	update = lastUpdate(updateChan)
+	assert.Equal(t, ChannelValue{ChannelDelta, 39}, update.Values[5])
+}
+
+func TestLapTimerResend(t *testing.T) {
+	updateChan := make(chan Update, 10)
+	lt := newLapTimer(TrackConfig{StartFinish: testLine})
+	lt.SetUpdateChan(updateChan)
+
+	assert.NoError(t, lt.Forward(gpsFix(-0.0001, 0, time.Second), &Telemetry{}))
+	assert.NoError(t, lt.Forward(gpsFix(0.0001, 0, 2*time.Second), &Telemetry{}))
+	<-updateChan
+
+	// telemetry from before the update was sent is not missing it
+	assert.NoError(t, lt.Forward(gpsFix(0.0002, 0, 3*time.Second), &Telemetry{}))
+	assert.Len(t, updateChan, 0)
+
+	// newer telemetry without the lap means the update was dropped
+	telem := gpsFix(0.0003, 0, time.Duration(time.Now().Add(time.Second).UnixNano()))
+	assert.NoError(t, lt.Forward(telem, &Telemetry{}))
+	update := <-updateChan
+	assert.Equal(t, ChannelValue{ChannelLap, 1}, update.Values[0])
+
+	telem = gpsFix(0.0004, 0, time.Duration(time.Now().Add(time.Second).UnixNano()))
+	telem.Lap = 1
+	telem.Sector = 1
+	assert.NoError(t, lt.Forward(telem, &Telemetry{}))
+	assert.Len(t, updateChan, 0)
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/brutella/can"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"math"
 )
 
 const (
@@ -13,6 +14,15 @@ const (
 	frameCoolantTemp        = 0x101
 	frameFuel               = 0x102
 	frameSpeed              = 0x103
+	frameDelta              = 0x104
+	frameMessage            = 0x105
+)
+
+// characters of a message text carried by each frame, and the most frames a
+// message is split into
+const (
+	messageFrameText = 5
+	maxMessageFrames = 15
 )
 
 type IntResultFn func(v int)
@@ -21,6 +31,8 @@ type Callbacks struct {
 	OilTemp     IntResultFn
 	CoolantTemp IntResultFn
 	Fuel        IntResultFn
+	// called with every frame received, before it is decoded
+	Frame func(can.Frame)
 }
 
 type CANBus interface {
@@ -88,10 +100,76 @@ func (c *Connection) SendSpeed(speed int) error {
 	})
 }
 
+// SendDelta sends the predictive lap delta in milliseconds, limited to what
+// fits in an int16.
+func (c *Connection) SendDelta(delta int) error {
+	if c.bus == nil {
+		return errors.New("can bus not connected")
+	}
+	if delta > math.MaxInt16 {
+		delta = math.MaxInt16
+	} else if delta < math.MinInt16 {
+		delta = math.MinInt16
+	}
+	log.WithField("delta", delta).Debug("sending delta over canbus")
+	frame := can.Frame{
+		ID:     frameDelta,
+		Length: 2,
+	}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(int16(delta)))
+	return c.bus.Publish(frame)
+}
+
+// SendMessage sends a message from the pit to the dash. It is split into
+// frames of
+//
+//	id      uint8   message ID, the same for every frame of a message
+//	code    uint8   instruction, such as box or slow down
+//	part    uint8   index of the frame in the high nibble and the number of
+//	                frames in the low nibble
+//	text    [5]byte the part of the text carried by the frame
+//
+// so the text is truncated to 75 bytes. A message without text is sent as a
+// single frame of 3 bytes.
+func (c *Connection) SendMessage(id uint8, code uint8, text string) error {
+	if c.bus == nil {
+		return errors.New("can bus not connected")
+	}
+	if len(text) > messageFrameText*maxMessageFrames {
+		text = text[:messageFrameText*maxMessageFrames]
+	}
+	count := (len(text) + messageFrameText - 1) / messageFrameText
+	if count == 0 {
+		count = 1
+	}
+	log.WithField("id", id).
+		WithField("code", code).
+		WithField("frames", count).
+		Debug("sending message over canbus")
+	for n := 0; n < count; n++ {
+		frame := can.Frame{
+			ID:   frameMessage,
+			Data: [8]uint8{id, code, uint8(n<<4 | count)},
+		}
+		part := text[n*messageFrameText:]
+		if len(part) > messageFrameText {
+			part = part[:messageFrameText]
+		}
+		frame.Length = uint8(3 + copy(frame.Data[3:], part))
+		if err := c.bus.Publish(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Connection) handleFrame(frame can.Frame) {
 	log.WithField("canID", frame.ID).
 		WithField("length", frame.Length).
 		Debug("received canbus frame")
+	if c.cb.Frame != nil {
+		c.cb.Frame(frame)
+	}
 
 	var cb IntResultFn
 	switch frame.ID {
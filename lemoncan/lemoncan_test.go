@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"github.com/brutella/can"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"sync"
 	"testing"
 )
@@ -99,6 +100,54 @@ func TestSendSpeed(t *testing.T) {
 	assert.Equal(t, uint32(frameSpeed), f.ID)
 }
 
+func TestSendDelta(t *testing.T) {
+	bus := &busStub{
+		publishChan: make(chan *can.Frame, 1),
+	}
+
+	c := &Connection{
+		bus: bus,
+	}
+
+	assert.NoError(t, c.SendDelta(-1500))
+	f := <-bus.publishChan
+	assert.Equal(t, uint32(frameDelta), f.ID)
+	assert.Equal(t, uint8(2), f.Length)
+	assert.Equal(t, int16(-1500), int16(binary.LittleEndian.Uint16(f.Data[0:2])))
+
+	assert.NoError(t, c.SendDelta(100000))
+	f = <-bus.publishChan
+	assert.Equal(t, int16(math.MaxInt16), int16(binary.LittleEndian.Uint16(f.Data[0:2])))
+}
+
+func TestSendMessage(t *testing.T) {
+	bus := &busStub{
+		publishChan: make(chan *can.Frame, 3),
+	}
+
+	c := &Connection{
+		bus: bus,
+	}
+
+	assert.NoError(t, c.SendMessage(7, 1, "box this lap"))
+	assert.Len(t, bus.publishChan, 3)
+	var text []byte
+	for n := 0; n < 3; n++ {
+		f := <-bus.publishChan
+		assert.Equal(t, uint32(frameMessage), f.ID)
+		assert.Equal(t, uint8(7), f.Data[0])
+		assert.Equal(t, uint8(1), f.Data[1])
+		assert.Equal(t, uint8(n<<4|3), f.Data[2])
+		text = append(text, f.Data[3:f.Length]...)
+	}
+	assert.Equal(t, "box this lap", string(text))
+
+	assert.NoError(t, c.SendMessage(8, 3, ""))
+	f := <-bus.publishChan
+	assert.Equal(t, uint8(3), f.Length)
+	assert.Equal(t, uint8(1), f.Data[2])
+}
+
 func TestHandleFrame(t *testing.T) {
 	bus := &busStub{
 		publishChan: make(chan *can.Frame, 1),
@@ -169,6 +218,24 @@ func TestHandleFrame(t *testing.T) {
 	assert.Equal(t, expectedData, data)
 }
 
+func TestHandleFrameRaw(t *testing.T) {
+	var frames []can.Frame
+	c := &Connection{
+		cb: &Callbacks{
+			OilTemp: func(v int) {},
+			Frame: func(frame can.Frame) {
+				frames = append(frames, frame)
+			},
+		},
+	}
+	oilTemp := can.Frame{ID: frameOilTemp, Length: 2}
+	unknown := can.Frame{ID: 400, Length: 1}
+	c.handleFrame(oilTemp)
+	c.handleFrame(unknown)
+	// every frame is seen, even those that cannot be decoded
+	assert.Equal(t, []can.Frame{oilTemp, unknown}, frames)
+}
+
 func TestUint16Result(t *testing.T) {
 	_, err := uint16Result(can.Frame{})
 	assert.Error(t, err)
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jd3nn1s/juicer/recorder"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s capture...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	for _, fileName := range flag.Args() {
+		if err := dump(fileName); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// dump prints every message of a capture, one per line.
+func dump(fileName string) error {
+	r, err := recorder.OpenCapture(fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == recorder.ErrTruncated {
+			log.Warnf("%s ends with a partial record", fileName)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		at := rec.Time.Format(time.RFC3339Nano)
+		switch {
+		case rec.CANFrame != nil:
+			f := rec.CANFrame
+			fmt.Printf("%s can id=%#x length=%d flags=%#x data=% x\n",
+				at, f.ID, f.Length, f.Flags, f.Data[:])
+		case rec.KW1281 != nil:
+			fmt.Printf("%s kw1281 group=%d", at, rec.KW1281.Group)
+			for _, m := range rec.KW1281.Measurements {
+				fmt.Printf(" metric%d=%v%s", m.Metric, m.Value, m.Units)
+			}
+			fmt.Println()
+		case rec.NavData != nil:
+			fmt.Printf("%s skytraq %+v\n", at, *rec.NavData)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jd3nn1s/juicer/export"
+	"github.com/jd3nn1s/juicer/recorder"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+var format = flag.String("format", "csv", "export format, csv, ndjson, gpx, kml, ld (MoTeC) or vbo (VBOX)")
+var fields = flag.String("fields", "", "comma separated channels to export, the format's default if empty")
+var from = flag.String("from", "", "start of the export, a time (RFC 3339) or a duration from the start of the session")
+var to = flag.String("to", "", "end of the export, a time (RFC 3339) or a duration from the start of the session")
+var output = flag.String("o", "", "file to write, stdout if empty")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] recording|dir...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fileNames, err := recordings(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	channels, err := export.ParseChannels(*fields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rng, err := exportRange(fileNames[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	w, err := export.New(*format, out, channels)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	total := 0
+	for _, fileName := range fileNames {
+		n, err := exportFile(w, fileName, rng)
+		total += n
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal("unable to write export: ", err)
+	}
+	log.Infof("exported %d samples from %d recordings", total, len(fileNames))
+}
+
+// recordings returns the recordings named, or in the directories named.
+func recordings(args []string) ([]string, error) {
+	var fileNames []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			fileNames = append(fileNames, arg)
+			continue
+		}
+		files, err := recorder.Files(arg)
+		if err != nil {
+			return nil, err
+		}
+		fileNames = append(fileNames, files...)
+	}
+	if len(fileNames) == 0 {
+		return nil, errors.New("no recordings to export")
+	}
+	return fileNames, nil
+}
+
+func exportFile(w export.Writer, fileName string, rng export.Range) (int, error) {
+	r, err := recorder.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := export.Export(w, r, rng)
+	if err == recorder.ErrTruncated {
+		log.Warnf("%s ends with a partial record", fileName)
+		err = nil
+	}
+	return n, errors.Wrapf(err, "unable to export %s", fileName)
+}
+
+// exportRange parses -from and -to, durations are from the first sample of
+// the first recording.
+func exportRange(fileName string) (export.Range, error) {
+	var start time.Time
+	parse := func(flagName, s string) (time.Time, error) {
+		if s == "" {
+			return time.Time{}, nil
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, errors.Errorf("-%s %q is neither a time nor a duration", flagName, s)
+		}
+		if start.IsZero() {
+			start, err = firstSample(fileName)
+			if err != nil {
+				return time.Time{}, err
+			}
+		}
+		return start.Add(d), nil
+	}
+	var rng export.Range
+	var err error
+	if rng.From, err = parse("from", *from); err != nil {
+		return rng, err
+	}
+	rng.To, err = parse("to", *to)
+	return rng, err
+}
+
+func firstSample(fileName string) (time.Time, error) {
+	r, err := recorder.Open(fileName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer r.Close()
+	telem, err := r.Next()
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "unable to read %s", fileName)
+	}
+	return time.Unix(0, telem.Time), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/jd3nn1s/juicer"
+	"github.com/jd3nn1s/juicer/forwarder"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var listen = flag.String("listen", ":5000", "address to receive telemetry on")
+var timeout = flag.Duration("timeout", 5*time.Second, "log a car as lost when no packet is received for this long")
+var printTelemetry = flag.Bool("print-telemetry", true, "print telemetry to stdout")
+var key = flag.String("key", "", "shared key of the cars as hex, packets that are not authenticated with it are dropped")
+var encrypt = flag.Bool("encrypt", false, "encrypt the packets sent to the cars, needs -key")
+
+func main() {
+	log.SetLevel(log.InfoLevel)
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		log.Infof("received %v, shutting down", sig)
+		cancel()
+	}()
+
+	r, err := forwarder.NewReceiver(*listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *key != "" {
+		k, err := forwarder.ParseKey(*key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth, err := forwarder.NewAuth(k, *encrypt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.SetAuth(auth)
+	} else if *encrypt {
+		log.Fatal("-encrypt needs a -key")
+	}
+	log.Infof("listening on %v", r.Addr())
+	go watchCars(ctx, r)
+	go readMessages(r, os.Stdin)
+
+	if err := r.Run(ctx, handlePacket); err != nil && err != context.Canceled {
+		log.Error("receiver stopped: ", err)
+	}
+}
+
+func handlePacket(p *forwarder.Packet, from net.Addr) {
+	switch p.Type {
+	case forwarder.TypeTelemetry, forwarder.TypeBatch, forwarder.TypeDelta:
+		if !*printTelemetry {
+			break
+		}
+		backfill := ""
+		if p.Flags&forwarder.FlagBackfill != 0 {
+			backfill = " backfill"
+		} else if p.Recovered {
+			backfill = " recovered"
+		}
+		if p.Batch == nil {
+			fmt.Printf("car %d seq %d%s %+v\n", p.CarID, p.Sequence, backfill, *p.Telemetry)
+			break
+		}
+		for n, telem := range p.Batch {
+			fmt.Printf("car %d seq %d.%d%s %+v\n", p.CarID, p.Sequence, n, backfill, telem)
+		}
+	case forwarder.TypeTiming:
+		log.Infof("car %d lap %d last %v best %v sector %d last %v",
+			p.CarID, p.Timing.Lap, p.Timing.LastLap, p.Timing.BestLap,
+			p.Timing.Sector, p.Timing.LastSector)
+	case forwarder.TypeStatus:
+		for _, s := range p.Status {
+			log.Infof("car %d source %s %v messages %d rate %.1f/s reconnects %d %s",
+				p.CarID, s.Name, s.State, s.Messages, s.MessageRate, s.Reconnects, s.LastError)
+		}
+	case forwarder.TypeMessageAck:
+		fmt.Printf("car %d received message %d\n", p.CarID, p.MessageAck)
+	default:
+		log.Debugf("car %d sent packet type %d of %d bytes", p.CarID, p.Type, len(p.Body))
+	}
+}
+
+// watchCars logs when a car stops sending packets.
+func watchCars(ctx context.Context, r *forwarder.Receiver) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lost := map[uint16]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, car := range r.Cars() {
+			since := time.Since(car.LastSeen)
+			if since >= *timeout && !lost[car.CarID] {
+				log.Warnf("car %d not seen for %v", car.CarID, since.Round(time.Second))
+				lost[car.CarID] = true
+			} else if since < *timeout && lost[car.CarID] {
+				log.Infof("car %d is back", car.CarID)
+				lost[car.CarID] = false
+			}
+		}
+	}
+}
+
+// readMessages sends the messages typed, one per line, to the drivers. A line
+// is a car ID followed by BOX, FUEL or SLOW and optionally text, or just text.
+func readMessages(r *forwarder.Receiver, in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			if len(fields) > 0 {
+				fmt.Println("usage: car BOX|FUEL|SLOW [text] or car text")
+			}
+			continue
+		}
+		carID, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			fmt.Printf("invalid car %q\n", fields[0])
+			continue
+		}
+		code, ok := juicer.ParsePitCode(fields[1])
+		if ok {
+			fields = fields[2:]
+		} else {
+			fields = fields[1:]
+		}
+		id, err := r.SendMessage(uint16(carID), code, strings.Join(fields, " "))
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("sent message %d to car %d\n", id, carID)
+	}
+}
@@ -6,35 +6,119 @@ import (
 	"fmt"
 	"github.com/jd3nn1s/juicer"
 	"github.com/jd3nn1s/juicer/forwarder"
+	"github.com/jd3nn1s/juicer/recorder"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+var configFile = flag.String("config", "juicer.toml", "configuration file, relative to the binary")
 var testMode = flag.Bool("testmode", false, "generate test data")
 var printTelemetry = flag.Bool("print-telemetry", false, "print telemetry to stdout")
+var replay = flag.String("replay", "", "play back a recording, or the recordings in a directory, instead of reading the sensors")
+var captureDir = flag.String("capture", "", "directory to capture the raw sensor messages to")
+var replaySpeed = flag.Float64("replay-speed", 1, "replay speed relative to the recording, 0 for as fast as possible")
 
 func main() {
 	log.SetLevel(log.InfoLevel)
 	flag.Parse()
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		log.Infof("received %v, shutting down", sig)
+		cancel()
+	}()
 
-	jc := juicer.NewJuicer()
-	fwder, err := forwarder.NewUDPForwarder("udpforwarder.toml")
+	config, err := juicer.LoadConfig(*configFile)
 	if err != nil {
-		log.Fatal("unable to load UDP forwarder: ", err)
+		log.Fatal("unable to load configuration: ", err)
+	}
+
+	var rp *recorder.Replay
+	if *replay != "" {
+		rp, err = newReplay(*replay)
+		if err != nil {
+			log.Fatal("unable to replay: ", err)
+		}
+		config.ECU.Enabled = false
+		config.GPS.Enabled = false
+		config.CANBus.Enabled = false
+		rp.LapTimer = !config.Track.Enabled
+	}
+
+	jc := juicer.NewJuicerFromConfig(config)
+	for _, fc := range config.Forwarders {
+		fwder, err := forwarder.New(fc)
+		if err != nil {
+			log.Fatalf("unable to load %s forwarder: %v", fc.Type, err)
+		}
+		jc.AddForwarderFromConfig(fwder, fc)
+	}
+	if *printTelemetry {
+		jc.AddForwarder(&printForwarder{})
+	}
+	if rp != nil {
+		jc.AddSource(rp)
+		// the recorded updates keep the names of the sources they were read
+		// from, which are disabled while replaying
+		jc.SetStaleTimeout("ecu", config.ECU.StaleTimeout.Duration)
+		jc.SetStaleTimeout("gps", config.GPS.StaleTimeout.Duration)
+		jc.SetStaleTimeout("canbus", config.CANBus.StaleTimeout.Duration)
+		// every recorded update reaches the forwarders however fast it is replayed
+		jc.SetOverflowPolicy(juicer.Block)
+		jc.SetUpdateClock(true)
+		go func() {
+			<-rp.Done()
+			cancel()
+		}()
+	}
+	if *captureDir != "" {
+		capture, err := recorder.NewCapture(*captureDir)
+		if err != nil {
+			log.Fatal("unable to capture: ", err)
+		}
+		defer capture.Close()
+		log.Infof("capturing sensor messages to %s", capture.FileName())
+		jc.SetCapturer(capture)
 	}
-	go fwder.Start(ctx)
-	jc.AddForwarder(fwder)
 	jc.SetTestMode(*testMode)
 	jc.Start(ctx)
 
-	for {
-		changed := jc.CheckChannels()
-		if changed {
-			if *printTelemetry {
-				fmt.Printf("%+v\n", jc.Telemetry)
-			}
-			jc.TelemetryUpdate()
+	if err := jc.Run(ctx); err != nil && err != context.Canceled {
+		log.Error("juicer stopped: ", err)
+	}
+}
+
+func newReplay(path string) (*recorder.Replay, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	fileNames := []string{path}
+	if info.IsDir() {
+		fileNames, err = recorder.Files(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(fileNames) == 0 {
+			return nil, fmt.Errorf("no recordings in %s", path)
 		}
 	}
+	rp := recorder.NewReplay(fileNames...)
+	rp.Speed = *replaySpeed
+	rp.StartTime = time.Now()
+	return rp, nil
+}
+
+type printForwarder struct{}
+
+func (p *printForwarder) Forward(newTelemetry *juicer.Telemetry, prevTelemetry *juicer.Telemetry) error {
+	fmt.Printf("%+v\n", *newTelemetry)
+	return nil
 }
@@ -0,0 +1,74 @@
+package juicer
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// PitCode is an instruction from the pit to the driver.
+type PitCode uint8
+
+const (
+	// a text message without an instruction
+	PitText PitCode = iota
+	// come into the pits
+	PitBox
+	// fuel is low, come in to refuel
+	PitFuel
+	// slow down, such as under a yellow flag
+	PitSlow
+)
+
+var pitCodeNames = map[PitCode]string{
+	PitText: "TEXT",
+	PitBox:  "BOX",
+	PitFuel: "FUEL",
+	PitSlow: "SLOW",
+}
+
+func (c PitCode) String() string {
+	if name, ok := pitCodeNames[c]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// ParsePitCode returns the instruction with the given name, ignoring case.
+// PitText is not an instruction so "TEXT" is not parsed, it can start the
+// text of a message.
+func ParsePitCode(name string) (PitCode, bool) {
+	for code, codeName := range pitCodeNames {
+		if code != PitText && strings.EqualFold(name, codeName) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// PitMessage is a message from the pit to the driver.
+type PitMessage struct {
+	// chosen by the pit, the dash can use it to tell a new message from one
+	// that is repeated
+	ID   uint32
+	Code PitCode
+	Text string
+}
+
+// showPitMessage sends a message from the pit to the driver's dash over the
+// CAN bus.
+func (jc *Juicer) showPitMessage(msg PitMessage) {
+	log.WithField("id", msg.ID).
+		WithField("code", msg.Code).
+		Infof("message from the pit: %s", msg.Text)
+	if jc.canSensorBus == nil {
+		return
+	}
+	canBus := jc.canSensorBus.CANBus()
+	if canBus == nil {
+		log.Error("unable to show pit message, canbus is not initialized")
+		return
+	}
+	if err := canBus.SendMessage(uint8(msg.ID), uint8(msg.Code), msg.Text); err != nil {
+		log.Error("unable to send pit message to CAN bus: ", err)
+	}
+}
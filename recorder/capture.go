@@ -0,0 +1,461 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/brutella/can"
+	"github.com/jd3nn1s/kw1281"
+	"github.com/jd3nn1s/skytraq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A capture has the messages read from the sensors before they are decoded.
+// It uses the same file header and framing as a recording, with the magic
+// "JCAP". The payload of every record is
+//
+//	type      uint8    captureCAN, captureKW1281 or captureNavData
+//	time      int64    unix nanoseconds when the message was read
+//
+// followed by the message. A CAN frame is stored as the can.Frame struct
+//
+//	id        uint32
+//	length    uint8
+//	flags     uint8
+//	res       [2]byte
+//	data      [8]byte
+//
+// a KW1281 measurement block as
+//
+//	group     uint8    kw1281.MeasurementGroup
+//	count     uint8    number of measurements
+//
+// followed by count measurements of
+//
+//	metric    uint8    kw1281.Metric
+//	kind      uint8    valueNone, valueInt, valueFloat or valueString
+//	value              int64, float64 or a string, absent for valueNone
+//	units     string
+//
+// and a SkyTraq navigation data message as captureNavData. A string is a
+// uint8 length followed by the bytes.
+const captureVersion uint8 = 1
+
+const captureExt = ".jcap"
+
+// records queued while the SD card is busy
+const captureQueueSize = 4096
+
+const (
+	captureCAN     uint8 = 1
+	captureKW1281  uint8 = 2
+	captureNavData uint8 = 3
+)
+
+const (
+	valueNone   uint8 = 0
+	valueInt    uint8 = 1
+	valueFloat  uint8 = 2
+	valueString uint8 = 3
+)
+
+var captureMagic = [4]byte{'J', 'C', 'A', 'P'}
+
+type captureHeader struct {
+	Type uint8
+	Time int64
+}
+
+type captureNavDataBody struct {
+	Fix            uint8
+	SatelliteCount uint8
+	Latitude       int32
+	Longitude      int32
+	Altitude       int32
+	VX             int32
+	VY             int32
+	VZ             int32
+	HDOP           int32
+}
+
+// KW1281Block is a measurement group read from the ECU.
+type KW1281Block struct {
+	Group        kw1281.MeasurementGroup
+	Measurements []*kw1281.Measurement
+}
+
+// CaptureRecord is a message read from a capture. Only the field for the
+// type of message is set.
+type CaptureRecord struct {
+	Time     time.Time
+	CANFrame *can.Frame
+	KW1281   *KW1281Block
+	NavData  *skytraq.NavData
+}
+
+// Capture writes the messages read from the sensors to a file so that
+// decoding problems can be reproduced offline. It implements
+// juicer.Capturer. Records are queued and written by a go-routine so that
+// reading the sensors is not held up by the SD card, and are dropped if the
+// queue is full. The file is synced to disk every syncInterval, so a power
+// loss only loses the records of the last interval.
+type Capture struct {
+	file    *os.File
+	w       *bufio.Writer
+	records chan []byte
+	// closed once the records are written
+	done chan struct{}
+	// set once a write fails, to stop logging the same error. Only used by
+	// the go-routine writing the records.
+	failed bool
+
+	// protects records from being sent to once closed
+	mu      sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+// NewCapture creates a capture in dir, named after the time it was created.
+func NewCapture(dir string) (*Capture, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "unable to create %s", dir)
+	}
+	file, _, err := create(dir, time.Now().Format("20060102-150405"), 0, captureExt)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create capture")
+	}
+	if err := writeFileHeader(file, captureMagic, captureVersion); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "unable to write capture %s", file.Name())
+	}
+	c := &Capture{
+		file:    file,
+		w:       bufio.NewWriter(file),
+		records: make(chan []byte, captureQueueSize),
+		done:    make(chan struct{}),
+	}
+	go c.run(syncInterval)
+	return c, nil
+}
+
+// FileName returns the name of the file being written.
+func (c *Capture) FileName() string {
+	return c.file.Name()
+}
+
+func (c *Capture) CANFrame(frame can.Frame) {
+	buf := newCaptureBuffer(captureCAN)
+	_ = binary.Write(buf, binary.LittleEndian, &frame)
+	c.write(buf.Bytes())
+}
+
+func (c *Capture) KW1281Block(group kw1281.MeasurementGroup, measurements []*kw1281.Measurement) {
+	buf := newCaptureBuffer(captureKW1281)
+	if len(measurements) > 255 {
+		measurements = measurements[:255]
+	}
+	buf.WriteByte(uint8(group))
+	buf.WriteByte(uint8(len(measurements)))
+	for _, m := range measurements {
+		writeMeasurement(buf, m)
+	}
+	c.write(buf.Bytes())
+}
+
+func (c *Capture) NavData(navData skytraq.NavData) {
+	buf := newCaptureBuffer(captureNavData)
+	_ = binary.Write(buf, binary.LittleEndian, &captureNavDataBody{
+		Fix:            uint8(navData.Fix),
+		SatelliteCount: uint8(navData.SatelliteCount),
+		Latitude:       int32(navData.Latitude),
+		Longitude:      int32(navData.Longitude),
+		Altitude:       int32(navData.Altitude),
+		VX:             int32(navData.VX),
+		VY:             int32(navData.VY),
+		VZ:             int32(navData.VZ),
+		HDOP:           int32(navData.HDOP),
+	})
+	c.write(buf.Bytes())
+}
+
+func newCaptureBuffer(typ uint8) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	// captureHeader is a fixed size, so writing it to a buffer cannot fail
+	_ = binary.Write(buf, binary.LittleEndian, &captureHeader{
+		Type: typ,
+		Time: time.Now().UnixNano(),
+	})
+	return buf
+}
+
+// write queues a record to be written by run.
+func (c *Capture) write(payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.records <- payload:
+	default:
+		if c.dropped == 0 {
+			log.Warnf("capture %s is not keeping up, dropping records", c.file.Name())
+		}
+		c.dropped++
+	}
+}
+
+// run writes the queued records until the capture is closed, syncing them to
+// disk every interval.
+func (c *Capture) run(interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case payload, ok := <-c.records:
+			if !ok {
+				return
+			}
+			c.check(writeFrame(c.w, payload))
+		case <-ticker.C:
+			c.check(c.sync())
+		}
+	}
+}
+
+func (c *Capture) check(err error) {
+	if err != nil {
+		if !c.failed {
+			log.Errorf("unable to write capture %s: %v", c.file.Name(), err)
+		}
+		c.failed = true
+		return
+	}
+	c.failed = false
+}
+
+func (c *Capture) sync() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+// Close writes the queued records and closes the file.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.records)
+	dropped := c.dropped
+	c.mu.Unlock()
+	<-c.done
+	if dropped > 0 {
+		log.Warnf("dropped %d records of capture %s", dropped, c.file.Name())
+	}
+	err := errors.Wrapf(c.sync(), "unable to write capture %s", c.file.Name())
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeMeasurement(buf *bytes.Buffer, m *kw1281.Measurement) {
+	buf.WriteByte(uint8(m.Metric))
+	if m.MeasurementValue == nil {
+		buf.WriteByte(valueNone)
+		writeString(buf, "")
+		return
+	}
+	switch v := m.Value.(type) {
+	case int:
+		buf.WriteByte(valueInt)
+		_ = binary.Write(buf, binary.LittleEndian, int64(v))
+	case float64:
+		buf.WriteByte(valueFloat)
+		_ = binary.Write(buf, binary.LittleEndian, v)
+	case string:
+		buf.WriteByte(valueString)
+		writeString(buf, v)
+	default:
+		buf.WriteByte(valueNone)
+	}
+	writeString(buf, m.Units)
+}
+
+func readMeasurement(r *bytes.Reader) (*kw1281.Measurement, error) {
+	var hdr struct {
+		Metric uint8
+		Kind   uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	m := &kw1281.Measurement{
+		Metric:           kw1281.Metric(hdr.Metric),
+		MeasurementValue: &kw1281.MeasurementValue{},
+	}
+	switch hdr.Kind {
+	case valueNone:
+	case valueInt:
+		var v int64
+		if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+			return nil, err
+		}
+		m.Value = int(v)
+	case valueFloat:
+		var v float64
+		if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+			return nil, err
+		}
+		m.Value = v
+	case valueString:
+		v, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Value = v
+	default:
+		return nil, errors.Errorf("unknown measurement value kind %d", hdr.Kind)
+	}
+	units, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	m.Units = units
+	return m, nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	buf.WriteByte(uint8(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// CaptureReader reads the messages from a capture.
+type CaptureReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+}
+
+// OpenCapture opens a capture for reading.
+func OpenCapture(fileName string) (*CaptureReader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open capture %s", fileName)
+	}
+	r, err := NewCaptureReader(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "unable to read capture %s", fileName)
+	}
+	r.closer = file
+	return r, nil
+}
+
+func NewCaptureReader(rdr io.Reader) (*CaptureReader, error) {
+	r := &CaptureReader{
+		r: bufio.NewReader(rdr),
+	}
+	if err := readFileHeader(r.r, captureMagic, captureVersion); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Next returns the next message of the capture. It returns io.EOF at the end
+// of the capture and ErrTruncated if the capture ends with a partial record.
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	payload, err := readFrame(r.r)
+	if err != nil {
+		return nil, err
+	}
+	rdr := bytes.NewReader(payload)
+	hdr := captureHeader{}
+	if err := binary.Read(rdr, binary.LittleEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "unable to read capture record header")
+	}
+	rec := &CaptureRecord{
+		Time: time.Unix(0, hdr.Time),
+	}
+	switch hdr.Type {
+	case captureCAN:
+		frame := can.Frame{}
+		err = binary.Read(rdr, binary.LittleEndian, &frame)
+		rec.CANFrame = &frame
+	case captureKW1281:
+		rec.KW1281, err = readKW1281Block(rdr)
+	case captureNavData:
+		body := captureNavDataBody{}
+		err = binary.Read(rdr, binary.LittleEndian, &body)
+		rec.NavData = &skytraq.NavData{
+			Fix:            skytraq.FixMode(body.Fix),
+			SatelliteCount: int(body.SatelliteCount),
+			Latitude:       int(body.Latitude),
+			Longitude:      int(body.Longitude),
+			Altitude:       int(body.Altitude),
+			VX:             int(body.VX),
+			VY:             int(body.VY),
+			VZ:             int(body.VZ),
+			HDOP:           int(body.HDOP),
+		}
+	default:
+		return nil, errors.Errorf("unknown capture record type %d", hdr.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read capture record")
+	}
+	return rec, nil
+}
+
+func readKW1281Block(r *bytes.Reader) (*KW1281Block, error) {
+	var hdr struct {
+		Group uint8
+		Count uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	block := &KW1281Block{
+		Group:        kw1281.MeasurementGroup(hdr.Group),
+		Measurements: make([]*kw1281.Measurement, 0, hdr.Count),
+	}
+	for i := 0; i < int(hdr.Count); i++ {
+		m, err := readMeasurement(r)
+		if err != nil {
+			return nil, err
+		}
+		block.Measurements = append(block.Measurements, m)
+	}
+	return block, nil
+}
+
+func (r *CaptureReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
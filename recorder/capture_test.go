@@ -0,0 +1,122 @@
+package recorder
+
+import (
+	"github.com/brutella/can"
+	"github.com/jd3nn1s/kw1281"
+	"github.com/jd3nn1s/skytraq"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func readCapture(t *testing.T, fileName string) ([]*CaptureRecord, error) {
+	r, err := OpenCapture(fileName)
+	assert.NoError(t, err)
+	defer r.Close()
+	var records []*CaptureRecord
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := NewCapture(dir)
+	assert.NoError(t, err)
+	start := time.Now()
+	frame := can.Frame{ID: 0x100, Length: 2, Data: [8]uint8{1, 2}}
+	c.CANFrame(frame)
+	measurements := []*kw1281.Measurement{
+		{Metric: kw1281.MetricRPM, MeasurementValue: &kw1281.MeasurementValue{Value: 850, Units: "/min"}},
+		{Metric: kw1281.MetricBatteryVoltage, MeasurementValue: &kw1281.MeasurementValue{Value: 13.8, Units: "V"}},
+		{Metric: kw1281.MetricThrottleAngle, MeasurementValue: &kw1281.MeasurementValue{Value: "idle"}},
+		{Metric: kw1281.MetricSpeed},
+	}
+	c.KW1281Block(kw1281.GroupRPMSpeedBlockNum, measurements)
+	navData := skytraq.NavData{
+		Fix:            skytraq.Fix3D,
+		SatelliteCount: 9,
+		Latitude:       514779948,
+		Longitude:      -1,
+		Altitude:       4500,
+		VX:             -120,
+		VY:             340,
+		VZ:             2,
+		HDOP:           95,
+	}
+	c.NavData(navData)
+	assert.NoError(t, c.Close())
+
+	records, err := readCapture(t, c.FileName())
+	assert.NoError(t, err)
+	if !assert.Len(t, records, 3) {
+		return
+	}
+	for _, rec := range records {
+		assert.False(t, rec.Time.Before(start.Truncate(time.Second)))
+	}
+	assert.Equal(t, &frame, records[0].CANFrame)
+	measurements[3].MeasurementValue = &kw1281.MeasurementValue{}
+	assert.Equal(t, &KW1281Block{
+		Group:        kw1281.GroupRPMSpeedBlockNum,
+		Measurements: measurements,
+	}, records[1].KW1281)
+	assert.Equal(t, &navData, records[2].NavData)
+}
+
+func TestCaptureSync(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func(interval time.Duration) { syncInterval = interval }(syncInterval)
+	syncInterval = 10 * time.Millisecond
+
+	c, err := NewCapture(dir)
+	assert.NoError(t, err)
+	defer c.Close()
+	c.CANFrame(can.Frame{ID: 0x100})
+
+	// the record is written without closing the capture
+	deadline := time.Now().Add(time.Second)
+	var records []*CaptureRecord
+	for time.Now().Before(deadline) {
+		records, _ = readCapture(t, c.FileName())
+		if len(records) == 1 {
+			break
+		}
+		time.Sleep(syncInterval)
+	}
+	assert.Len(t, records, 1)
+}
+
+func TestCaptureTruncated(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c, err := NewCapture(dir)
+	assert.NoError(t, err)
+	c.CANFrame(can.Frame{ID: 0x101})
+	c.CANFrame(can.Frame{ID: 0x102})
+	assert.NoError(t, c.Close())
+
+	info, err := os.Stat(c.FileName())
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(c.FileName(), info.Size()-1))
+	records, err := readCapture(t, c.FileName())
+	assert.Equal(t, ErrTruncated, err)
+	assert.Len(t, records, 1)
+
+	// a recording is not a capture
+	_, err = OpenCapture(record(t, dir, testTelemetry(1)))
+	assert.Error(t, err)
+}
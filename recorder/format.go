@@ -0,0 +1,225 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+)
+
+// A recording is a file header followed by records. The file header is
+//
+//	magic     [4]byte  "JREC"
+//	version   uint8    formatVersion
+//	reserved  [3]byte
+//
+// and every record is framed as
+//
+//	length    uint32   length of the payload
+//	crc       uint32   CRC-32 (IEEE) of the payload
+//	payload   [length]byte
+//
+// so that a record cut short by a power loss is detected and the records
+// before it can still be read. Every value is little-endian.
+//
+// The payload of a telemetry record is
+//
+//	type      uint8    recordKeyframe or recordDelta
+//	time      int64    Telemetry.Time
+//	monotonic int64    Telemetry.Monotonic
+//	stale     uint64   Telemetry.Stale
+//	count     uint8    number of channels
+//
+// followed by count channels of
+//
+//	tag       uint8    juicer.Channel
+//	updated   int64    unix nanoseconds, zero if the channel was never updated
+//	value     float64
+//
+// A keyframe has every channel while a delta only has the channels that
+// changed since the previous record. Every file starts with a keyframe so
+// that it can be read on its own.
+const formatVersion uint8 = 1
+
+const (
+	recordKeyframe uint8 = 1
+	recordDelta    uint8 = 2
+)
+
+const (
+	fileHeaderSize  = 8
+	frameHeaderSize = 8
+	// larger than any record, a frame claiming to be bigger is corrupt
+	maxRecordSize = 64 * 1024
+)
+
+var fileMagic = [4]byte{'J', 'R', 'E', 'C'}
+
+// ErrTruncated is returned by Reader.Next when the file ends with a partial
+// or corrupt record, such as when the power was cut during a write.
+var ErrTruncated = errors.New("recording is truncated")
+
+type fileHeader struct {
+	Magic    [4]byte
+	Version  uint8
+	Reserved [3]byte
+}
+
+type recordHeader struct {
+	Type      uint8
+	Time      int64
+	Monotonic int64
+	Stale     uint64
+	Count     uint8
+}
+
+type recordChannel struct {
+	Tag     uint8
+	Updated int64
+	Value   float64
+}
+
+func writeFileHeader(w io.Writer, magic [4]byte, version uint8) error {
+	return binary.Write(w, binary.LittleEndian, &fileHeader{
+		Magic:   magic,
+		Version: version,
+	})
+}
+
+func readFileHeader(r io.Reader, magic [4]byte, version uint8) error {
+	hdr := fileHeader{}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return errors.Wrap(err, "unable to read file header")
+	}
+	if hdr.Magic != magic {
+		return errors.Errorf("not a %s file", magic[:])
+	}
+	if hdr.Version > version {
+		return errors.Errorf("unsupported %s version %d", magic[:], hdr.Version)
+	}
+	return nil
+}
+
+// writeFrame writes a framed record in a single call so that a partial
+// write is only ever at the end of the file.
+func writeFrame(w io.Writer, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[frameHeaderSize:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a framed record, returning io.EOF at the end of the file
+// and ErrTruncated if the record is incomplete or corrupt.
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [frameHeaderSize]byte
+	if n, err := io.ReadFull(r, hdr[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrTruncated
+	}
+	length := binary.LittleEndian.Uint32(hdr[0:4])
+	if length > maxRecordSize {
+		return nil, ErrTruncated
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, ErrTruncated
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		return nil, ErrTruncated
+	}
+	return payload, nil
+}
+
+// recordEncoder encodes telemetry as the changes from the previous record.
+type recordEncoder struct {
+	prev     juicer.Telemetry
+	keyframe bool
+}
+
+func newRecordEncoder() *recordEncoder {
+	return &recordEncoder{keyframe: true}
+}
+
+func (e *recordEncoder) encode(telem *juicer.Telemetry) []byte {
+	hdr := recordHeader{
+		Type:      recordDelta,
+		Time:      telem.Time,
+		Monotonic: telem.Monotonic,
+		Stale:     uint64(telem.Stale),
+	}
+	if e.keyframe {
+		hdr.Type = recordKeyframe
+	}
+	var channels []recordChannel
+	for _, ch := range juicer.Channels() {
+		v := telem.Get(ch)
+		if !e.keyframe && telem.Updated[ch] == e.prev.Updated[ch] && v == e.prev.Get(ch) {
+			continue
+		}
+		channels = append(channels, recordChannel{
+			Tag:     uint8(ch),
+			Updated: telem.Updated[ch],
+			Value:   v,
+		})
+	}
+	hdr.Count = uint8(len(channels))
+
+	buf := &bytes.Buffer{}
+	// recordHeader and recordChannel are fixed size and the buffer grows as
+	// needed, so encoding the record cannot fail
+	_ = binary.Write(buf, binary.LittleEndian, &hdr)
+	_ = binary.Write(buf, binary.LittleEndian, channels)
+	e.prev = *telem
+	e.keyframe = false
+	return buf.Bytes()
+}
+
+// recordDecoder rebuilds telemetry from the records of a file.
+type recordDecoder struct {
+	telem    juicer.Telemetry
+	keyframe bool
+}
+
+func (d *recordDecoder) decode(payload []byte) (*juicer.Telemetry, error) {
+	rdr := bytes.NewReader(payload)
+	hdr := recordHeader{}
+	if err := binary.Read(rdr, binary.LittleEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "unable to read record header")
+	}
+	switch hdr.Type {
+	case recordKeyframe:
+		d.telem = juicer.Telemetry{}
+		d.keyframe = true
+	case recordDelta:
+		if !d.keyframe {
+			return nil, errors.New("delta record before the first keyframe")
+		}
+	default:
+		return nil, errors.Errorf("unknown record type %d", hdr.Type)
+	}
+	channels := make([]recordChannel, hdr.Count)
+	if err := binary.Read(rdr, binary.LittleEndian, channels); err != nil {
+		return nil, errors.Wrap(err, "unable to read record channels")
+	}
+	d.telem.Time = hdr.Time
+	d.telem.Monotonic = hdr.Monotonic
+	d.telem.Stale = juicer.ChannelSet(hdr.Stale)
+	for _, c := range channels {
+		ch := juicer.Channel(c.Tag)
+		// recorded by a newer juicer
+		if !ch.Valid() {
+			continue
+		}
+		d.telem.Set(ch, c.Value)
+		d.telem.Updated[ch] = c.Updated
+	}
+	telem := d.telem
+	return &telem, nil
+}
@@ -0,0 +1,118 @@
+package recorder
+
+import (
+	"bufio"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Reader reads the telemetry from a recording.
+type Reader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	dec    recordDecoder
+	// bytes of the file header and complete records read
+	offset int64
+}
+
+// Open opens a recording for reading.
+func Open(fileName string) (*Reader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open recording %s", fileName)
+	}
+	r, err := NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "unable to read recording %s", fileName)
+	}
+	r.closer = file
+	return r, nil
+}
+
+func NewReader(rdr io.Reader) (*Reader, error) {
+	r := &Reader{
+		r: bufio.NewReader(rdr),
+	}
+	if err := readFileHeader(r.r, fileMagic, formatVersion); err != nil {
+		return nil, err
+	}
+	r.offset = fileHeaderSize
+	return r, nil
+}
+
+// Next returns the next telemetry of the recording. It returns io.EOF at the
+// end of the recording and ErrTruncated if the recording ends with a partial
+// record.
+func (r *Reader) Next() (*juicer.Telemetry, error) {
+	payload, err := readFrame(r.r)
+	if err != nil {
+		return nil, err
+	}
+	telem, err := r.dec.decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	r.offset += int64(frameHeaderSize + len(payload))
+	return telem, nil
+}
+
+// Offset returns the size of the file header and records read so far.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// Recover truncates a recording after its last complete record and returns
+// the number of bytes removed. A recording without a complete file header is
+// removed.
+func Recover(fileName string) (int64, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to stat recording %s", fileName)
+	}
+	if info.Size() < fileHeaderSize {
+		return info.Size(), os.Remove(fileName)
+	}
+	r, err := Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	for {
+		_, err = r.Next()
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != ErrTruncated {
+		return 0, errors.Wrapf(err, "unable to read recording %s", fileName)
+	}
+	if err := os.Truncate(fileName, r.Offset()); err != nil {
+		return 0, errors.Wrapf(err, "unable to truncate recording %s", fileName)
+	}
+	return info.Size() - r.Offset(), nil
+}
+
+// Files returns the recordings in dir, oldest first.
+func Files(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+fileExt))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list recordings in %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
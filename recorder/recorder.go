@@ -0,0 +1,251 @@
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileExt = ".jrec"
+	// telemetry queued while the SD card is busy
+	queueSize = 1024
+)
+
+var syncInterval = time.Second
+var defaultMaxSize int64 = 64 * 1024 * 1024
+
+type Config struct {
+	// directory the recordings are written to
+	Dir string
+	// size in bytes at which a new file is started, zero for no limit
+	MaxSize int64
+	// interval between writing buffered records to disk
+	SyncInterval juicer.Duration
+}
+
+// Recorder is a forwarder that appends every telemetry update to a
+// recording. A new file is started for each session, named after a number
+// that increases with every session and the time the recorder was created,
+// and whenever a file reaches MaxSize. The names sort in the order the files
+// were written even when the clock of a car without a real-time clock goes
+// backwards. Records are
+// buffered and synced to disk every SyncInterval, a record cut short by a
+// power loss is removed by Recover the next time the recorder is created.
+type Recorder struct {
+	Config *Config
+
+	mu      sync.Mutex
+	session string
+	part    int
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	enc     *recordEncoder
+	// records written since the last sync
+	pending int
+}
+
+// NewFromConfig creates a recorder from a [[forwarder]] entry of the juicer
+// configuration.
+func NewFromConfig(fc juicer.ForwarderConfig) (*Recorder, error) {
+	config := defaultConfig()
+	if err := fc.Decode(&config); err != nil {
+		return nil, errors.Wrap(err, "unable to load recorder configuration")
+	}
+	return New(config)
+}
+
+func defaultConfig() Config {
+	return Config{
+		MaxSize:      defaultMaxSize,
+		SyncInterval: juicer.Duration{Duration: syncInterval},
+	}
+}
+
+func New(config Config) (*Recorder, error) {
+	if config.Dir == "" {
+		return nil, errors.New("recorder has no dir")
+	}
+	if config.SyncInterval.Duration <= 0 {
+		return nil, errors.New("recorder needs a syncInterval")
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "unable to create %s", config.Dir)
+	}
+	// only the last recording can have been cut short
+	files, err := Files(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		n, err := Recover(last)
+		if err != nil {
+			log.Warnf("unable to recover %s: %v", last, err)
+		} else if n > 0 {
+			log.Warnf("removed %d bytes of partial records from %s", n, last)
+		}
+	}
+
+	rec := &Recorder{
+		Config: &config,
+		session: fmt.Sprintf("%06d-%s", nextSession(files),
+			time.Now().Format("20060102-150405")),
+	}
+	if err := rec.open(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// nextSession returns the number of the session after the latest of the
+// recordings in files.
+func nextSession(files []string) int {
+	next := 1
+	for _, fileName := range files {
+		prefix := strings.SplitN(filepath.Base(fileName), "-", 2)[0]
+		if n, err := strconv.Atoi(prefix); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	return next
+}
+
+// FileName returns the name of the file being written.
+func (rec *Recorder) FileName() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.file.Name()
+}
+
+func (rec *Recorder) open() error {
+	file, part, err := create(rec.Config.Dir, rec.session, rec.part, fileExt)
+	if err != nil {
+		return errors.Wrap(err, "unable to create recording")
+	}
+	fileName := file.Name()
+	rec.part = part
+	rec.file = file
+	rec.w = bufio.NewWriter(file)
+	rec.enc = newRecordEncoder()
+	rec.size = fileHeaderSize
+	err = writeFileHeader(rec.w, fileMagic, formatVersion)
+	if err == nil {
+		err = rec.w.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "unable to write recording %s", fileName)
+	}
+	return nil
+}
+
+// create creates the file for part of a session, moving on to the next part
+// if it already exists, such as when a session started within the same
+// second.
+func create(dir, session string, part int, ext string) (*os.File, int, error) {
+	for {
+		fileName := filepath.Join(dir, fmt.Sprintf("%s-%03d%s", session, part, ext))
+		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			part++
+			continue
+		}
+		return file, part, err
+	}
+}
+
+// ForwarderOptions queues telemetry so that updates are not lost while the
+// file is synced.
+func (rec *Recorder) ForwarderOptions() juicer.ForwarderOptions {
+	opts := juicer.DefaultForwarderOptions()
+	opts.QueueSize = queueSize
+	return opts
+}
+
+func (rec *Recorder) Forward(newTelemetry *juicer.Telemetry, prevTelemetry *juicer.Telemetry) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	payload := rec.enc.encode(newTelemetry)
+	frameSize := int64(frameHeaderSize + len(payload))
+	if rec.Config.MaxSize > 0 && rec.size > fileHeaderSize &&
+		rec.size+frameSize > rec.Config.MaxSize {
+		if err := rec.rotate(); err != nil {
+			return err
+		}
+		payload = rec.enc.encode(newTelemetry)
+		frameSize = int64(frameHeaderSize + len(payload))
+	}
+	if err := writeFrame(rec.w, payload); err != nil {
+		return errors.Wrap(err, "unable to write record")
+	}
+	rec.size += frameSize
+	rec.pending++
+	return nil
+}
+
+func (rec *Recorder) rotate() error {
+	if _, err := rec.sync(); err != nil {
+		return err
+	}
+	if err := rec.file.Close(); err != nil {
+		return errors.Wrapf(err, "unable to close recording %s", rec.file.Name())
+	}
+	rec.part++
+	return rec.open()
+}
+
+// Start syncs the recording to disk every SyncInterval until ctx is done.
+func (rec *Recorder) Start(ctx context.Context) error {
+	ticker := time.NewTicker(rec.Config.SyncInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if _, err := rec.Flush(); err != nil {
+				log.Error("unable to sync recording ", err)
+			}
+		}
+	}
+}
+
+// Flush writes the buffered records to disk and returns how many there were.
+func (rec *Recorder) Flush() (int, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.sync()
+}
+
+func (rec *Recorder) sync() (int, error) {
+	if err := rec.w.Flush(); err != nil {
+		return 0, errors.Wrapf(err, "unable to write recording %s", rec.file.Name())
+	}
+	if err := rec.file.Sync(); err != nil {
+		return 0, errors.Wrapf(err, "unable to sync recording %s", rec.file.Name())
+	}
+	n := rec.pending
+	rec.pending = 0
+	return n, nil
+}
+
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	_, err := rec.sync()
+	if closeErr := rec.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
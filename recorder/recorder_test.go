@@ -0,0 +1,233 @@
+package recorder
+
+import (
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "recorder")
+	assert.NoError(t, err)
+	return dir
+}
+
+func testConfig(dir string) Config {
+	return Config{
+		Dir:          dir,
+		SyncInterval: juicer.Duration{Duration: time.Second},
+	}
+}
+
+func testTelemetry(n int) []juicer.Telemetry {
+	telems := make([]juicer.Telemetry, n)
+	var telem juicer.Telemetry
+	for i := range telems {
+		telem.Time = int64(i+1) * int64(time.Second)
+		telem.Monotonic = int64(i + 1)
+		telem.RPM = float32(1000 + i)
+		telem.Updated[juicer.ChannelRPM] = telem.Time
+		if i%2 == 0 {
+			telem.Latitude = 51 + float64(i)/1e6
+			telem.Updated[juicer.ChannelLatitude] = telem.Time
+		}
+		telem.Stale = 0
+		telem.Stale.Add(juicer.ChannelOilTemp)
+		telems[i] = telem
+	}
+	return telems
+}
+
+func readAll(t *testing.T, fileName string) ([]juicer.Telemetry, error) {
+	r, err := Open(fileName)
+	assert.NoError(t, err)
+	defer r.Close()
+	var telems []juicer.Telemetry
+	for {
+		telem, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return telems, err
+		}
+		telems = append(telems, *telem)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rec, err := New(testConfig(dir))
+	assert.NoError(t, err)
+	telems := testTelemetry(10)
+	for i := range telems {
+		assert.NoError(t, rec.Forward(&telems[i], &juicer.Telemetry{}))
+	}
+	n, err := rec.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.NoError(t, rec.Close())
+
+	files, err := Files(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{rec.FileName()}, files)
+	recorded, err := readAll(t, files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, telems, recorded)
+}
+
+func TestRecorderRotate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := testConfig(dir)
+	config.MaxSize = 500
+	rec, err := New(config)
+	assert.NoError(t, err)
+	telems := testTelemetry(10)
+	for i := range telems {
+		assert.NoError(t, rec.Forward(&telems[i], &juicer.Telemetry{}))
+	}
+	assert.NoError(t, rec.Close())
+
+	files, err := Files(dir)
+	assert.NoError(t, err)
+	assert.True(t, len(files) > 1)
+	var recorded []juicer.Telemetry
+	for _, fileName := range files {
+		info, err := os.Stat(fileName)
+		assert.NoError(t, err)
+		assert.True(t, info.Size() <= 500)
+		// each file starts with a keyframe so can be read on its own
+		records, err := readAll(t, fileName)
+		assert.NoError(t, err)
+		recorded = append(recorded, records...)
+	}
+	assert.Equal(t, telems, recorded)
+
+	// a second session in the same second does not overwrite the first
+	rec, err = New(testConfig(dir))
+	assert.NoError(t, err)
+	assert.NoError(t, rec.Close())
+	newFiles, err := Files(dir)
+	assert.NoError(t, err)
+	assert.Len(t, newFiles, len(files)+1)
+
+	_, err = New(Config{Dir: dir})
+	assert.Error(t, err, "no syncInterval")
+}
+
+func TestRecover(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a session recorded while the clock was ahead is still older
+	rec, err := New(testConfig(dir))
+	assert.NoError(t, err)
+	assert.NoError(t, rec.Close())
+	assert.NoError(t, os.Rename(rec.FileName(),
+		filepath.Join(dir, "000001-29991231-235959-000"+fileExt)))
+
+	rec, err = New(testConfig(dir))
+	assert.NoError(t, err)
+	assert.Equal(t, "000002-", filepath.Base(rec.FileName())[:7])
+	telems := testTelemetry(5)
+	for i := range telems {
+		assert.NoError(t, rec.Forward(&telems[i], &juicer.Telemetry{}))
+	}
+	assert.NoError(t, rec.Close())
+	fileName := rec.FileName()
+	info, err := os.Stat(fileName)
+	assert.NoError(t, err)
+
+	// power cut part way through writing a record
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{40, 0, 0, 0, 1, 2, 3, 4, 1, 2})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	recorded, err := readAll(t, fileName)
+	assert.Equal(t, ErrTruncated, err)
+	assert.Equal(t, telems, recorded)
+
+	// recovered when the next session starts
+	rec, err = New(testConfig(dir))
+	assert.NoError(t, err)
+	assert.NoError(t, rec.Close())
+	recovered, err := os.Stat(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), recovered.Size())
+	recorded, err = readAll(t, fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, telems, recorded)
+
+	n, err := Recover(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestRecoverCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rec, err := New(testConfig(dir))
+	assert.NoError(t, err)
+	telems := testTelemetry(3)
+	for i := range telems {
+		assert.NoError(t, rec.Forward(&telems[i], &juicer.Telemetry{}))
+	}
+	assert.NoError(t, rec.Close())
+	fileName := rec.FileName()
+
+	// corrupt the last byte of the last record
+	data, err := ioutil.ReadFile(fileName)
+	assert.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(fileName, data, 0644))
+
+	n, err := Recover(fileName)
+	assert.NoError(t, err)
+	assert.True(t, n > 0)
+	recorded, err := readAll(t, fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, telems[:2], recorded)
+}
+
+func TestRecorderStart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := testConfig(dir)
+	config.SyncInterval = juicer.Duration{Duration: time.Millisecond}
+	rec, err := New(config)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- rec.Start(ctx)
+	}()
+
+	telems := testTelemetry(1)
+	assert.NoError(t, rec.Forward(&telems[0], &juicer.Telemetry{}))
+	// synced without a call to Flush
+	var recorded []juicer.Telemetry
+	for start := time.Now(); len(recorded) == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+		recorded, err = readAll(t, rec.FileName())
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, telems, recorded)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.NoError(t, rec.Close())
+}
@@ -0,0 +1,234 @@
+package recorder
+
+import (
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sort"
+	"time"
+)
+
+const replayName = "replay"
+
+// longest a replay waits for the next recorded update before it sends an
+// empty one to keep the juicer's update clock following the recording
+var replayClockInterval = 100 * time.Millisecond
+
+// Replay is a source that plays back recordings through the juicer. The
+// recorded channel values are sent as updates from the sources that first
+// sent them, paced by the times they were updated, so that forwarders, lap
+// timing and alarms see the session as it happened. The recorded staleness
+// is not replayed, the juicer works it out from the update times. They follow
+// the recording rather than the wall clock, so the juicer must be given
+// SetUpdateClock.
+type Replay struct {
+	juicer.UpdateSender
+
+	// recordings played back in order
+	FileNames []string
+	// 1 plays back at the recorded rate, 2 twice as fast and zero as fast as
+	// possible
+	Speed float64
+	// recorded times are shifted so that the replay starts at StartTime, the
+	// zero time keeps the recorded times
+	StartTime time.Time
+	// send the recorded lap timer channels, false when the lap timer is
+	// running so that the laps are timed again
+	LapTimer bool
+
+	done chan struct{}
+	// update times of the channels sent
+	updated juicer.Telemetry
+	// recorded time of the first update and when it was sent
+	first   time.Time
+	started time.Time
+	// time of the last update sent
+	last time.Time
+}
+
+func NewReplay(fileNames ...string) *Replay {
+	return &Replay{
+		FileNames: fileNames,
+		Speed:     1,
+		done:      make(chan struct{}),
+	}
+}
+
+func (rp *Replay) Name() string {
+	return replayName
+}
+
+func (rp *Replay) Open() error {
+	return nil
+}
+
+func (rp *Replay) Close() error {
+	return nil
+}
+
+// Done is closed once the recordings have been played back and the juicer
+// has finished with them, or could not be.
+func (rp *Replay) Done() <-chan struct{} {
+	return rp.done
+}
+
+// Start plays back the recordings then waits for ctx to be done so that they
+// are only played once.
+func (rp *Replay) Start(ctx context.Context) error {
+	select {
+	case <-rp.done:
+		<-ctx.Done()
+		return ctx.Err()
+	default:
+	}
+	err := rp.play(ctx)
+	if err != nil && err == ctx.Err() {
+		return err
+	}
+	close(rp.done)
+	if err != nil {
+		return err
+	}
+	log.Infof("replayed %d recordings", len(rp.FileNames))
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (rp *Replay) play(ctx context.Context) error {
+	for _, fileName := range rp.FileNames {
+		if err := rp.playFile(ctx, fileName); err != nil {
+			return err
+		}
+	}
+	// the juicer merges updates in order, so once it has merged an empty
+	// update and its forwarders are idle it has finished with the recorded
+	// ones
+	merged := make(chan struct{})
+	err := rp.SendContext(ctx, juicer.Update{Source: replayName, Time: rp.last, Merged: merged})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-merged:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rp *Replay) playFile(ctx context.Context, fileName string) error {
+	r, err := Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		telem, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == ErrTruncated {
+			log.Warnf("%s ends with a partial record", fileName)
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "unable to read recording %s", fileName)
+		}
+		for _, update := range rp.updates(telem) {
+			if err := rp.send(ctx, update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// updates returns the channels updated since the previous record, grouped
+// into an update for each source and update time.
+func (rp *Replay) updates(telem *juicer.Telemetry) []juicer.Update {
+	var updates []juicer.Update
+	for _, ch := range juicer.Channels() {
+		at := telem.Updated[ch]
+		if at == 0 || at == rp.updated.Updated[ch] {
+			continue
+		}
+		rp.updated.Updated[ch] = at
+		source := ch.Source()
+		if source == juicer.ChannelLap.Source() && !rp.LapTimer {
+			continue
+		}
+		value := juicer.ChannelValue{Channel: ch, Value: telem.Get(ch)}
+		i := 0
+		for ; i < len(updates); i++ {
+			if updates[i].Source == source && updates[i].Time.UnixNano() == at {
+				break
+			}
+		}
+		if i == len(updates) {
+			updates = append(updates, juicer.Update{
+				Source: source,
+				Time:   time.Unix(0, at),
+			})
+		}
+		updates[i].Values = append(updates[i].Values, value)
+	}
+	sort.SliceStable(updates, func(i, j int) bool {
+		return updates[i].Time.Before(updates[j].Time)
+	})
+	return updates
+}
+
+func (rp *Replay) send(ctx context.Context, update juicer.Update) error {
+	if rp.first.IsZero() {
+		rp.first = update.Time
+		rp.started = time.Now()
+	}
+	if rp.Speed > 0 {
+		elapsed := time.Duration(float64(update.Time.Sub(rp.first)) / rp.Speed)
+		if err := rp.waitUntil(ctx, rp.started.Add(elapsed)); err != nil {
+			return err
+		}
+	}
+	update.Time = rp.shift(update.Time)
+	rp.last = update.Time
+	return rp.SendContext(ctx, update)
+}
+
+// waitUntil waits for the time an update is due, sending empty updates with
+// the recorded time reached every replayClockInterval so that channels become
+// stale during a gap in the recording.
+func (rp *Replay) waitUntil(ctx context.Context, due time.Time) error {
+	for {
+		wait := time.Until(due)
+		if wait <= 0 {
+			return nil
+		}
+		if wait > replayClockInterval {
+			wait = replayClockInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		if time.Until(due) <= 0 {
+			return nil
+		}
+		elapsed := time.Duration(float64(time.Since(rp.started)) * rp.Speed)
+		update := juicer.Update{Source: replayName, Time: rp.shift(rp.first.Add(elapsed))}
+		if err := rp.SendContext(ctx, update); err != nil {
+			return err
+		}
+	}
+}
+
+// shift returns a recorded time as it is replayed, starting at StartTime.
+func (rp *Replay) shift(t time.Time) time.Time {
+	if rp.StartTime.IsZero() {
+		return t
+	}
+	return rp.StartTime.Add(t.Sub(rp.first))
+}
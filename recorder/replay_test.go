@@ -0,0 +1,247 @@
+package recorder
+
+import (
+	"context"
+	"github.com/jd3nn1s/juicer"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func record(t *testing.T, dir string, telems []juicer.Telemetry) string {
+	rec, err := New(testConfig(dir))
+	assert.NoError(t, err)
+	for i := range telems {
+		assert.NoError(t, rec.Forward(&telems[i], &juicer.Telemetry{}))
+	}
+	assert.NoError(t, rec.Close())
+	return rec.FileName()
+}
+
+func replayAll(t *testing.T, rp *Replay) []juicer.Update {
+	updateChan := make(chan juicer.Update)
+	rp.SetUpdateChan(updateChan)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- rp.Start(ctx)
+	}()
+	var updates []juicer.Update
+	for {
+		select {
+		case update := <-updateChan:
+			// the empty update that ends the replay
+			if update.Merged != nil {
+				close(update.Merged)
+			}
+			if len(update.Values) > 0 {
+				updates = append(updates, update)
+			}
+			continue
+		case <-rp.Done():
+		}
+		break
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	return updates
+}
+
+func TestReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	telems := testTelemetry(4)
+	fileName := record(t, dir, telems)
+
+	rp := NewReplay(fileName)
+	rp.Speed = 0
+	updates := replayAll(t, rp)
+	assert.Equal(t, []juicer.Update{
+		{Source: "ecu", Time: time.Unix(1, 0), Values: []juicer.ChannelValue{{Channel: juicer.ChannelRPM, Value: 1000}}},
+		{Source: "gps", Time: time.Unix(1, 0), Values: []juicer.ChannelValue{{Channel: juicer.ChannelLatitude, Value: 51}}},
+		{Source: "ecu", Time: time.Unix(2, 0), Values: []juicer.ChannelValue{{Channel: juicer.ChannelRPM, Value: 1001}}},
+		{Source: "ecu", Time: time.Unix(3, 0), Values: []juicer.ChannelValue{{Channel: juicer.ChannelRPM, Value: 1002}}},
+		{Source: "gps", Time: time.Unix(3, 0), Values: []juicer.ChannelValue{{Channel: juicer.ChannelLatitude, Value: 51.000002}}},
+		{Source: "ecu", Time: time.Unix(4, 0), Values: []juicer.ChannelValue{{Channel: juicer.ChannelRPM, Value: 1003}}},
+	}, updates)
+
+	// a second start does not replay the recording again
+	updates = replayAll(t, rp)
+	assert.Empty(t, updates)
+}
+
+func TestReplayTiming(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	telems := testTelemetry(3)
+	telems[2].Lap = 2
+	telems[2].Updated[juicer.ChannelLap] = telems[2].Time
+	fileName := record(t, dir, telems)
+
+	start := time.Unix(1000, 0)
+	rp := NewReplay(fileName)
+	rp.Speed = 100
+	rp.StartTime = start
+	began := time.Now()
+	updates := replayAll(t, rp)
+	// two seconds of recording at 100 times the speed
+	assert.True(t, time.Since(began) >= 20*time.Millisecond)
+	assert.Len(t, updates, 5)
+	assert.Equal(t, start, updates[0].Time)
+	assert.Equal(t, start.Add(2*time.Second), updates[4].Time)
+	for _, update := range updates {
+		assert.NotEqual(t, "laptimer", update.Source)
+	}
+
+	rp = NewReplay(fileName)
+	rp.Speed = 0
+	rp.LapTimer = true
+	updates = replayAll(t, rp)
+	assert.Len(t, updates, 6)
+	assert.Equal(t, juicer.Update{
+		Source: "laptimer",
+		Time:   time.Unix(3, 0),
+		Values: []juicer.ChannelValue{{Channel: juicer.ChannelLap, Value: 2}},
+	}, updates[5])
+}
+
+type captureForwarder struct {
+	// how long each telemetry takes to forward
+	delay time.Duration
+
+	mu     sync.Mutex
+	telems []juicer.Telemetry
+}
+
+func (c *captureForwarder) Forward(newTelemetry *juicer.Telemetry, prevTelemetry *juicer.Telemetry) error {
+	time.Sleep(c.delay)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.telems = append(c.telems, *newTelemetry)
+	return nil
+}
+
+// replayJuicer runs the juicer until its replay is done.
+func replayJuicer(t *testing.T, jc *juicer.Juicer, rp *Replay) {
+	ctx, cancel := context.WithCancel(context.Background())
+	jc.Start(ctx)
+	go func() {
+		<-rp.Done()
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, jc.Run(ctx))
+}
+
+func TestReplayJuicer(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	telems := testTelemetry(50)
+	fileName := record(t, dir, telems)
+
+	config := juicer.DefaultConfig()
+	config.ECU.Enabled = false
+	config.GPS.Enabled = false
+	config.CANBus.Enabled = false
+	jc := juicer.NewJuicerFromConfig(config)
+	rp := NewReplay(fileName)
+	rp.Speed = 0
+	jc.AddSource(rp)
+	capture := &captureForwarder{}
+	jc.AddForwarderWithOptions(capture, juicer.ForwarderOptions{QueueSize: 1})
+	jc.SetOverflowPolicy(juicer.Block)
+	jc.SetUpdateClock(true)
+
+	replayJuicer(t, jc, rp)
+
+	// every recorded value reaches the forwarder
+	var rpm []float32
+	for _, telem := range capture.telems {
+		if len(rpm) == 0 || rpm[len(rpm)-1] != telem.RPM {
+			rpm = append(rpm, telem.RPM)
+		}
+	}
+	assert.Len(t, rpm, len(telems))
+	last := capture.telems[len(capture.telems)-1]
+	assert.Equal(t, telems[49].Updated, last.Updated)
+	assert.Equal(t, telems[48].Latitude, last.Latitude)
+}
+
+func TestReplaySlowForwarder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	telems := testTelemetry(20)
+	fileName := record(t, dir, telems)
+
+	config := juicer.DefaultConfig()
+	config.ECU.Enabled = false
+	config.GPS.Enabled = false
+	config.CANBus.Enabled = false
+	jc := juicer.NewJuicerFromConfig(config)
+	rp := NewReplay(fileName)
+	rp.Speed = 0
+	jc.AddSource(rp)
+	capture := &captureForwarder{delay: 5 * time.Millisecond}
+	jc.AddForwarderWithOptions(capture, juicer.ForwarderOptions{QueueSize: 1})
+	jc.SetOverflowPolicy(juicer.Block)
+	jc.SetUpdateClock(true)
+	replayJuicer(t, jc, rp)
+
+	// the replay is only done once the last record has been forwarded
+	last := capture.telems[len(capture.telems)-1]
+	assert.Equal(t, telems[19].RPM, last.RPM)
+	assert.Equal(t, telems[19].Updated, last.Updated)
+	assert.Zero(t, jc.ForwarderStats()[0].Dropped)
+}
+
+func TestReplayStale(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// the GPS stops after 40ms of the recording
+	start := time.Unix(1000, 0).UnixNano()
+	telems := make([]juicer.Telemetry, 20)
+	for i := range telems {
+		if i > 0 {
+			telems[i] = telems[i-1]
+		}
+		telems[i].Time = start + int64(i)*int64(10*time.Millisecond)
+		telems[i].RPM = float32(1000 + i)
+		telems[i].Updated[juicer.ChannelRPM] = telems[i].Time
+		if i < 5 {
+			telems[i].Latitude = 51 + float64(i)/1e6
+			telems[i].Updated[juicer.ChannelLatitude] = telems[i].Time
+		}
+	}
+	fileName := record(t, dir, telems)
+
+	for _, speed := range []float64{0.5, 0} {
+		config := juicer.DefaultConfig()
+		config.ECU.Enabled = false
+		config.GPS.Enabled = false
+		config.CANBus.Enabled = false
+		jc := juicer.NewJuicerFromConfig(config)
+		jc.SetStaleTimeout("ecu", 30*time.Millisecond)
+		jc.SetStaleTimeout("gps", 30*time.Millisecond)
+		rp := NewReplay(fileName)
+		rp.Speed = speed
+		rp.StartTime = time.Now()
+		jc.AddSource(rp)
+		capture := &captureForwarder{}
+		jc.AddForwarderWithOptions(capture, juicer.ForwarderOptions{QueueSize: 1})
+		jc.SetOverflowPolicy(juicer.Block)
+		jc.SetUpdateClock(true)
+		replayJuicer(t, jc, rp)
+
+		// the ECU is updated throughout and never stale, the GPS is once it
+		// has stopped for longer than its timeout of the recording
+		for _, telem := range capture.telems {
+			if telem.RPM != 0 {
+				assert.False(t, telem.Stale.Has(juicer.ChannelRPM), "speed %v", speed)
+			}
+		}
+		last := capture.telems[len(capture.telems)-1]
+		assert.Equal(t, telems[19].RPM, last.RPM, "speed %v", speed)
+		assert.True(t, last.Stale.Has(juicer.ChannelLatitude), "speed %v", speed)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"time"
 )
 
-var retrySleep = time.Second
+var defaultRetrySleep = time.Second
 
 type Retryable interface {
 	Open() error
@@ -16,27 +16,40 @@ type Retryable interface {
 	Name() string
 }
 
-func retry(ctx context.Context, r Retryable) error {
+// retry opens and starts r until ctx is done, closing and reopening it
+// whenever it fails. The outcomes are recorded in health, which may be nil.
+func retry(ctx context.Context, r Retryable, retrySleep time.Duration, health *Health) error {
 	errStarting := errors.New("starting")
 	err := errStarting
+	defer health.stopped(r.Name())
 	for {
 		select {
 		case <-ctx.Done():
+			if err := r.Close(); err != nil {
+				log.WithField("err", err).Warnf("%s: unable to close", r.Name())
+			}
 			return ctx.Err()
 		default:
 		}
 		if err != nil {
 			if err != errStarting {
+				health.failed(r.Name(), err)
 				log.WithField("err", err).Errorf("%s: reconnecting due to error", r.Name())
 				if err = r.Close(); err != nil {
 					log.WithField("err", err).Warnf("%s: unable to close", r.Name())
 				}
-				time.Sleep(retrySleep)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(retrySleep):
+				}
 			}
+			health.connecting(r.Name())
 			err = r.Open()
 			if err != nil {
 				continue
 			}
+			health.connected(r.Name())
 		}
 		err = r.Start(ctx)
 	}
@@ -8,14 +8,6 @@ import (
 	"testing"
 )
 
-func noDelays() func() {
-	origRetrySleep := retrySleep
-	retrySleep = 0
-	return func() {
-		retrySleep = origRetrySleep
-	}
-}
-
 type retryable struct {
 	open        bool
 	hasClosed   bool
@@ -50,7 +42,6 @@ func (r *retryable) Name() string {
 }
 
 func TestRetry(t *testing.T) {
-	defer noDelays()()
 	r := retryable{
 		startedChan: make(chan struct{}),
 		stopChan:    make(chan error),
@@ -60,7 +51,7 @@ func TestRetry(t *testing.T) {
 	wg.Add(1)
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		_ = retry(ctx, &r)
+		_ = retry(ctx, &r, 0, nil)
 		wg.Done()
 	}()
 	// wait for start to be called
@@ -79,6 +70,9 @@ func TestRetry(t *testing.T) {
 	assert.True(t, r.hasClosed)
 	assert.True(t, r.open)
 
+	// should be closed when the context is done
+	r.hasClosed = false
 	cancel()
 	wg.Wait()
+	assert.True(t, r.hasClosed)
 }
@@ -0,0 +1,52 @@
+package juicer
+
+import (
+	"context"
+	"time"
+)
+
+// Update is a set of channel values sent by a Source.
+type Update struct {
+	Source string
+	// when the values were read, set by Send if zero
+	Time   time.Time
+	Values []ChannelValue
+	// closed by Juicer.Run once the update is merged and the forwarders have
+	// finished with the telemetry, including any updates they sent in turn
+	Merged chan struct{}
+}
+
+// UpdateSender can be embedded in a Source to implement SetUpdateChan.
+type UpdateSender struct {
+	updateChan chan<- Update
+}
+
+func (s *UpdateSender) SetUpdateChan(updateChan chan<- Update) {
+	s.updateChan = updateChan
+}
+
+// Send sends an update to the juicer. The update is dropped if the juicer
+// is busy as the source is expected to send a newer one soon.
+func (s *UpdateSender) Send(update Update) {
+	if update.Time.IsZero() {
+		update.Time = time.Now()
+	}
+	select {
+	case s.updateChan <- update:
+	default:
+	}
+}
+
+// SendContext sends an update to the juicer, waiting until it has room or
+// ctx is done. It is used by sources that must not drop updates.
+func (s *UpdateSender) SendContext(ctx context.Context, update Update) error {
+	if update.Time.IsZero() {
+		update.Time = time.Now()
+	}
+	select {
+	case s.updateChan <- update:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
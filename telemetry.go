@@ -1,5 +1,9 @@
 package juicer
 
+import (
+	"math"
+)
+
 type gpsData struct {
 	Latitude  int
 	Longitude int
@@ -25,6 +29,37 @@ type canSensorData struct {
 	OilTemp       int
 }
 
+func (data gpsData) values() []ChannelValue {
+	return []ChannelValue{
+		{ChannelLatitude, float64(data.Latitude) / math.Pow(10, 7)},
+		{ChannelLongitude, float64(data.Longitude) / math.Pow(10, 7)},
+		{ChannelAltitude, float64(data.Altitude) / 100.0},
+		{ChannelTrack, data.Track},
+		{ChannelGPSSpeed, data.Speed},
+	}
+}
+
+// coolant temperature is provided by the CAN bus sensor rather than the ECU
+func (data ecuData) values() []ChannelValue {
+	return []ChannelValue{
+		{ChannelGasPedalAngle, float64(data.GasPedalAngle)},
+		{ChannelRPM, float64(data.RPM)},
+		{ChannelOilPressure, float64(data.OilPressure)},
+		{ChannelSpeed, float64(data.Speed)},
+		{ChannelAirIntakeTemp, float64(data.AirIntakeTemp)},
+		{ChannelBatteryVoltage, float64(data.BatteryVoltage)},
+	}
+}
+
+func (data canSensorData) values() []ChannelValue {
+	return []ChannelValue{
+		{ChannelFuelRemaining, float64(data.FuelRemaining)},
+		{ChannelFuelLevel, float64(data.FuelLevel)},
+		{ChannelCoolantTemp, float64(data.CoolantTemp)},
+		{ChannelOilTemp, float64(data.OilTemp)},
+	}
+}
+
 type Telemetry struct {
 	RPM         float32
 	OilPressure float32
@@ -44,4 +79,36 @@ type Telemetry struct {
 	Track         float32
 	GPSSpeed      float32
 	GasPedalAngle uint8
+
+	// laps started, zero before the start/finish line is first crossed
+	Lap uint16
+	// in seconds, zero until a lap has been completed
+	LastLapTime float32
+	BestLapTime float32
+	// current sector, starting at 1, and the time of the last sector
+	// completed in seconds
+	Sector         uint8
+	LastSectorTime float32
+	// predictive delta to the best lap in seconds, negative when the
+	// current lap is faster
+	Delta float32
+
+	// quality of the link to the pit, measured by the forwarder sending
+	// telemetry to it: percentage of the recent packets lost, and the
+	// smoothed round trip time and its jitter in milliseconds
+	LinkLoss   float32
+	LinkRTT    float32
+	LinkJitter float32
+
+	// Time is when a source last updated the telemetry, in unix nanoseconds.
+	Time int64
+	// Monotonic is Time in nanoseconds since the juicer was created. Unlike
+	// Time it is not affected by changes to the wall clock.
+	Monotonic int64
+	// Updated is when each channel was last updated, in unix nanoseconds,
+	// indexed by Channel.
+	Updated [maxChannel + 1]int64
+	// Stale is the set of channels that have never been updated or that have
+	// not been updated within the stale timeout of their source.
+	Stale ChannelSet
 }
@@ -10,7 +10,7 @@ func (jc *Juicer) runTestMode(ctx context.Context) {
 	ecu := ecuData{}
 	can := canSensorData{}
 
-	go func() {
+	jc.goRun(func() {
 		down := false
 		for {
 			select {
@@ -18,7 +18,11 @@ func (jc *Juicer) runTestMode(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			}
-			jc.gpsChan <- gps
+			select {
+			case jc.updateChan <- Update{Source: "gps", Values: gps.values()}:
+			case <-ctx.Done():
+				return
+			}
 
 			if down {
 				gps.Speed -= 0.01
@@ -36,9 +40,9 @@ func (jc *Juicer) runTestMode(ctx context.Context) {
 				down = true
 			}
 		}
-	}()
+	})
 
-	go func() {
+	jc.goRun(func() {
 		down := false
 		for {
 			select {
@@ -46,7 +50,11 @@ func (jc *Juicer) runTestMode(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			}
-			jc.ecuChan <- ecu
+			select {
+			case jc.updateChan <- Update{Source: "ecu", Values: ecu.values()}:
+			case <-ctx.Done():
+				return
+			}
 
 			if down {
 				ecu.Speed -= 7
@@ -62,9 +70,9 @@ func (jc *Juicer) runTestMode(ctx context.Context) {
 				down = false
 			}
 		}
-	}()
+	})
 
-	go func() {
+	jc.goRun(func() {
 		down := false
 		for {
 			select {
@@ -72,7 +80,11 @@ func (jc *Juicer) runTestMode(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			}
-			jc.canSensorChan <- can
+			select {
+			case jc.updateChan <- Update{Source: "canbus", Values: can.values()}:
+			case <-ctx.Done():
+				return
+			}
 
 			if down {
 				can.CoolantTemp -= 5
@@ -88,5 +100,5 @@ func (jc *Juicer) runTestMode(ctx context.Context) {
 				down = false
 			}
 		}
-	}()
+	})
 }